@@ -0,0 +1,255 @@
+// SPDX-License-Identifier: Apache-2.0
+
+// Package capture saves what a device sends to a file, in one of several
+// formats, rotating the file when it grows too large, so that long-running
+// tests keep a full transcript.
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filmil/futility/uploader"
+)
+
+// Format is the format of a capture file.
+type Format int
+
+const (
+	// FormatText writes each line received on a line of its own, after the
+	// time it was received. It is the default.
+	FormatText Format = iota
+	// FormatRaw writes the bytes received as they are.
+	FormatRaw
+	// FormatJSON writes a JSON object for each line received, one to a line.
+	FormatJSON
+)
+
+var formatNames = map[Format]string{
+	FormatText: "text",
+	FormatRaw:  "raw",
+	FormatJSON: "jsonl",
+}
+
+func (f Format) String() string {
+	if name, ok := formatNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// ParseFormat parses a capture format: text, raw or jsonl.
+func ParseFormat(s string) (Format, error) {
+	for f, name := range formatNames {
+		if s == name {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown capture format: %q", s)
+}
+
+// ParseSize parses a size in bytes, with an optional K, M or G suffix for
+// kibibytes, mebibytes or gibibytes, such as "10M".
+func ParseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	digits := s
+	if mult > 1 {
+		digits = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size: %q", s)
+	}
+	return n * mult, nil
+}
+
+// Options configures a capture.
+type Options struct {
+	Format Format
+	// MaxSize, if set, is the size past which the file is rotated: it is
+	// renamed with a ".1" suffix, older files move on to ".2" and so on,
+	// and a new file is started. Records are not split between files,
+	// except raw data.
+	MaxSize int64
+	// Keep is the number of rotated files kept. With none, the file is
+	// started afresh when it is rotated.
+	Keep int
+}
+
+// Capture writes what a device sends to a file.
+type Capture struct {
+	path string
+	opts Options
+	now  func() time.Time
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	// err is the first error met, which Record cannot return.
+	err error
+}
+
+// Open opens a capture to path. The data is appended to the file if it
+// exists.
+func Open(path string, opts Options) (*Capture, error) {
+	c := &Capture{path: path, opts: opts, now: time.Now}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// open opens the file at c.path for appending.
+func (c *Capture) open() error {
+	f, err := os.OpenFile(c.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open capture file: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open capture file: %w", err)
+	}
+	c.f = f
+	c.size = fi.Size()
+	return nil
+}
+
+// record is a line in the jsonl format.
+type record struct {
+	Time time.Time `json:"time"`
+	// Line is the number of the line, starting at 1.
+	Line    int    `json:"line"`
+	Text    string `json:"text"`
+	Partial bool   `json:"partial,omitempty"`
+}
+
+// Record records e, if it holds data received: DataReceived for the raw
+// format, and LineReceived for the others, at e.Time, or now if it is zero.
+// It may be used as uploader.Options.OnEvent. Errors are kept for Close to
+// return.
+func (c *Capture) Record(e uploader.Event) {
+	at := e.Time
+	if at.IsZero() {
+		at = c.now()
+	}
+	var p []byte
+	switch {
+	case c.opts.Format == FormatRaw && e.Type == uploader.DataReceived:
+		p = e.Data
+	case c.opts.Format == FormatText && e.Type == uploader.LineReceived:
+		p = fmt.Appendf(nil, "%s %s\n", at.Format("2006-01-02 15:04:05.000"), e.Line)
+	case c.opts.Format == FormatJSON && e.Type == uploader.LineReceived:
+		b, err := json.Marshal(record{Time: at, Line: e.Count, Text: e.Line, Partial: e.Partial})
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		p = append(b, '\n')
+	default:
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.write(p)
+}
+
+// write writes p, rotating the file first if p would take it past
+// Options.MaxSize. Raw data is split to fill the file up to the limit. c.mu
+// must be held.
+func (c *Capture) write(p []byte) {
+	for len(p) > 0 && c.f != nil {
+		n := len(p)
+		if limit := c.opts.MaxSize; limit > 0 && c.size+int64(n) > limit {
+			switch {
+			case c.opts.Format == FormatRaw && c.size < limit:
+				n = int(limit - c.size)
+			case c.size > 0:
+				if err := c.rotate(); err != nil {
+					c.err = firstErr(c.err, err)
+					return
+				}
+				continue
+			}
+		}
+		m, err := c.f.Write(p[:n])
+		c.size += int64(m)
+		if err != nil {
+			c.err = firstErr(c.err, fmt.Errorf("failed to write capture file: %w", err))
+			return
+		}
+		p = p[n:]
+	}
+}
+
+// rotate moves the file out of the way, as Options.MaxSize says, and opens
+// a new one. c.mu must be held.
+func (c *Capture) rotate() error {
+	if err := c.f.Close(); err != nil {
+		return fmt.Errorf("failed to close capture file: %w", err)
+	}
+	c.f = nil
+	if c.opts.Keep <= 0 {
+		if err := os.Remove(c.path); err != nil {
+			return fmt.Errorf("failed to rotate capture file: %w", err)
+		}
+		return c.open()
+	}
+	for i := c.opts.Keep - 1; i >= 1; i-- {
+		err := os.Rename(rotated(c.path, i), rotated(c.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate capture file: %w", err)
+		}
+	}
+	if err := os.Rename(c.path, rotated(c.path, 1)); err != nil {
+		return fmt.Errorf("failed to rotate capture file: %w", err)
+	}
+	return c.open()
+}
+
+// rotated returns the name of the i'th rotated file.
+func rotated(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// fail keeps err, if it is the first error.
+func (c *Capture) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = firstErr(c.err, err)
+}
+
+// firstErr returns the first of the errors that is not nil.
+func firstErr(first, err error) error {
+	if first != nil {
+		return first
+	}
+	return err
+}
+
+// Close closes the file, and returns the first error met while capturing,
+// if any.
+func (c *Capture) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f != nil {
+		if err := c.f.Close(); err != nil {
+			c.err = firstErr(c.err, fmt.Errorf("failed to close capture file: %w", err))
+		}
+		c.f = nil
+	}
+	return c.err
+}
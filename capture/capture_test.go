@@ -0,0 +1,159 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package capture
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/filmil/futility/uploader"
+)
+
+// fixedTime is the time that the tests record events at.
+var fixedTime = time.Date(2024, 5, 1, 12, 30, 0, 250e6, time.UTC)
+
+func open(t *testing.T, opts Options) (*Capture, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "console.log")
+	c, err := Open(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.now = func() time.Time { return fixedTime }
+	return c, path
+}
+
+func read(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, f := range []Format{FormatText, FormatRaw, FormatJSON} {
+		if got, err := ParseFormat(f.String()); err != nil || got != f {
+			t.Errorf("ParseFormat(%q) = %v, %v", f.String(), got, err)
+		}
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Error("ParseFormat(\"xml\") succeeded, want an error")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for s, want := range map[string]int64{"0": 0, "512": 512, "4K": 4096, "10M": 10 << 20, "1G": 1 << 30} {
+		if got, err := ParseSize(s); err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "M", "-1", "1T"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("ParseSize(%q) succeeded, want an error", s)
+		}
+	}
+}
+
+func TestFormats(t *testing.T) {
+	events := []uploader.Event{
+		{Type: uploader.DataReceived, Data: []byte("boot\r\nlogin: ")},
+		{Type: uploader.LineReceived, Line: "boot", Count: 1},
+		{Type: uploader.Sent},
+		// The time of the event is used, rather than when it is recorded.
+		{Type: uploader.LineReceived, Time: fixedTime.Add(-time.Second), Line: "login: ", Count: 2, Partial: true},
+	}
+	tests := []struct {
+		format Format
+		want   string
+	}{
+		{FormatRaw, "boot\r\nlogin: "},
+		{FormatText, "2024-05-01 12:30:00.250 boot\n2024-05-01 12:29:59.250 login: \n"},
+		{FormatJSON, `{"time":"2024-05-01T12:30:00.25Z","line":1,"text":"boot"}` + "\n" +
+			`{"time":"2024-05-01T12:29:59.25Z","line":2,"text":"login: ","partial":true}` + "\n"},
+	}
+	for _, tt := range tests {
+		c, path := open(t, Options{Format: tt.format})
+		for _, e := range events {
+			c.Record(e)
+		}
+		if err := c.Close(); err != nil {
+			t.Fatalf("%v: Close() = %v", tt.format, err)
+		}
+		if got := read(t, path); got != tt.want {
+			t.Errorf("%v: captured %q, want %q", tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestJSONLines(t *testing.T) {
+	c, path := open(t, Options{Format: FormatJSON})
+	c.Record(uploader.Event{Type: uploader.LineReceived, Line: "a \"quoted\" line", Count: 1})
+	c.Close()
+	var r record
+	if err := json.Unmarshal([]byte(read(t, path)), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Text != "a \"quoted\" line" || !r.Time.Equal(fixedTime) {
+		t.Errorf("record = %+v", r)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	c, path := open(t, Options{Format: FormatText, MaxSize: 62, Keep: 2})
+	for i := 1; i <= 5; i++ {
+		// Each record is 31 bytes, so that two fit in a file.
+		c.Record(uploader.Event{Type: uploader.LineReceived, Line: "line " + string(rune('0'+i)), Count: i})
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		path:        "2024-05-01 12:30:00.250 line 5\n",
+		path + ".1": "2024-05-01 12:30:00.250 line 3\n2024-05-01 12:30:00.250 line 4\n",
+		path + ".2": "2024-05-01 12:30:00.250 line 1\n2024-05-01 12:30:00.250 line 2\n",
+	}
+	for name, w := range want {
+		if got := read(t, name); got != w {
+			t.Errorf("%s = %q, want %q", filepath.Base(name), got, w)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 exists, want only 2 rotated files", filepath.Base(path))
+	}
+}
+
+func TestRotateRaw(t *testing.T) {
+	c, path := open(t, Options{Format: FormatRaw, MaxSize: 4})
+	c.Record(uploader.Event{Type: uploader.DataReceived, Data: []byte("abcdefghij")})
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// With nothing kept, only the last part is left.
+	if got := read(t, path); got != "ij" {
+		t.Errorf("captured %q, want \"ij\"", got)
+	}
+}
+
+func TestOpenAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "console.log")
+	if err := os.WriteFile(path, []byte("old\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Open(path, Options{Format: FormatRaw, MaxSize: 6, Keep: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Record(uploader.Event{Type: uploader.DataReceived, Data: []byte("new")})
+	c.Close()
+	if got := read(t, path+".1"); got != "old\nne" {
+		t.Errorf("rotated file %q, want \"old\\nne\"", got)
+	}
+	if got := read(t, path); got != "w" {
+		t.Errorf("captured %q, want \"w\"", got)
+	}
+}
@@ -0,0 +1,149 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/filmil/futility/rawterm"
+	"github.com/filmil/futility/seriallib"
+	"github.com/filmil/futility/uploader"
+)
+
+var (
+	deviceName = flag.String("device", "", "serial port device name, or a selector such as usb:vid=0403,pid=6001,serial=A50285BI, by-path:NAME or by-id:NAME")
+	baudRate   = flag.Int("baud", 115200, "baud rate")
+	dataBits   = flag.Int("databits", 8, "data bits")
+	stopBits   = flag.Int("stopbits", 1, "stop bits")
+	parity     = flag.String("parity", "N", "parity (N, O, E)")
+	flow       = flag.String("flow", "none", "flow control (none, xonxoff, rtscts); xonxoff is only honored while a file is sent")
+	localEcho  = flag.Bool("local-echo", false, "show what is typed, for devices that do not echo it")
+	hex        = flag.Bool("hex", false, "show the data received as hex bytes")
+	inEOL      = flag.String("in-eol", "crlf", "line ending that the device sends: crlf shows the data as it is, and lf or cr show a bare LF or CR as a new line")
+	outEOL     = flag.String("out-eol", "cr", "what Enter sends: cr, lf or crlf")
+	logFile    = flag.String("session-log", "", "file to append the data received to, with the time at the start of each line")
+	protocol   = flag.String("protocol", "raw", "protocol of the files sent with Ctrl-] s (raw, xmodem, xmodem-crc, xmodem-1k, ymodem, zmodem)")
+	eol        = flag.String("eol", "", "line ending to send the lines of files with, with -protocol=raw: lf, cr or crlf. Empty to send files as they are")
+	charDelay  = flag.Duration("char-delay", 0, "time between the bytes of files sent with -protocol=raw, such as 1ms")
+	lineDelay  = flag.Duration("line-delay", 0, "extra wait after each line of files sent with -protocol=raw, such as 50ms")
+)
+
+// Config is the configuration of a terminal session.
+type Config struct {
+	DeviceName string
+	Mode       seriallib.Mode
+	LocalEcho  bool
+	Hex        bool
+	// InEOL is the line ending that the device sends, and OutEOL what Enter
+	// sends.
+	InEOL  uploader.LineEnding
+	OutEOL uploader.LineEnding
+	// Log, if set, receives the data received, with timestamps.
+	Log io.Writer
+	// Protocol, EOL and Pacing apply to the files sent.
+	Protocol uploader.Protocol
+	EOL      uploader.LineEnding
+	Pacing   seriallib.Pacing
+}
+
+func main() {
+	flag.Parse()
+	if *deviceName == "" {
+		log.Fatal("-device is required")
+	}
+	cfg, err := config()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := run(cfg); err != nil && !errors.Is(err, context.Canceled) {
+		log.Fatal(err)
+	}
+}
+
+// run opens the port and the log, and runs a session with the terminal in
+// raw mode. The terminal is restored when it returns.
+func run(cfg Config) error {
+	if *logFile != "" {
+		f, err := os.OpenFile(*logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to open log: %w", err)
+		}
+		defer f.Close()
+		cfg.Log = f
+	}
+
+	port, err := seriallib.Open(cfg.DeviceName)
+	if err != nil {
+		return fmt.Errorf("failed to open serial port: %w", err)
+	}
+	defer port.Close()
+
+	// Without raw mode, such as when stdin is not a terminal, Ctrl-C stops
+	// the program rather than going to the device.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if fd := int(os.Stdin.Fd()); rawterm.IsTerminal(fd) {
+		restore, err := rawterm.MakeRaw(fd)
+		if err != nil {
+			return fmt.Errorf("failed to put the terminal into raw mode: %w", err)
+		}
+		defer restore()
+	}
+
+	msg := rawterm.NewlineWriter(os.Stderr)
+	err = newTerm(ctx, port, cfg, os.Stdin, os.Stdout, msg).run()
+	fmt.Fprintln(msg)
+	return err
+}
+
+// config returns the configuration that the flags give.
+func config() (Config, error) {
+	cfg := Config{
+		DeviceName: *deviceName,
+		Mode: seriallib.Mode{
+			BaudRate: *baudRate,
+			DataBits: *dataBits,
+			StopBits: *stopBits,
+			Parity:   seriallib.ParityNone,
+		},
+		LocalEcho: *localEcho,
+		Hex:       *hex,
+		Protocol:  uploader.Protocol(*protocol),
+		Pacing:    seriallib.Pacing{CharDelay: *charDelay, LineDelay: *lineDelay},
+	}
+	switch *parity {
+	case "N":
+	case "O":
+		cfg.Mode.Parity = seriallib.ParityOdd
+	case "E":
+		cfg.Mode.Parity = seriallib.ParityEven
+	default:
+		return Config{}, fmt.Errorf("unknown parity: %q", *parity)
+	}
+	var err error
+	if cfg.Mode.FlowControl, err = seriallib.ParseFlowControl(*flow); err != nil {
+		return Config{}, err
+	}
+	if cfg.InEOL, err = uploader.ParseLineEnding(*inEOL); err != nil {
+		return Config{}, fmt.Errorf("bad -in-eol: %w", err)
+	}
+	if cfg.OutEOL, err = uploader.ParseLineEnding(*outEOL); err != nil {
+		return Config{}, fmt.Errorf("bad -out-eol: %w", err)
+	}
+	if cfg.OutEOL == uploader.LineEndingAny {
+		return Config{}, fmt.Errorf("bad -out-eol: %q, want cr, lf or crlf", *outEOL)
+	}
+	if *eol != "" {
+		if cfg.EOL, err = uploader.ParseLineEnding(*eol); err != nil {
+			return Config{}, fmt.Errorf("bad -eol: %w", err)
+		}
+	}
+	return cfg, nil
+}
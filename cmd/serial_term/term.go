@@ -0,0 +1,351 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/filmil/futility/seriallib"
+	"github.com/filmil/futility/uploader"
+)
+
+// ctrlC cancels an upload.
+const ctrlC = 0x03
+
+// parities are the parities that the p command goes through, in order.
+var parities = []seriallib.Parity{seriallib.ParityNone, seriallib.ParityEven, seriallib.ParityOdd}
+
+// outEOLs are the line endings that the n command goes through, in order.
+var outEOLs = []uploader.LineEnding{uploader.LineEndingCR, uploader.LineEndingLF, uploader.LineEndingCRLF}
+
+// inEOLs are the line endings that the m command goes through, in order.
+var inEOLs = []uploader.LineEnding{uploader.LineEndingCRLF, uploader.LineEndingLF, uploader.LineEndingCR}
+
+// term is a terminal session: what is received is shown, and what is typed
+// is sent, until the quit command is typed or the port closes.
+type term struct {
+	ctx    context.Context
+	port   seriallib.Port
+	cfg    Config
+	screen *view
+	// msg receives the messages of the local commands.
+	msg  io.Writer
+	keys <-chan []byte
+
+	// data receives what the reader reads, and is closed when it stops.
+	data <-chan []byte
+	// stopReader stops the reader, and shows what it read until then.
+	stopReader func()
+	// readErr is the error that the reader stopped with, other than io.EOF.
+	// It is set before data is closed.
+	readErr error
+
+	// typed tells what is typed from the local commands.
+	typed uploader.Keys
+	// dtr and rts are the states that the output lines were last set to.
+	dtr, rts bool
+}
+
+// newTerm returns a session on port, with the keys typed read from in, and
+// the data received shown on out.
+func newTerm(ctx context.Context, port seriallib.Port, cfg Config, in io.Reader, out, msg io.Writer) *term {
+	screen := &view{out: out, hex: cfg.Hex, eol: cfg.InEOL}
+	if cfg.Log != nil {
+		screen.log = newLogger(cfg.Log)
+	}
+	return &term{
+		ctx:    ctx,
+		port:   port,
+		cfg:    cfg,
+		screen: screen,
+		msg:    msg,
+		keys:   uploader.ReadKeys(in),
+		typed:  uploader.Keys{Messages: msg},
+		dtr:    true,
+		rts:    true,
+	}
+}
+
+// run runs the session until the quit command is typed, the port closes,
+// or ctx is done.
+func (t *term) run() error {
+	if err := t.port.SetMode(&t.cfg.Mode); err != nil {
+		return fmt.Errorf("failed to set serial port mode: %w", err)
+	}
+	fmt.Fprintf(t.msg, "connected to %s at %s; type Ctrl-] then ? for the local commands\n", t.cfg.DeviceName, modeString(t.cfg.Mode))
+	t.startReader()
+	defer func() { t.stopReader() }()
+	for {
+		select {
+		case p, ok := <-t.data:
+			if !ok {
+				if t.readErr != nil {
+					return fmt.Errorf("error reading from serial port: %w", t.readErr)
+				}
+				return nil
+			}
+			t.screen.Write(p)
+		case p, ok := <-t.keys:
+			if !ok {
+				// Nothing more can be typed; keep showing what is
+				// received.
+				t.keys = nil
+				continue
+			}
+			quit, err := t.typed.Handle(p, t.send, t.command)
+			if err != nil || quit {
+				return err
+			}
+		case <-t.ctx.Done():
+			return t.ctx.Err()
+		}
+	}
+}
+
+// startReader starts reading from the port in the background.
+func (t *term) startReader() {
+	ctx, cancel := context.WithCancel(t.ctx)
+	data := make(chan []byte)
+	t.data = data
+	t.stopReader = func() {
+		cancel()
+		for p := range data {
+			t.screen.Write(p)
+		}
+	}
+	go func() {
+		defer close(data)
+		for {
+			buf := make([]byte, 1024)
+			n, err := seriallib.ReadContext(ctx, t.port, buf)
+			if n > 0 {
+				data <- buf[:n]
+			}
+			if err != nil {
+				if ctx.Err() == nil && err != io.EOF {
+					t.readErr = err
+				}
+				return
+			}
+		}
+	}()
+}
+
+// send sends what was typed, with Enter as t.cfg.OutEOL says, and shows it
+// with the local echo on.
+func (t *term) send(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	p = bytes.ReplaceAll(p, []byte{'\r'}, t.cfg.OutEOL.Bytes())
+	if _, err := seriallib.WriteContext(t.ctx, t.port, p); err != nil {
+		return fmt.Errorf("failed to write to serial port: %w", err)
+	}
+	if t.cfg.LocalEcho {
+		t.screen.show(p)
+	}
+	return nil
+}
+
+// command runs a local command. It reports whether the command is quit.
+// Commands that fail are reported, and do not end the session.
+func (t *term) command(c uploader.Command) (bool, error) {
+	switch c {
+	case uploader.Quit:
+		return true, nil
+	case uploader.LocalEcho:
+		t.cfg.LocalEcho = !t.cfg.LocalEcho
+		t.status("local echo %s", uploader.OnOff(t.cfg.LocalEcho))
+	case uploader.HexView:
+		hex, _ := t.screen.settings()
+		t.screen.setHex(!hex)
+		t.status("hex view %s", uploader.OnOff(!hex))
+	case uploader.InEOL:
+		_, eol := t.screen.settings()
+		eol = next(inEOLs, eol)
+		t.screen.setEOL(eol)
+		t.status("device line ending %v", eol)
+	case uploader.OutEOL:
+		t.cfg.OutEOL = next(outEOLs, t.cfg.OutEOL)
+		t.status("Enter sends %v", t.cfg.OutEOL)
+	case uploader.Parity:
+		mode := t.cfg.Mode
+		mode.Parity = next(parities, mode.Parity)
+		t.setMode(mode)
+	case uploader.BaudRate:
+		t.typed.Ask("baud rate: ", func(answer string) error {
+			rate, err := strconv.Atoi(answer)
+			if err != nil || rate <= 0 {
+				t.status("bad baud rate %q", answer)
+				return nil
+			}
+			mode := t.cfg.Mode
+			mode.BaudRate = rate
+			t.setMode(mode)
+			return nil
+		})
+	case uploader.Break:
+		if err := seriallib.SendBreak(t.port, uploader.BreakLength); err != nil {
+			t.status("break failed: %v", err)
+		} else {
+			t.status("break sent")
+		}
+	case uploader.ToggleDTR:
+		if err := t.port.SetDTR(!t.dtr); err != nil {
+			t.status("%v", err)
+		} else {
+			t.dtr = !t.dtr
+			t.status("DTR %s", uploader.OnOff(t.dtr))
+		}
+	case uploader.ToggleRTS:
+		if err := t.port.SetRTS(!t.rts); err != nil {
+			t.status("%v", err)
+		} else {
+			t.rts = !t.rts
+			t.status("RTS %s", uploader.OnOff(t.rts))
+		}
+	case uploader.SendFile:
+		t.typed.Ask("file to send: ", t.upload)
+	default:
+		t.help()
+	}
+	return false, nil
+}
+
+// setMode changes the mode of the port, keeping the old one if that fails.
+func (t *term) setMode(mode seriallib.Mode) {
+	if err := t.port.SetMode(&mode); err != nil {
+		t.status("failed to set %s: %v", modeString(mode), err)
+		return
+	}
+	t.cfg.Mode = mode
+	t.status("%s", modeString(mode))
+}
+
+// status reports the outcome of a local command, and logs it.
+func (t *term) status(format string, args ...any) {
+	text := fmt.Sprintf(format, args...)
+	fmt.Fprintf(t.msg, "\n[%s]\n", text)
+	if t.screen.log != nil {
+		t.screen.log.note("%s", text)
+	}
+}
+
+// help lists the local commands.
+func (t *term) help() {
+	uploader.WriteHelp(t.msg, uploader.DefaultEscape, uploader.Quit, uploader.LocalEcho, uploader.HexView,
+		uploader.InEOL, uploader.OutEOL, uploader.BaudRate, uploader.Parity, uploader.Break,
+		uploader.ToggleDTR, uploader.ToggleRTS, uploader.SendFile, uploader.Help)
+	hex, eol := t.screen.settings()
+	fmt.Fprintf(t.msg, "now: %s, local echo %s, hex view %s, device line ending %v, Enter sends %v, DTR %s, RTS %s\n",
+		modeString(t.cfg.Mode), uploader.OnOff(t.cfg.LocalEcho), uploader.OnOff(hex), eol, t.cfg.OutEOL, uploader.OnOff(t.dtr), uploader.OnOff(t.rts))
+}
+
+// upload sends the named file as serial_upload does, over the port that the
+// session has open. While it runs, the uploader reads the port, and Ctrl-]
+// or Ctrl-C cancels it; anything else typed is dropped.
+func (t *term) upload(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		t.status("%v", err)
+		return nil
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.status("%v", err)
+		return nil
+	}
+
+	t.stopReader()
+	defer t.startReader()
+	ctx, cancel := context.WithCancel(t.ctx)
+	defer cancel()
+	stop := t.watchKeys(cancel)
+	defer stop()
+
+	mode := t.cfg.Mode
+	opts := uploader.Options{
+		Mode:      &mode,
+		Protocol:  t.cfg.Protocol,
+		EOL:       t.cfg.EOL,
+		Pacing:    t.cfg.Pacing,
+		RawOutput: t.screen,
+		OnEvent:   t.progress,
+	}
+	file := uploader.File{Name: filepath.Base(name), Size: fi.Size(), ModTime: fi.ModTime(), Data: f}
+	err = uploader.RunFiles(ctx, t.port, []uploader.File{file}, opts)
+	switch {
+	case t.ctx.Err() != nil:
+		return t.ctx.Err()
+	case ctx.Err() != nil:
+		t.status("upload canceled")
+	case err != nil:
+		t.status("upload failed: %v", err)
+	}
+	return nil
+}
+
+// watchKeys takes the keys typed until the returned function is called, and
+// calls cancel when Ctrl-] or Ctrl-C is typed.
+func (t *term) watchKeys(cancel func()) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	keys := t.keys
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case p, ok := <-keys:
+				if !ok {
+					keys = nil
+					continue
+				}
+				if slices.Contains(p, uploader.DefaultEscape) || slices.Contains(p, ctrlC) {
+					cancel()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// progress reports the progress of an upload.
+func (t *term) progress(e uploader.Event) {
+	switch e.Type {
+	case uploader.Sending:
+		fmt.Fprintf(t.msg, "\n[sending %s with %s; Ctrl-] cancels]\n", e.File, t.cfg.Protocol)
+		if t.screen.log != nil {
+			t.screen.log.note("sending %s", e.File)
+		}
+	case uploader.ChunkSent:
+		if e.Data == nil && e.Size > 0 {
+			fmt.Fprintf(t.msg, "\r[%d/%d bytes]", e.Offset, e.Size)
+		}
+	case uploader.Sent:
+		t.status("file sent")
+	}
+}
+
+// next returns the value that follows v in values, or the first one.
+func next[T comparable](values []T, v T) T {
+	i := slices.Index(values, v)
+	return values[(i+1)%len(values)]
+}
+
+// modeString describes a mode, such as "115200 8N1".
+func modeString(m seriallib.Mode) string {
+	return fmt.Sprintf("%d %d%c%d", m.BaudRate, m.DataBits, m.Parity, m.StopBits)
+}
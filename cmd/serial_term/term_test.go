@@ -0,0 +1,152 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filmil/futility/seriallib"
+	"github.com/filmil/futility/seriallib/serialtest"
+	"github.com/filmil/futility/uploader"
+)
+
+// syncBuffer is a bytes.Buffer that can be read while it is written.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// session is a terminal session running in the background.
+type session struct {
+	port *serialtest.Port
+	keys *io.PipeWriter
+	out  syncBuffer
+	msg  syncBuffer
+	done chan error
+}
+
+func startSession(t *testing.T, cfg Config) *session {
+	t.Helper()
+	cfg.Mode = seriallib.Mode{BaudRate: 115200, DataBits: 8, StopBits: 1, Parity: seriallib.ParityNone}
+	in, keys := io.Pipe()
+	s := &session{port: serialtest.NewPort(), keys: keys, done: make(chan error, 1)}
+	go func() {
+		s.done <- newTerm(context.Background(), s.port, cfg, in, &s.out, &s.msg).run()
+	}()
+	t.Cleanup(func() { keys.Close() })
+	return s
+}
+
+// typeKeys types keys into the session.
+func (s *session) typeKeys(t *testing.T, keys string) {
+	t.Helper()
+	if _, err := s.keys.Write([]byte(keys)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// wait waits for the session to end.
+func (s *session) wait(t *testing.T) {
+	t.Helper()
+	select {
+	case err := <-s.done:
+		if err != nil {
+			t.Fatalf("run() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session did not end")
+	}
+}
+
+// waitFor waits until cond is true.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTermCommands(t *testing.T) {
+	var log syncBuffer
+	s := startSession(t, Config{OutEOL: uploader.LineEndingCRLF, LocalEcho: true, Log: &log})
+
+	s.typeKeys(t, "ls\r\x1d\x1d")
+	waitFor(t, "the typed line", func() bool { return string(s.port.Written()) == "ls\r\n\x1d" })
+	s.port.Feed([]byte("hello\n"))
+	waitFor(t, "the data received", func() bool { return strings.Contains(s.out.String(), "hello") })
+
+	s.typeKeys(t, "\x1dp")
+	waitFor(t, "the parity", func() bool { return s.port.Mode().Parity == seriallib.ParityEven })
+	// The baud rate is typed with a mistake, erased with a backspace.
+	s.typeKeys(t, "\x1db96x\x7f00\r")
+	waitFor(t, "the baud rate", func() bool { return s.port.Mode().BaudRate == 9600 })
+	s.typeKeys(t, "\x1dk\x1dd\x1dx")
+	waitFor(t, "the break and DTR", func() bool {
+		dtr, _ := s.port.Lines()
+		return len(s.port.Breaks()) == 1 && !dtr
+	})
+	s.port.Feed([]byte("A"))
+	waitFor(t, "the hex view", func() bool { return strings.HasSuffix(s.out.String(), "41 ") })
+	s.typeKeys(t, "\x1dq")
+	s.wait(t)
+
+	if out := s.out.String(); !strings.HasPrefix(out, "ls\r\n") {
+		t.Errorf("screen %q does not start with the local echo", out)
+	}
+	if got := log.String(); !strings.Contains(got, " hello\n") || !strings.Contains(got, " --- 9600 8E1\n") {
+		t.Errorf("log %q lacks the data received or the baud rate change", got)
+	}
+}
+
+func TestTermUpload(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "main.py")
+	if err := os.WriteFile(name, []byte("print(1)\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := startSession(t, Config{Protocol: uploader.Raw, EOL: uploader.LineEndingCRLF})
+	s.typeKeys(t, "\x1ds"+name+"\r")
+	waitFor(t, "the file", func() bool { return string(s.port.Written()) == "print(1)\r\n" })
+	waitFor(t, "the end of the upload", func() bool { return strings.Contains(s.msg.String(), "[file sent]") })
+
+	// The session reads the port again once the upload is done.
+	s.port.Feed([]byte("1\r\n"))
+	waitFor(t, "the data received", func() bool { return s.out.String() == "1\r\n" })
+	s.typeKeys(t, "\x1dsmissing\r\x1dq")
+	s.wait(t)
+	if !strings.Contains(s.msg.String(), "missing") {
+		t.Errorf("messages %q do not report the missing file", s.msg.String())
+	}
+}
+
+func TestTermPortClosed(t *testing.T) {
+	s := startSession(t, Config{})
+	s.port.Feed([]byte("bye"))
+	s.port.CloseInput()
+	s.wait(t)
+	if got := s.out.String(); got != "bye" {
+		t.Errorf("screen %q, want \"bye\"", got)
+	}
+}
@@ -0,0 +1,156 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/filmil/futility/uploader"
+)
+
+// hexWidth is the number of bytes in a row of the hex view.
+const hexWidth = 16
+
+// view shows the data received on the screen, as text or in hex, and copies
+// it to the log. During an upload, the data is written by the uploader's
+// reader, while the session reports the progress.
+type view struct {
+	out io.Writer
+	log *logger
+
+	// mu guards the fields below, and the writes to out.
+	mu sync.Mutex
+	// hex shows the data as hex bytes, hexWidth to a row.
+	hex bool
+	// eol is the line ending that the device sends; a bare LF or CR is shown
+	// as a CRLF, as the terminal is in raw mode.
+	eol     uploader.LineEnding
+	afterCR bool
+	// col is the number of bytes in the current hex row.
+	col int
+}
+
+// Write shows p, and logs it.
+func (v *view) Write(p []byte) (int, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.log != nil {
+		v.log.Write(p)
+	}
+	v.draw(p)
+	return len(p), nil
+}
+
+// show shows p on the screen, without logging it, as for the local echo.
+func (v *view) show(p []byte) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.draw(p)
+}
+
+// draw shows p on the screen. v.mu must be held.
+func (v *view) draw(p []byte) {
+	var out []byte
+	for _, b := range p {
+		if v.hex {
+			out = fmt.Appendf(out, "%02x ", b)
+			if v.col++; v.col == hexWidth {
+				out = append(out, '\r', '\n')
+				v.col = 0
+			}
+			continue
+		}
+		switch {
+		case b == '\n' && v.eol == uploader.LineEndingLF && !v.afterCR:
+			out = append(out, '\r', '\n')
+		case b == '\r' && v.eol == uploader.LineEndingCR:
+			out = append(out, '\r', '\n')
+		default:
+			out = append(out, b)
+		}
+		v.afterCR = b == '\r'
+	}
+	v.out.Write(out)
+}
+
+// setHex switches between the text and the hex view, starting the new view
+// on a line of its own.
+func (v *view) setHex(hex bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.hex && v.col > 0 {
+		v.out.Write([]byte("\r\n"))
+	}
+	v.hex = hex
+	v.col = 0
+	v.afterCR = false
+}
+
+// setEOL changes the line ending that the device sends.
+func (v *view) setEOL(eol uploader.LineEnding) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.eol = eol
+	v.afterCR = false
+}
+
+// settings returns whether the hex view is on, and the line ending that the
+// device sends.
+func (v *view) settings() (hex bool, eol uploader.LineEnding) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.hex, v.eol
+}
+
+// logger writes data to a log file, with the time that each line started
+// to arrive at its start.
+type logger struct {
+	w   io.Writer
+	now func() time.Time
+
+	// mu guards midLine, and the writes to w.
+	mu sync.Mutex
+	// midLine is set when the last byte written did not end a line.
+	midLine bool
+}
+
+// logTime is the format of the times in the log.
+const logTime = "2006-01-02 15:04:05.000"
+
+func newLogger(w io.Writer) *logger {
+	return &logger{w: w, now: time.Now}
+}
+
+// Write logs p. Lines end at LF.
+func (l *logger) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var out []byte
+	for _, b := range p {
+		if !l.midLine {
+			out = append(out, l.now().Format(logTime)...)
+			out = append(out, ' ')
+		}
+		out = append(out, b)
+		l.midLine = b != '\n'
+	}
+	if _, err := l.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// note logs a local event, such as a change of baud rate, on a line of its
+// own.
+func (l *logger) note(format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.midLine {
+		l.w.Write([]byte{'\n'})
+		l.midLine = false
+	}
+	fmt.Fprintf(l.w, "%s --- %s\n", l.now().Format(logTime), fmt.Sprintf(format, args...))
+}
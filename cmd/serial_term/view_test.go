@@ -0,0 +1,89 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/filmil/futility/uploader"
+)
+
+func TestViewText(t *testing.T) {
+	tests := []struct {
+		eol  uploader.LineEnding
+		want string
+	}{
+		{eol: uploader.LineEndingCRLF, want: "a\nb\rc\r\n"},
+		{eol: uploader.LineEndingLF, want: "a\r\nb\rc\r\n"},
+		{eol: uploader.LineEndingCR, want: "a\nb\r\nc\r\n\n"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		v := &view{out: &out, eol: tt.eol}
+		v.Write([]byte("a\nb\rc\r"))
+		v.Write([]byte("\n"))
+		if got := out.String(); got != tt.want {
+			t.Errorf("%v: shown %q, want %q", tt.eol, got, tt.want)
+		}
+	}
+}
+
+func TestViewHex(t *testing.T) {
+	var out bytes.Buffer
+	v := &view{out: &out}
+	v.Write([]byte("a"))
+	v.setHex(true)
+	v.Write([]byte("0123456789abcdefg"))
+	v.setHex(false)
+	v.Write([]byte("z"))
+	want := "a30 31 32 33 34 35 36 37 38 39 61 62 63 64 65 66 \r\n67 \r\nz"
+	if got := out.String(); got != want {
+		t.Errorf("shown %q, want %q", got, want)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var out bytes.Buffer
+	l := newLogger(&out)
+	l.now = func() time.Time { return time.Date(2024, 5, 1, 12, 30, 0, 250e6, time.UTC) }
+	l.Write([]byte("boot\nlog"))
+	l.note("baud %d", 9600)
+	l.Write([]byte("in: ok\n"))
+	want := "2024-05-01 12:30:00.250 boot\n" +
+		"2024-05-01 12:30:00.250 log\n" +
+		"2024-05-01 12:30:00.250 --- baud 9600\n" +
+		"2024-05-01 12:30:00.250 in: ok\n"
+	if got := out.String(); got != want {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+}
+
+func TestLoggerConcurrent(t *testing.T) {
+	// During an upload, the data received and the progress notes are logged
+	// from different goroutines.
+	var out bytes.Buffer
+	v := &view{out: io.Discard, log: newLogger(&out)}
+	v.log.now = func() time.Time { return time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC) }
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			v.Write([]byte("da"))
+			v.Write([]byte("ta\n"))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		v.log.note("sent")
+	}
+	<-done
+	// A note may split the data, but each line has one time, at its start.
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		if !strings.HasPrefix(line, "2024-05-01 12:30:00.000 ") || strings.Count(line, "2024") != 1 {
+			t.Errorf("logged %q", line)
+		}
+	}
+}
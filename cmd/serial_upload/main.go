@@ -3,145 +3,472 @@
 package main
 
 import (
-	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/signal"
-
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/filmil/futility/capture"
+	"github.com/filmil/futility/rawterm"
 	"github.com/filmil/futility/seriallib"
+	"github.com/filmil/futility/uploader"
 )
 
 var (
-	fileName   = flag.String("file", "", "file name to upload")
-	deviceName = flag.String("device", "", "serial port device name")
+	fileNames  fileList
+	deviceName = flag.String("device", "", "serial port device name, or a selector such as usb:vid=0403,pid=6001,serial=A50285BI, by-path:NAME or by-id:NAME")
 	baudRate   = flag.Int("baud", 115200, "baud rate")
 	startBits  = flag.Int("startbits", 8, "start bits")
 	stopBits   = flag.Int("stopbits", 1, "stop bits")
 	parity     = flag.String("parity", "N", "parity (N, O, E)")
 	prompt     = flag.String("prompt", "", "prompt line to wait for before uploading; if empty, upload immediately")
+	promptRe   = flag.String("prompt-regex", "", "regular expression for the prompt to wait for, instead of -prompt; matches lines in which it finds a match")
+	promptSub  = flag.Bool("prompt-substring", false, "match any line containing -prompt, rather than only the line equal to it")
+	promptPart = flag.Bool("prompt-partial", false, "also match the prompt against the line being received, before its line ending arrives")
+	promptTime = flag.Duration("prompt-timeout", 0, "give up waiting for the prompt after this long, and exit with status 3; 0 to wait forever")
+	retries    = flag.Int("prompt-retries", 0, "number of times to wait for the prompt again after -prompt-timeout")
+	wake       = flag.String("wake", "", "string to send when starting to wait for the prompt, on each retry, and every -wake-interval, with Go escapes such as \\r\\n or \\x03 for Ctrl-C")
+	wakeEvery  = flag.Duration("wake-interval", 2*time.Second, "how often to send -wake again while waiting for the prompt; 0 to send it only when the wait starts, and on each retry")
 	linger     = flag.Bool("linger", false, "linger after upload and echo serial output to stdout")
+	untilPass  = flag.String("until-success", "", "regular expression that ends lingering, and the program with status 0, when a line received matches it, such as ^PASS; the port closing first exits with status 2. Implies -linger, and other errors then exit with status 4")
+	untilFail  = flag.String("until-failure", "", "regular expression that ends lingering, and the program with status 1, when a line received matches it, such as ^FAIL. Implies -linger")
+	lingerTime = flag.Duration("linger-timeout", 0, "stop lingering after this long, and exit with status 2; 0 to linger until the port closes. Implies -linger")
+	interact   = flag.Bool("interactive", false, "after the upload, send what is typed to the device, with the terminal in raw mode; Ctrl-] then ? lists the local commands. Implies -linger and -raw-output")
 	lineBuffer = flag.Bool("line-buffer", false, "wait for an XON character to arrive after a single line has been emitted before sending the next line")
+	separator  = flag.String("separator", "", "string to send between files with -protocol=raw, with Go escapes such as \\x04 for Ctrl-D")
+	promptEach = flag.Bool("prompt-each", false, "wait for the prompt again before each file with -protocol=raw, rather than only before the first")
+	eol        = flag.String("eol", "", "line ending to send lines with: lf, cr or crlf; CR, LF and CRLF in the file all become it. Empty to send the file as it is")
+	charset    = flag.String("charset", "utf-8", "character set to send UTF-8 text in: utf-8, latin1 or ascii")
+	translate  = flag.Bool("translate-received", false, "also translate the data received, from -charset to UTF-8, with its line endings made LF if -eol is set")
+	charDelay  = flag.Duration("char-delay", 0, "time between the bytes sent, for devices without flow control, such as 1ms")
+	lineDelay  = flag.Duration("line-delay", 0, "extra wait after each line sent, such as 50ms")
+	maxRate    = flag.Int("max-rate", 0, "maximum number of bytes sent per second; 0 for no limit")
+	ack        = flag.String("ack", "", "text that the device answers each line with, such as ok, found anywhere in a received line other than the echo of the line sent; each line is sent once the one before it is acknowledged")
+	ackRe      = flag.String("ack-regex", "", "regular expression for the answer to each line, instead of -ack, matched against the received lines other than the echo of the line sent")
+	nak        = flag.String("nak", "", "text that the device answers a line it wants sent again with, such as error; needs -ack or -ack-regex")
+	nakRe      = flag.String("nak-regex", "", "regular expression for the answer to a line to send again, instead of -nak")
+	ackTime    = flag.Duration("ack-timeout", 0, "send a line again if it is not acknowledged within this long; 0 to wait forever")
+	ackTries   = flag.Int("ack-retries", 0, "number of times to send a line again, after -nak or -ack-timeout, before giving up")
 	logFlag    = flag.Bool("log", false, "log to stderr all the lines sent")
+	protocol   = flag.String("protocol", "raw", "upload protocol (raw, xmodem, xmodem-crc, xmodem-1k, ymodem, zmodem)")
+	resume     = flag.Bool("resume", false, "ask the receiver to resume partially received files (zmodem only)")
+	flow       = flag.String("flow", "xonxoff", "flow control (none, xonxoff, rtscts); with none and rtscts, XON and XOFF are sent and received as data")
+	receive    = flag.String("receive", "drop", "what to do with received XON and XOFF characters under xonxoff flow control: drop, pass (keep them in the output), send-only (honor them only while sending), or escape (show them as ^Q and ^S)")
+	rawOutput  = flag.Bool("raw-output", false, "write the bytes received to stdout unchanged, instead of quoted lines; progress goes to stderr")
+	lineEnding = flag.String("line-ending", "any", "what ends a received line: any (CR, LF or CRLF), lf, cr or crlf")
+	idleFlush  = flag.Duration("idle-flush", 500*time.Millisecond, "show a received partial line after nothing has been received for this long; 0 to wait for the line ending")
+	resetSeq   = flag.String("reset-sequence", "", "DTR/RTS sequence to run before waiting for the prompt: a preset (arduino-1200bps-touch, esp32-classic, pulse-dtr), or steps such as dtr=0,rts=1,sleep=100ms,rts=0")
+	scriptFile = flag.String("script", "", "expect/send script to run instead of uploading -file; see the README for its commands")
+	echo       = flag.String("echo", "off", "check the device's echo of the data sent with the raw protocol: off, char (send a character at a time) or line (send a line at a time, ending it only once its echo matches)")
+	echoTime   = flag.Duration("echo-timeout", time.Second, "how long to wait for the echo with -echo")
+	echoTries  = flag.Int("echo-retries", 0, "number of times to erase and send again a line or character whose echo differs, with -echo")
+	capFile    = flag.String("capture", "", "file to save the data received to, appending to it if it exists")
+	capFormat  = flag.String("capture-format", "text", "format of the -capture file: text (each line after the time it was received), raw (the bytes received) or jsonl (a JSON object for each line)")
+	capMaxSize = flag.String("capture-max-size", "0", "rotate the -capture file once it would grow past this size, such as 10M; 0 for no limit")
+	capKeep    = flag.Int("capture-keep", 5, "number of rotated -capture files to keep, as FILE.1, FILE.2 and so on")
+	outFormat  = flag.String("output", "text", "how to report progress: text, or json for a JSON object for each event, one to a line")
+	list       = flag.Bool("list", false, "list the serial ports present, and exit")
+	listFormat = flag.String("list-format", "table", "format of the -list output (table, json)")
 )
 
+func init() {
+	flag.Var(&fileNames, "file", "file name to upload, or - for stdin; may be a glob or a directory, and may be repeated with -protocol=raw, ymodem or zmodem")
+}
+
+// fileList is a flag that may be given more than once.
+type fileList []string
+
+func (f *fileList) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *fileList) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// expandGlobs replaces each pattern by the files it matches, in order, and
+// each directory by the files in it, in name order. A pattern that matches
+// nothing is kept as-is, so that opening it reports a sensible error, and
+// so is "-", for stdin.
+func expandGlobs(patterns []string) ([]string, error) {
+	var files []string
+	for _, p := range patterns {
+		if p == stdinName {
+			files = append(files, p)
+			continue
+		}
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return nil, fmt.Errorf("bad file pattern %q: %w", p, err)
+		}
+		if len(matches) == 0 {
+			matches = []string{p}
+		}
+		for _, m := range matches {
+			if fi, err := os.Stat(m); err != nil || !fi.IsDir() {
+				files = append(files, m)
+				continue
+			}
+			entries, err := os.ReadDir(m)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				if e.Type().IsRegular() {
+					files = append(files, filepath.Join(m, e.Name()))
+				}
+			}
+		}
+	}
+	return files, nil
+}
+
+// stdinName is the file name that stands for stdin.
+const stdinName = "-"
+
 type Config struct {
-	FileName   string
-	DeviceName string
-	BaudRate   int
-	StartBits  int
-	StopBits   int
-	Parity     string
-	Prompt     string
-	Linger     bool
-	LineBuffer bool
-	Log        bool
-	Output     io.Writer
-	Copy       bool
+	FileName string
+	// FileNames lists the files to upload in a batch. If empty, FileName is
+	// uploaded alone.
+	FileNames     []string
+	DeviceName    string
+	BaudRate      int
+	StartBits     int
+	StopBits      int
+	Parity        string
+	Prompt        string
+	Linger        bool
+	LineBuffer    bool
+	Log           bool
+	Protocol      string
+	Resume        bool
+	Output        io.Writer
+	Copy          bool
+	ResetSequence []uploader.ResetStep
+	// Flow is the flow control setting. Empty means xonxoff.
+	Flow string
+	// Receive is the receive mode, as parsed by uploader.ParseReceiveMode.
+	// Empty means drop.
+	Receive string
+	// RawOutput writes the received bytes to Output as they are.
+	RawOutput bool
+	// LineEnding is what ends a received line, as parsed by
+	// uploader.ParseLineEnding. Empty means any.
+	LineEnding string
+	// IdleFlush is how long to wait before showing a partial line.
+	IdleFlush time.Duration
+	// PromptRegex, if set, is the prompt to wait for instead of Prompt.
+	PromptRegex     string
+	PromptSubstring bool
+	PromptPartial   bool
+	PromptTimeout   time.Duration
+	PromptRetries   int
+	// Wake is sent to wake the device up while waiting for the prompt.
+	Wake string
+	// WakeInterval, if set, is how often Wake is sent again.
+	WakeInterval time.Duration
+	// Separator is sent between files.
+	Separator  string
+	PromptEach bool
+	// EOL and Charset translate the data sent, as parsed by
+	// uploader.ParseLineEnding and uploader.ParseCharset. Empty means none.
+	EOL     string
+	Charset string
+	// Translate also translates the data received.
+	Translate bool
+	// CharDelay, LineDelay and MaxRate pace the data sent.
+	CharDelay time.Duration
+	LineDelay time.Duration
+	MaxRate   int
+	// Ack and Nak are matched as substrings; AckRegex and NakRegex, if set,
+	// are used instead.
+	Ack        string
+	AckRegex   string
+	Nak        string
+	NakRegex   string
+	AckTimeout time.Duration
+	AckRetries int
+	// Echo is the echo mode, as parsed by uploader.ParseEchoMode. Empty
+	// means off.
+	Echo        string
+	EchoTimeout time.Duration
+	EchoRetries int
+	// Script, if set, is the expect/send script to run instead of uploading
+	// the files.
+	Script string
+	// Interactive sends what is typed to the device while lingering, from
+	// Input, or from stdin in raw mode if Input is nil.
+	Interactive bool
+	Input       io.Reader
+	// Capture, if set, is the file to save the data received to, in
+	// CaptureFormat, as parsed by capture.ParseFormat. Empty means text.
+	Capture       string
+	CaptureFormat string
+	// CaptureMaxSize and CaptureKeep rotate the capture file.
+	CaptureMaxSize int64
+	CaptureKeep    int
+	// OutputFormat is how progress is reported: text or json. Empty means
+	// text.
+	OutputFormat string
+	// UntilSuccess and UntilFailure, if set, are the regular expressions
+	// for the lines that end lingering; LingerTimeout, if set, ends it after
+	// that long. They imply Linger.
+	UntilSuccess  string
+	UntilFailure  string
+	LingerTimeout time.Duration
+
+	// Reporter, if set, reports progress, as built by newReporter. If not,
+	// one is built for OutputFormat.
+	Reporter reporter
 }
 
 // port is an interface that represents a serial port.
 // It is used to abstract the real serial port implementation for testing.
 type port interface {
-	io.ReadWriteCloser
-	SetMode(mode *seriallib.Mode) error
+	seriallib.Port
 }
 
 func main() {
 	flag.Parse()
 
-	if *fileName == "" {
-		log.Fatal("-file is required")
+	if *list {
+		ports, err := seriallib.ListPorts()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := printPorts(os.Stdout, ports, *listFormat); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(fileNames) == 0 && *scriptFile == "" {
+		log.Fatal("-file or -script is required")
+	}
+	files, err := expandGlobs(fileNames)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(files) == 0 {
+		files = []string{""}
 	}
 	if *deviceName == "" {
 		log.Fatal("-device is required")
 	}
+	wakeString, err := unescape(*wake)
+	if err != nil {
+		log.Fatalf("bad -wake: %v", err)
+	}
+	separatorString, err := unescape(*separator)
+	if err != nil {
+		log.Fatalf("bad -separator: %v", err)
+	}
+	captureMaxSize, err := capture.ParseSize(*capMaxSize)
+	if err != nil {
+		log.Fatalf("bad -capture-max-size: %v", err)
+	}
+	var resetSequence []uploader.ResetStep
+	if *resetSeq != "" {
+		if resetSequence, err = uploader.ParseResetSequence(*resetSeq); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	cfg := Config{
-		FileName:   *fileName,
-		DeviceName: *deviceName,
-		BaudRate:   *baudRate,
-		StartBits:  *startBits,
-		StopBits:   *stopBits,
-		Parity:     *parity,
-		Prompt:     *prompt,
-		Linger:     *linger,
-		LineBuffer: *lineBuffer,
-		Log:        *logFlag,
-		Output:     os.Stdout,
+		FileName:        files[0],
+		FileNames:       files,
+		DeviceName:      *deviceName,
+		BaudRate:        *baudRate,
+		StartBits:       *startBits,
+		StopBits:        *stopBits,
+		Parity:          *parity,
+		Prompt:          *prompt,
+		Linger:          *linger,
+		LineBuffer:      *lineBuffer,
+		Log:             *logFlag,
+		Protocol:        *protocol,
+		Resume:          *resume,
+		Output:          os.Stdout,
+		ResetSequence:   resetSequence,
+		Flow:            *flow,
+		Receive:         *receive,
+		RawOutput:       *rawOutput,
+		LineEnding:      *lineEnding,
+		IdleFlush:       *idleFlush,
+		PromptRegex:     *promptRe,
+		PromptSubstring: *promptSub,
+		PromptPartial:   *promptPart,
+		PromptTimeout:   *promptTime,
+		PromptRetries:   *retries,
+		Wake:            wakeString,
+		WakeInterval:    *wakeEvery,
+		Separator:       separatorString,
+		PromptEach:      *promptEach,
+		EOL:             *eol,
+		Charset:         *charset,
+		Translate:       *translate,
+		CharDelay:       *charDelay,
+		LineDelay:       *lineDelay,
+		MaxRate:         *maxRate,
+		Ack:             *ack,
+		AckRegex:        *ackRe,
+		Nak:             *nak,
+		NakRegex:        *nakRe,
+		AckTimeout:      *ackTime,
+		AckRetries:      *ackTries,
+		Echo:            *echo,
+		EchoTimeout:     *echoTime,
+		EchoRetries:     *echoTries,
+		Script:          *scriptFile,
+		Interactive:     *interact,
+		Capture:         *capFile,
+		CaptureFormat:   *capFormat,
+		CaptureMaxSize:  captureMaxSize,
+		CaptureKeep:     *capKeep,
+		OutputFormat:    *outFormat,
+		UntilSuccess:    *untilPass,
+		UntilFailure:    *untilFail,
+		LingerTimeout:   *lingerTime,
 	}
+	rep, err := newReporter(cfg, len(files))
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.Reporter = rep
 
 	port, err := seriallib.Open(cfg.DeviceName)
 	if err != nil {
-		log.Fatalf("failed to open serial port: %v", err)
+		err = fmt.Errorf("failed to open serial port: %w", err)
+		rep.fail(err)
+		os.Exit(cfg.exitCode(err))
 	}
 	defer port.Close()
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
+	defer closeOnCancel(ctx, port)()
 
-	go func() {
-		<-ctx.Done()
-		fmt.Printf("\nReceived interrupt, closing serial port.\n")
+	run := upload
+	if cfg.Script != "" {
+		run = runScript
+	}
+	if err := run(ctx, cfg, port); err != nil {
+		rep.fail(err)
 		port.Close()
-	}()
+		os.Exit(cfg.exitCode(err))
+	}
+}
 
-	if err := upload(cfg, port); err != nil {
-		// When the port is closed by the signal handler, upload will return an error.
-		// We log it and exit, which is reasonable behavior.
-		log.Fatal(err)
+// closeOnCancel closes port once ctx is done, so that a write held up by
+// flow control, which ctx alone cannot interrupt, ends as well. The returned
+// function stops it.
+func closeOnCancel(ctx context.Context, port port) func() bool {
+	return context.AfterFunc(ctx, func() { port.Close() })
+}
+
+// exitCode returns the exit status for the error that the program ends with,
+// or 0 for none. When the outcome of a test is watched for, errors other
+// than a failure seen exit with 4, so that they are not taken for one.
+func (c *Config) exitCode(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, context.Canceled):
+		return 130
+	case errors.Is(err, uploader.ErrPromptTimeout), errors.Is(err, uploader.ErrExpectTimeout):
+		return 3
+	case errors.Is(err, uploader.ErrLingerTimeout), errors.Is(err, uploader.ErrNoOutcome):
+		return 2
+	case errors.Is(err, uploader.ErrFailure):
+		return 1
+	case c.UntilSuccess != "" || c.UntilFailure != "" || c.LingerTimeout > 0:
+		return 4
 	}
+	return 1
 }
 
-type chanReader struct {
-	ch    <-chan byte
-	errCh <-chan error
-	err   error
+// unescape interprets the escapes of a Go string literal in s, such as \r,
+// \n and \x03.
+func unescape(s string) (string, error) {
+	return strconv.Unquote(`"` + strings.ReplaceAll(s, `"`, `\"`) + `"`)
 }
 
-func (r *chanReader) Read(p []byte) (int, error) {
-	if r.err != nil {
-		return 0, r.err
+// printPorts writes the list of ports to w, in the given format.
+func printPorts(w io.Writer, ports []seriallib.PortInfo, format string) error {
+	switch format {
+	case "json":
+		if ports == nil {
+			ports = []seriallib.PortInfo{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(ports)
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "DEVICE\tVID\tPID\tSERIAL\tMANUFACTURER\tPRODUCT\tINTERFACE")
+		for _, p := range ports {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				p.Path, p.VID, p.PID, p.SerialNumber, p.Manufacturer, p.Product, p.Interface)
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown list format: %q", format)
 	}
-	if len(p) == 0 {
-		return 0, nil
+}
+
+// files returns the names of all the files to upload.
+func (c *Config) files() []string {
+	if len(c.FileNames) == 0 {
+		return []string{c.FileName}
 	}
+	return c.FileNames
+}
 
-	b, ok := <-r.ch
-	if !ok {
-		select {
-		case err := <-r.errCh:
-			r.err = err
-			if err == io.EOF {
-				return 0, io.EOF
+// openFiles opens the named files, or none of them, with "-" standing for
+// stdin. The caller must close the files.
+func openFiles(names []string) ([]*os.File, error) {
+	var files []*os.File
+	stdin := false
+	for _, name := range names {
+		if name == stdinName {
+			if stdin {
+				for _, f := range files {
+					f.Close()
+				}
+				return nil, errors.New("stdin can only be uploaded once")
 			}
-			return 0, err
-		default:
-			return 0, io.EOF
+			stdin = true
+			files = append(files, os.Stdin)
+			continue
 		}
-	}
-	p[0] = b
-	n := 1
-
-	for i := 1; i < len(p); i++ {
-		select {
-		case b, ok := <-r.ch:
-			if !ok {
-				return n, nil
+		file, err := os.Open(name)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
 			}
-			p[i] = b
-			n++
-		default:
-			return n, nil
+			return nil, fmt.Errorf("failed to open file: %w", err)
 		}
+		files = append(files, file)
 	}
-	return n, nil
+	return files, nil
 }
 
-func upload(cfg Config, port port) error {
+// options returns the uploader options that cfg gives, reporting progress
+// for the given number of files.
+func options(cfg Config, files int) (uploader.Options, error) {
 	p := seriallib.ParityNone
 	switch cfg.Parity {
 	case "O":
@@ -149,252 +476,479 @@ func upload(cfg Config, port port) error {
 	case "E":
 		p = seriallib.ParityEven
 	}
-
-	if err := port.SetMode(&seriallib.Mode{
-		BaudRate: cfg.BaudRate,
-		DataBits: cfg.StartBits,
-		StopBits: cfg.StopBits,
-		Parity:   p,
-	}); err != nil {
-		return fmt.Errorf("failed to set serial port mode: %w", err)
-	}
-
-	byteCh := make(chan byte, 1024*1024)
-	errCh := make(chan error, 1)
-	pauseCh := make(chan bool, 10)
-
-	go func() {
-		buf := make([]byte, 1024)
-		for {
-			n, err := port.Read(buf)
-			if n > 0 {
-				for i := 0; i < n; i++ {
-					b := buf[i]
-					if b == 0x13 { // XOFF
-						if cfg.Log {
-							fmt.Fprintln(os.Stderr, "received: XOFF")
-						}
-						pauseCh <- true
-					} else if b == 0x11 { // XON
-						if cfg.Log {
-							fmt.Fprintln(os.Stderr, "received: XON")
-						}
-						pauseCh <- false
-					} else {
-						byteCh <- b
-					}
-				}
-			}
-			if err != nil {
-				errCh <- err
-				close(byteCh)
-				return
-			}
+	flow := seriallib.FlowXONXOFF
+	if cfg.Flow != "" {
+		var err error
+		if flow, err = seriallib.ParseFlowControl(cfg.Flow); err != nil {
+			return uploader.Options{}, err
 		}
-	}()
+	}
 
-	cr := &chanReader{ch: byteCh, errCh: errCh}
-	scanner := bufio.NewScanner(cr)
+	var receive uploader.ReceiveMode
+	if cfg.Receive != "" {
+		var err error
+		if receive, err = uploader.ParseReceiveMode(cfg.Receive); err != nil {
+			return uploader.Options{}, err
+		}
+	}
 
-	lineCh := make(chan string, 1024)
-	go func() {
-		for scanner.Scan() {
-			lineCh <- scanner.Text()
+	var ending uploader.LineEnding
+	if cfg.LineEnding != "" {
+		var err error
+		if ending, err = uploader.ParseLineEnding(cfg.LineEnding); err != nil {
+			return uploader.Options{}, err
 		}
-		close(lineCh)
-	}()
+	}
 
-	recvLineCount := 0
-	sentLineCount := 0
+	var eol uploader.LineEnding
+	if cfg.EOL != "" {
+		var err error
+		if eol, err = uploader.ParseLineEnding(cfg.EOL); err != nil {
+			return uploader.Options{}, err
+		}
+	}
 
-	// recvLine prints, and optionally copies, a line received from the port.
-	recvLine := func(line string) {
-		recvLineCount++
-		fmt.Printf("> [%d] %q\n", recvLineCount, line)
-		if cfg.Copy {
-			fmt.Fprintln(cfg.Output, line)
+	var charset uploader.Charset
+	if cfg.Charset != "" {
+		var err error
+		if charset, err = uploader.ParseCharset(cfg.Charset); err != nil {
+			return uploader.Options{}, err
 		}
 	}
 
-	// sendFile uploads the configured file to the serial port, honoring
-	// XON/XOFF flow control and the optional line-buffering mode.
-	sendFile := func() error {
-		file, err := os.Open(cfg.FileName)
-		if err != nil {
-			return fmt.Errorf("failed to open file: %w", err)
-		}
-		defer file.Close()
-
-		buf := make([]byte, 64)
-		paused := false
-		var sendErr error
-		br := bufio.NewReader(file)
-	SendLoop:
-		for {
-			for {
-				select {
-				case p := <-pauseCh:
-					paused = p
-					continue
-				case line, ok := <-lineCh:
-					if ok {
-						recvLine(line)
-					}
-					continue
-				default:
-				}
-				break
-			}
+	var echo uploader.EchoMode
+	if cfg.Echo != "" {
+		var err error
+		if echo, err = uploader.ParseEchoMode(cfg.Echo); err != nil {
+			return uploader.Options{}, err
+		}
+	}
 
-			if paused {
-				select {
-				case p := <-pauseCh:
-					paused = p
-				case err := <-errCh:
-					sendErr = err
-					break SendLoop
-				case line, ok := <-lineCh:
-					if ok {
-						recvLine(line)
-					}
-				}
-				continue
-			}
+	var promptRe *regexp.Regexp
+	if cfg.PromptRegex != "" {
+		var err error
+		if promptRe, err = regexp.Compile(cfg.PromptRegex); err != nil {
+			return uploader.Options{}, fmt.Errorf("bad -prompt-regex: %w", err)
+		}
+	}
 
-			var toWrite []byte
-			var readErr error
+	ackRegexp, err := answerRegexp(cfg.Ack, cfg.AckRegex, "-ack-regex")
+	if err != nil {
+		return uploader.Options{}, err
+	}
+	nakRegexp, err := answerRegexp(cfg.Nak, cfg.NakRegex, "-nak-regex")
+	if err != nil {
+		return uploader.Options{}, err
+	}
+	success, err := answerRegexp("", cfg.UntilSuccess, "-until-success")
+	if err != nil {
+		return uploader.Options{}, err
+	}
+	failure, err := answerRegexp("", cfg.UntilFailure, "-until-failure")
+	if err != nil {
+		return uploader.Options{}, err
+	}
 
-			if cfg.LineBuffer {
-				toWrite, readErr = br.ReadBytes('\n')
-			} else {
-				n, err := br.Read(buf)
-				if n > 0 {
-					toWrite = buf[:n]
-				}
-				readErr = err
-			}
+	rep := cfg.Reporter
+	if rep == nil {
+		if rep, err = newReporter(cfg, files); err != nil {
+			return uploader.Options{}, err
+		}
+	}
 
-			if len(toWrite) > 0 {
-				for len(toWrite) > 0 {
-					for {
-						select {
-						case p := <-pauseCh:
-							paused = p
-							continue
-						case line, ok := <-lineCh:
-							if ok {
-								recvLine(line)
-							}
-							continue
-						default:
-						}
-						break
-					}
-
-					if paused {
-						select {
-						case p := <-pauseCh:
-							paused = p
-						case err := <-errCh:
-							sendErr = err
-							break SendLoop
-						case line, ok := <-lineCh:
-							if ok {
-								recvLine(line)
-							}
-						}
-						continue
-					}
-
-					chunkSize := 64
-					if len(toWrite) < chunkSize {
-						chunkSize = len(toWrite)
-					}
-
-					if _, err := port.Write(toWrite[:chunkSize]); err != nil {
-						sendErr = fmt.Errorf("failed to write to serial port: %w", err)
-						break SendLoop
-					}
-
-					if cfg.Log {
-						sentLineCount++
-						fmt.Fprintf(os.Stderr, "sent [%d]: %q\n", sentLineCount, string(toWrite[:chunkSize]))
-					}
-
-					toWrite = toWrite[chunkSize:]
-				}
+	pacing := seriallib.Pacing{
+		CharDelay:      cfg.CharDelay,
+		LineDelay:      cfg.LineDelay,
+		BytesPerSecond: cfg.MaxRate,
+	}
 
-				if cfg.LineBuffer {
-					paused = true
-				}
-			}
+	opts := uploader.Options{
+		Mode: &seriallib.Mode{
+			BaudRate:    cfg.BaudRate,
+			DataBits:    cfg.StartBits,
+			StopBits:    cfg.StopBits,
+			Parity:      p,
+			FlowControl: flow,
+		},
+		Prompt:          cfg.Prompt,
+		Linger:          cfg.Linger,
+		LineBuffer:      cfg.LineBuffer,
+		Protocol:        uploader.Protocol(cfg.Protocol),
+		Resume:          cfg.Resume,
+		ResetSequence:   cfg.ResetSequence,
+		Receive:         receive,
+		LineEnding:      ending,
+		IdleFlush:       cfg.IdleFlush,
+		PromptSubstring: cfg.PromptSubstring,
+		PromptRegexp:    promptRe,
+		PromptPartial:   cfg.PromptPartial,
+		PromptTimeout:   cfg.PromptTimeout,
+		PromptRetries:   cfg.PromptRetries,
+		Wake:            []byte(cfg.Wake),
+		WakeInterval:    cfg.WakeInterval,
+		Separator:       []byte(cfg.Separator),
+		PromptEach:      cfg.PromptEach,
+		EOL:             eol,
+		Charset:         charset,
+		Pacing:          pacing,
+		Ack:             ackRegexp,
+		Nak:             nakRegexp,
+		AckTimeout:      cfg.AckTimeout,
+		AckRetries:      cfg.AckRetries,
+		Echo:            echo,
+		EchoTimeout:     cfg.EchoTimeout,
+		EchoRetries:     cfg.EchoRetries,
+		OnEvent:         rep.report,
+	}
+	if cfg.Copy {
+		opts.Output = cfg.Output
+	}
+	if cfg.RawOutput || cfg.Interactive {
+		opts.RawOutput = cfg.Output
+	}
+	if cfg.Interactive {
+		opts.Linger = true
+		opts.Terminal = terminal(cfg)
+	}
+	if success != nil || failure != nil || cfg.LingerTimeout > 0 {
+		opts.Linger = true
+		opts.Success = success
+		opts.Failure = failure
+		opts.LingerTimeout = cfg.LingerTimeout
+	}
+	opts.TranslateReceived = cfg.Translate
+	// A selector finds the device again, wherever it comes back.
+	opts.Reopen = func() (seriallib.Port, error) {
+		return seriallib.Open(cfg.DeviceName)
+	}
+	return opts, nil
+}
 
-			if readErr == io.EOF {
-				break
-			}
-			if readErr != nil {
-				sendErr = fmt.Errorf("failed to read file: %w", readErr)
-				break
-			}
+// terminal returns the interactive terminal that cfg gives. When typing at
+// a terminal on stdin, it is put into raw mode once the upload is done, so
+// that each key, Ctrl-C included, goes to the device.
+func terminal(cfg Config) *uploader.Terminal {
+	t := &uploader.Terminal{Input: cfg.Input, Messages: rawterm.NewlineWriter(os.Stderr)}
+	if t.Input != nil {
+		return t
+	}
+	t.Input = os.Stdin
+	fd := int(os.Stdin.Fd())
+	if !rawterm.IsTerminal(fd) {
+		return t
+	}
+	t.Start = func() (func(), error) {
+		restore, err := rawterm.MakeRaw(fd)
+		if err != nil {
+			return nil, err
 		}
+		return func() { restore() }, nil
+	}
+	return t
+}
 
-		if sendErr != nil {
-			return sendErr
+// answerRegexp returns the regular expression for an answer to a line sent:
+// re if set, or else one that finds text, or nil if neither is set. flag
+// names re in errors.
+func answerRegexp(text, re, flag string) (*regexp.Regexp, error) {
+	switch {
+	case re != "":
+		r, err := regexp.Compile(re)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s: %w", flag, err)
 		}
-		fmt.Printf("file sent\n")
-		return nil
+		return r, nil
+	case text != "":
+		return regexp.MustCompile(regexp.QuoteMeta(text)), nil
 	}
+	return nil, nil
+}
 
-	// linger echoes any further lines received from the port until it closes.
-	linger := func() error {
-		fmt.Println("lingering...")
-		for line := range lineCh {
-			recvLine(line)
-		}
-		if err := scanner.Err(); err != nil {
-			return fmt.Errorf("error reading from serial port: %w", err)
-		}
-		return nil
+// upload sends the configured files over port, until done or until ctx is
+// canceled.
+func upload(ctx context.Context, cfg Config, port port) error {
+	opts, err := options(cfg, len(cfg.files()))
+	if err != nil {
+		return err
+	}
+	if cfg.Interactive && cfg.Input == nil && slices.Contains(cfg.files(), stdinName) {
+		return errors.New("stdin cannot be both uploaded and typed in with -interactive")
 	}
 
-	// With no prompt configured, upload immediately without waiting.
-	if cfg.Prompt == "" {
-		fmt.Printf("sending file\n")
-		if err := sendFile(); err != nil {
-			return err
-		}
-		if cfg.Linger {
-			return linger()
+	osFiles, err := openFiles(cfg.files())
+	if err != nil {
+		return err
+	}
+	var files []uploader.File
+	for _, f := range osFiles {
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to stat file: %w", err)
 		}
-		fmt.Println("done")
-		return nil
+		files = append(files, uploader.File{
+			Name:    filepath.Base(f.Name()),
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+			Data:    f,
+		})
+	}
+
+	closeCapture, err := startCapture(cfg, &opts)
+	if err != nil {
+		return err
 	}
+	return closeCapture(uploader.RunFiles(ctx, port, files, opts))
+}
 
-	prompt := true
-	for line := range lineCh {
-		if prompt {
-			fmt.Printf("waiting for prompt %q\n", cfg.Prompt)
-			prompt = false
+// runScript runs the configured script over port, until done or until ctx is
+// canceled.
+func runScript(ctx context.Context, cfg Config, port port) error {
+	opts, err := options(cfg, 0)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(cfg.Script)
+	if err != nil {
+		return fmt.Errorf("failed to open script: %w", err)
+	}
+	defer f.Close()
+	script, err := uploader.ParseScript(f)
+	if err != nil {
+		return err
+	}
+	closeCapture, err := startCapture(cfg, &opts)
+	if err != nil {
+		return err
+	}
+	return closeCapture(uploader.RunScript(ctx, port, script, opts))
+}
+
+// startCapture opens the capture file that cfg names, if any, and makes opts
+// record the events in it as well. The returned function closes the file,
+// and returns the error that the session ended with, or else the error met
+// while capturing.
+func startCapture(cfg Config, opts *uploader.Options) (func(error) error, error) {
+	if cfg.Capture == "" {
+		return func(err error) error { return err }, nil
+	}
+	format := capture.FormatText
+	if cfg.CaptureFormat != "" {
+		var err error
+		if format, err = capture.ParseFormat(cfg.CaptureFormat); err != nil {
+			return nil, err
 		}
-		recvLine(line)
-		if line == cfg.Prompt {
-			fmt.Printf("prompt received, sending file\n")
-			if err := sendFile(); err != nil {
-				return err
-			}
-			if cfg.Linger {
-				fmt.Println("lingering...")
-				prompt = true
-			} else {
-				fmt.Println("done")
-				return nil
-			}
+	}
+	c, err := capture.Open(cfg.Capture, capture.Options{
+		Format:  format,
+		MaxSize: cfg.CaptureMaxSize,
+		Keep:    cfg.CaptureKeep,
+	})
+	if err != nil {
+		return nil, err
+	}
+	onEvent := opts.OnEvent
+	opts.OnEvent = func(e uploader.Event) {
+		c.Record(e)
+		onEvent(e)
+	}
+	return func(err error) error {
+		if captureErr := c.Close(); err == nil {
+			err = captureErr
 		}
+		return err
+	}, nil
+}
+
+// reporter reports the progress of the program, and the error that it ends
+// with. All that the program tells, other than the data received and the
+// -list output, goes through it.
+type reporter interface {
+	// report reports an event of the session.
+	report(e uploader.Event)
+	// fail reports the error that the program ends with.
+	fail(err error)
+}
+
+// newReporter returns the reporter for the format that cfg.OutputFormat
+// names, reporting progress for the given number of files.
+func newReporter(cfg Config, files int) (reporter, error) {
+	switch cfg.OutputFormat {
+	case "", "text":
+		return newPrinter(cfg, files), nil
+	case "json":
+		return newJSONReporter(cfg), nil
 	}
+	return nil, fmt.Errorf("unknown output format: %q", cfg.OutputFormat)
+}
+
+// jsonReporter reports each event as a JSON object on a line of its own, as
+// uploader.Event.MarshalJSON encodes it, and the error that the program ends
+// with as an "error" event. The objects go to cfg.Output, or to stderr if
+// cfg.Output is left to the data received.
+type jsonReporter struct {
+	enc *json.Encoder
+}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading from serial port: %w", err)
+func newJSONReporter(cfg Config) *jsonReporter {
+	var out io.Writer = cfg.Output
+	switch {
+	case cfg.Interactive:
+		// The terminal may be in raw mode.
+		out = rawterm.NewlineWriter(os.Stderr)
+	case cfg.RawOutput:
+		out = os.Stderr
 	}
+	return &jsonReporter{enc: json.NewEncoder(out)}
+}
+
+func (r *jsonReporter) report(e uploader.Event) {
+	r.enc.Encode(e)
+}
+
+func (r *jsonReporter) fail(err error) {
+	msg := err.Error()
+	if errors.Is(err, context.Canceled) {
+		msg = "interrupted"
+	}
+	r.enc.Encode(struct {
+		Time  time.Time `json:"time"`
+		Type  string    `json:"event"`
+		Error string    `json:"error"`
+	}{time.Now(), "error", msg})
+}
 
-	return fmt.Errorf("prompt not found")
+// printer reports the progress of an upload to stdout, and with -log, the
+// data sent to stderr. With -raw-output, stdout is left to the received
+// data, and progress goes to stderr.
+type printer struct {
+	out       io.Writer
+	log       bool
+	raw       bool
+	term      bool
+	files     int
+	sentCount int
+}
+
+func newPrinter(cfg Config, files int) *printer {
+	p := &printer{out: os.Stdout, log: cfg.Log, raw: cfg.RawOutput, files: files}
+	if cfg.RawOutput {
+		p.out = os.Stderr
+	}
+	if cfg.Interactive {
+		// The terminal may be in raw mode.
+		p.raw = true
+		p.term = true
+		p.out = rawterm.NewlineWriter(os.Stderr)
+	}
+	return p
+}
+
+func (p *printer) fail(err error) {
+	if errors.Is(err, context.Canceled) {
+		fmt.Fprintf(p.out, "\nReceived interrupt, closing serial port.\n")
+		return
+	}
+	log.Print(err)
+}
+
+func (p *printer) report(e uploader.Event) {
+	switch e.Type {
+	case uploader.Resetting:
+		fmt.Fprintf(p.out, "running reset sequence\n")
+	case uploader.WakeSent:
+		fmt.Fprintf(p.out, "sending wake-up string %q\n", e.Data)
+	case uploader.PromptTimedOut:
+		fmt.Fprintf(p.out, "prompt not seen, attempt %d\n", e.Count)
+	case uploader.WaitingForPrompt:
+		fmt.Fprintf(p.out, "waiting for prompt %q\n", e.Line)
+	case uploader.PromptSeen:
+		fmt.Fprintf(p.out, "prompt received, sending file\n")
+	case uploader.Sending:
+		switch {
+		case e.File != "":
+			fmt.Fprintf(p.out, "sending %s\n", e.File)
+		case p.files > 1:
+			fmt.Fprintf(p.out, "sending %d files\n", p.files)
+		default:
+			fmt.Fprintf(p.out, "sending file\n")
+		}
+	case uploader.ChunkSent:
+		switch {
+		case e.Data != nil:
+			if p.log {
+				p.sentCount++
+				if e.SourceOffset != e.Offset {
+					fmt.Fprintf(os.Stderr, "sent [%d] (file offset %d): %q\n", p.sentCount, e.SourceOffset, string(e.Data))
+				} else {
+					fmt.Fprintf(os.Stderr, "sent [%d]: %q\n", p.sentCount, string(e.Data))
+				}
+			}
+		case e.Restarted:
+			fmt.Fprintf(p.out, "%s: resending from %d\n", e.File, e.Offset)
+		case e.File != "" && e.Block != 0:
+			fmt.Fprintf(p.out, "%s: block %d: %d/%d bytes\n", e.File, e.Block, e.Offset, e.Size)
+		case e.File != "":
+			fmt.Fprintf(p.out, "%s: %d/%d bytes\n", e.File, e.Offset, e.Size)
+		default:
+			fmt.Fprintf(p.out, "block %d: %d/%d bytes\n", e.Block, e.Offset, e.Size)
+		}
+	case uploader.Paused:
+		if p.log {
+			fmt.Fprintln(os.Stderr, "received: XOFF")
+		}
+	case uploader.Resumed:
+		if p.log {
+			fmt.Fprintln(os.Stderr, "received: XON")
+		}
+	case uploader.LineReceived:
+		switch {
+		case p.raw:
+		case e.Partial:
+			fmt.Fprintf(p.out, "> [%d] %q (partial)\n", e.Count, e.Line)
+		default:
+			fmt.Fprintf(p.out, "> [%d] %q\n", e.Count, e.Line)
+		}
+	case uploader.LineResent:
+		if len(e.Data) > 0 {
+			fmt.Fprintf(p.out, "line %d rejected with %q, sending it again\n", e.Count, e.Data)
+		} else {
+			fmt.Fprintf(p.out, "line %d not acknowledged, sending it again\n", e.Count)
+		}
+	case uploader.EchoMismatch:
+		fmt.Fprintf(p.out, "echo mismatch at offset %d, attempt %d: sent %q, device echoed %q\n", e.Offset, e.Count, e.Line, e.Data)
+	case uploader.ScriptStep:
+		fmt.Fprintf(p.out, "script line %d: %s\n", e.Count, e.Line)
+	case uploader.Sent:
+		switch {
+		case e.File != "":
+			fmt.Fprintf(p.out, "%s sent\n", e.File)
+		case p.files > 1:
+			fmt.Fprintf(p.out, "%d files sent\n", p.files)
+		default:
+			fmt.Fprintf(p.out, "file sent\n")
+		}
+	case uploader.Lingering:
+		if p.term {
+			fmt.Fprintln(p.out, "connected; type Ctrl-] then ? for the local commands")
+		} else {
+			fmt.Fprintln(p.out, "lingering...")
+		}
+	case uploader.LocalCommand:
+		if e.Err != nil {
+			fmt.Fprintf(p.out, "\n%s failed: %v\n", e.Line, e.Err)
+		} else {
+			fmt.Fprintf(p.out, "\n[%s]\n", e.Line)
+		}
+	case uploader.PatternMatched:
+		if e.Err != nil {
+			fmt.Fprintf(p.out, "failure seen in line %d: %q\n", e.Count, e.Line)
+		} else {
+			fmt.Fprintf(p.out, "success seen in line %d: %q\n", e.Count, e.Line)
+		}
+	case uploader.Done:
+		if e.Err == nil {
+			fmt.Fprintln(p.out, "done")
+		}
+	}
 }
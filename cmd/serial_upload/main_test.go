@@ -4,16 +4,22 @@ package main
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/creack/pty"
 	"github.com/filmil/futility/seriallib"
+	"github.com/filmil/futility/seriallib/serialtest"
 	"golang.org/x/sys/unix"
 )
 
@@ -28,6 +34,14 @@ func (m *mockPort) SetMode(mode *seriallib.Mode) error {
 	return nil
 }
 
+func (m *mockPort) SetDTR(bool) error { return nil }
+
+func (m *mockPort) SetRTS(bool) error { return nil }
+
+func (m *mockPort) GetModemStatus() (seriallib.ModemStatus, error) {
+	return seriallib.ModemStatus{}, nil
+}
+
 func TestUpload(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -92,7 +106,7 @@ func TestUpload(t *testing.T) {
 			errCh := make(chan error, 1)
 			go func() {
 				mport := &mockPort{pts}
-				errCh <- upload(cfg, mport)
+				errCh <- upload(context.Background(), cfg, mport)
 			}()
 
 			// Give the program a moment to start up and wait for the prompt.
@@ -175,7 +189,7 @@ func TestUploadLinger(t *testing.T) {
 	errCh := make(chan error, 1)
 	go func() {
 		mport := &mockPort{pts}
-		errCh <- upload(cfg, mport)
+		errCh <- upload(context.Background(), cfg, mport)
 	}()
 
 	// Wait for startup
@@ -260,6 +274,14 @@ func (m *customMockPort) SetMode(mode *seriallib.Mode) error {
 	return nil
 }
 
+func (m *customMockPort) SetDTR(bool) error { return nil }
+
+func (m *customMockPort) SetRTS(bool) error { return nil }
+
+func (m *customMockPort) GetModemStatus() (seriallib.ModemStatus, error) {
+	return seriallib.ModemStatus{}, nil
+}
+
 func TestUploadLineBuffer(t *testing.T) {
 	fileContent := "line1\nline2\nline3"
 	prompt := "PROMPT\n"
@@ -313,7 +335,7 @@ func TestUploadLineBuffer(t *testing.T) {
 
 	errCh := make(chan error, 1)
 	go func() {
-		errCh <- upload(cfg, mport)
+		errCh <- upload(context.Background(), cfg, mport)
 	}()
 
 	// Wait for line1
@@ -410,7 +432,7 @@ func TestUploadNoPrompt(t *testing.T) {
 
 	errCh := make(chan error, 1)
 	go func() {
-		errCh <- upload(cfg, mport)
+		errCh <- upload(context.Background(), cfg, mport)
 	}()
 
 	var got []byte
@@ -491,7 +513,7 @@ func TestUploadXONXOFF(t *testing.T) {
 
 	errCh := make(chan error, 1)
 	go func() {
-		errCh <- upload(cfg, mport)
+		errCh <- upload(context.Background(), cfg, mport)
 	}()
 
 	// Wait for a write. It shouldn't write because it received XOFF immediately.
@@ -560,10 +582,7 @@ func TestSignalHandlerClosesPort(t *testing.T) {
 		},
 	}
 
-	go func() {
-		<-ctx.Done()
-		mport.Close()
-	}()
+	defer closeOnCancel(ctx, mport)()
 
 	proc, err := os.FindProcess(os.Getpid())
 	if err != nil {
@@ -580,3 +599,565 @@ func TestSignalHandlerClosesPort(t *testing.T) {
 		t.Error("port not closed after SIGINT")
 	}
 }
+
+func TestUploadXModem(t *testing.T) {
+	fileContent := strings.Repeat("x", 200)
+
+	tmpfile, err := os.CreateTemp("", "upload-xmodem-test-")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmpfile.Name())
+	if _, err := tmpfile.Write([]byte(fileContent)); err != nil {
+		t.Fatalf("failed to write to temp file: %v", err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatalf("failed to close temp file: %v", err)
+	}
+
+	cfg := Config{
+		FileName:   tmpfile.Name(),
+		DeviceName: "mock",
+		Prompt:     "PROMPT",
+		Protocol:   "xmodem-crc",
+		Output:     io.Discard,
+	}
+
+	readCh := make(chan byte, 100)
+	writeCh := make(chan []byte, 100)
+	for _, b := range []byte("PROMPT\n") {
+		readCh <- b
+	}
+
+	mport := &customMockPort{
+		readFunc: func(p []byte) (int, error) {
+			b, ok := <-readCh
+			if !ok {
+				return 0, io.EOF
+			}
+			p[0] = b
+			return 1, nil
+		},
+		writeFunc: func(p []byte) (int, error) {
+			b := make([]byte, len(p))
+			copy(b, p)
+			writeCh <- b
+			// Acknowledge every block, and the final EOT.
+			readCh <- 0x06
+			return len(p), nil
+		},
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- upload(context.Background(), cfg, mport)
+	}()
+
+	// Keep asking for a CRC transfer until the first block arrives, as a
+	// real receiver would.
+	var packets [][]byte
+Handshake:
+	for {
+		select {
+		case b := <-writeCh:
+			packets = append(packets, b)
+			break Handshake
+		case <-time.After(50 * time.Millisecond):
+			readCh <- 'C'
+		}
+	}
+	for len(packets) < 3 {
+		select {
+		case b := <-writeCh:
+			packets = append(packets, b)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for packets; got %d", len(packets))
+		}
+	}
+
+	var got []byte
+	for i, p := range packets[:2] {
+		if p[0] != 0x01 || p[1] != byte(i+1) || len(p) != 133 {
+			t.Fatalf("packet %d has unexpected framing: % x", i, p[:3])
+		}
+		got = append(got, p[3:131]...)
+	}
+	if string(bytes.TrimRight(got, "\x1a")) != fileContent {
+		t.Errorf("got %q, want %q", got, fileContent)
+	}
+	if !bytes.Equal(packets[2], []byte{0x04}) {
+		t.Errorf("got %q, want EOT", packets[2])
+	}
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Errorf("upload function returned an error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("upload function did not return after sending file")
+	}
+}
+
+func TestExpandGlobs(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"b.bin", "a.bin", "c.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sub := filepath.Join(dir, "sub")
+	if err := os.MkdirAll(filepath.Join(sub, "nested"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"y.py", "x.py"} {
+		if err := os.WriteFile(filepath.Join(sub, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := expandGlobs([]string{
+		filepath.Join(dir, "c.txt"),
+		filepath.Join(dir, "*.bin"),
+		filepath.Join(dir, "missing"),
+		"-",
+		sub,
+	})
+	if err != nil {
+		t.Fatalf("expandGlobs: %v", err)
+	}
+	want := []string{
+		filepath.Join(dir, "c.txt"),
+		filepath.Join(dir, "a.bin"),
+		filepath.Join(dir, "b.bin"),
+		filepath.Join(dir, "missing"),
+		"-",
+		filepath.Join(sub, "x.py"),
+		filepath.Join(sub, "y.py"),
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPrintPorts(t *testing.T) {
+	ports := []seriallib.PortInfo{
+		{Path: "/dev/ttyS0"},
+		{
+			Path:         "/dev/ttyUSB0",
+			VID:          "0403",
+			PID:          "6001",
+			SerialNumber: "A50285BI",
+			Manufacturer: "FTDI",
+			Product:      "FT232R",
+			Interface:    "00",
+		},
+	}
+
+	var table bytes.Buffer
+	if err := printPorts(&table, ports, "table"); err != nil {
+		t.Fatalf("printPorts: %v", err)
+	}
+	wantTable := "" +
+		"DEVICE        VID   PID   SERIAL    MANUFACTURER  PRODUCT  INTERFACE\n" +
+		"/dev/ttyS0\n" +
+		"/dev/ttyUSB0  0403  6001  A50285BI  FTDI          FT232R   00\n"
+	// Empty trailing columns leave padding, which does not matter.
+	var lines []string
+	for _, line := range strings.Split(table.String(), "\n") {
+		lines = append(lines, strings.TrimRight(line, " "))
+	}
+	if got := strings.Join(lines, "\n"); got != wantTable {
+		t.Errorf("table output:\n%s\nwant:\n%s", got, wantTable)
+	}
+
+	var js bytes.Buffer
+	if err := printPorts(&js, ports, "json"); err != nil {
+		t.Fatalf("printPorts: %v", err)
+	}
+	var got []seriallib.PortInfo
+	if err := json.Unmarshal(js.Bytes(), &got); err != nil {
+		t.Fatalf("bad JSON %q: %v", js.String(), err)
+	}
+	if len(got) != 2 || got[1] != ports[1] {
+		t.Errorf("JSON output = %+v, want %+v", got, ports)
+	}
+
+	if err := printPorts(io.Discard, ports, "xml"); err == nil {
+		t.Error("printPorts succeeded with an unknown format")
+	}
+}
+
+func TestUploadBadConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want string
+	}{
+		{name: "flow", cfg: Config{Flow: "dsrdtr"}, want: "flow control"},
+		{name: "prompt-regex", cfg: Config{PromptRegex: "(["}, want: "-prompt-regex"},
+		{name: "echo", cfg: Config{Echo: "word"}, want: `unknown echo mode: "word"`},
+		{name: "charset", cfg: Config{Charset: "ebcdic"}, want: `unknown character set: "ebcdic"`},
+		{name: "capture-format", cfg: Config{Capture: filepath.Join(t.TempDir(), "c"), CaptureFormat: "xml"}, want: `unknown capture format: "xml"`},
+		{name: "output", cfg: Config{OutputFormat: "xml"}, want: `unknown output format: "xml"`},
+		{name: "until-success", cfg: Config{UntilSuccess: "("}, want: "-until-success"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.FileName = os.DevNull
+			err := upload(context.Background(), tt.cfg, serialtest.NewPort())
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("upload() = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadRawOutput(t *testing.T) {
+	tmpfile, err := os.CreateTemp("", "upload-raw-output-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+
+	input := []byte("\x00\x13bin\x11\xff")
+	var out bytes.Buffer
+	mport := &customMockPort{
+		readFunc: func(p []byte) (int, error) {
+			if len(input) == 0 {
+				return 0, io.EOF
+			}
+			n := copy(p, input)
+			input = input[n:]
+			return n, nil
+		},
+	}
+	cfg := Config{
+		FileName:  tmpfile.Name(),
+		Linger:    true,
+		Receive:   "pass",
+		RawOutput: true,
+		Output:    &out,
+	}
+	if err := upload(context.Background(), cfg, mport); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	if got, want := out.String(), "\x00\x13bin\x11\xff"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+}
+
+func TestAnswerRegexp(t *testing.T) {
+	tests := []struct {
+		text, re string
+		line     string
+		want     bool
+	}{
+		{text: "ok", line: "ok T:20.1", want: true},
+		{text: "> ", line: "x > y", want: true},
+		{text: "a.b", line: "axb", want: false},
+		{text: "ignored", re: "^ok$", line: "ok", want: true},
+		{re: "^ok$", line: "ok T:20.1", want: false},
+	}
+	for _, tt := range tests {
+		re, err := answerRegexp(tt.text, tt.re, "-ack-regex")
+		if err != nil {
+			t.Fatalf("answerRegexp(%q, %q) = %v", tt.text, tt.re, err)
+		}
+		if got := re.MatchString(tt.line); got != tt.want {
+			t.Errorf("answerRegexp(%q, %q) matches %q = %v, want %v", tt.text, tt.re, tt.line, got, tt.want)
+		}
+	}
+	if re, err := answerRegexp("", "", "-ack-regex"); re != nil || err != nil {
+		t.Errorf("answerRegexp(\"\", \"\") = %v, %v, want nil", re, err)
+	}
+	if _, err := answerRegexp("", "(", "-nak-regex"); err == nil || !strings.Contains(err.Error(), "bad -nak-regex") {
+		t.Errorf("answerRegexp with a bad regex = %v, want an error", err)
+	}
+}
+
+func TestUnescape(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{in: `\r\n`, want: "\r\n"},
+		{in: `\x03`, want: "\x03"},
+		{in: `say "hi"`, want: `say "hi"`},
+		{in: "plain", want: "plain"},
+	}
+	for _, tt := range tests {
+		if got, err := unescape(tt.in); err != nil || got != tt.want {
+			t.Errorf("unescape(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+	if _, err := unescape(`\q`); err == nil {
+		t.Error("unescape(`\\q`) succeeded, want an error")
+	}
+}
+
+func TestRunScript(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "login.script")
+	err := os.WriteFile(script, []byte("expect \"login: $\"\nsend \"root\\r\"\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := serialtest.NewPort()
+	port.Feed([]byte("login: "))
+	cfg := Config{Script: script, Output: io.Discard}
+	if err := runScript(context.Background(), cfg, port); err != nil {
+		t.Fatalf("runScript() = %v", err)
+	}
+	if got := string(port.Written()); got != "root\r" {
+		t.Errorf("written %q, want %q", got, "root\r")
+	}
+}
+
+func TestOpenFilesStdinOnce(t *testing.T) {
+	if _, err := openFiles([]string{"-", "-"}); err == nil {
+		t.Error("openFiles with stdin twice succeeded, want an error")
+	}
+}
+
+func TestUploadRawFiles(t *testing.T) {
+	dir := t.TempDir()
+	var names []string
+	for _, f := range []struct{ name, data string }{{"a.py", "x = 1\n"}, {"b.py", "print(x)\n"}} {
+		name := filepath.Join(dir, f.name)
+		if err := os.WriteFile(name, []byte(f.data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	port := serialtest.NewPort()
+	cfg := Config{FileNames: names, Protocol: "raw", Separator: "\x04", Output: io.Discard}
+	if err := upload(context.Background(), cfg, port); err != nil {
+		t.Fatalf("upload() = %v", err)
+	}
+	if got, want := string(port.Written()), "x = 1\n\x04print(x)\n"; got != want {
+		t.Errorf("written %q, want %q", got, want)
+	}
+}
+
+func TestUploadInteractive(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "main.py")
+	if err := os.WriteFile(name, []byte("x = 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	port := serialtest.NewPort()
+	port.Feed([]byte(">>> "))
+	var out bytes.Buffer
+	cfg := Config{
+		FileName:    name,
+		Protocol:    "raw",
+		Output:      &out,
+		Interactive: true,
+		Input:       strings.NewReader("x\r\x1dq"),
+	}
+	if err := upload(context.Background(), cfg, port); err != nil {
+		t.Fatalf("upload() = %v", err)
+	}
+	if got, want := string(port.Written()), "x = 1\nx\r"; got != want {
+		t.Errorf("written %q, want %q", got, want)
+	}
+}
+
+func TestUploadInteractiveStdin(t *testing.T) {
+	cfg := Config{FileName: stdinName, Interactive: true}
+	if err := upload(context.Background(), cfg, serialtest.NewPort()); err == nil {
+		t.Error("upload() of stdin with -interactive succeeded")
+	}
+}
+
+func TestUploadCapture(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "main.py")
+	if err := os.WriteFile(name, []byte("x = 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	port := serialtest.NewPort()
+	port.Feed([]byte("boot\r\nready\r\n"))
+	captured := filepath.Join(dir, "console.jsonl")
+	cfg := Config{
+		FileName:      name,
+		Protocol:      "raw",
+		Prompt:        "ready",
+		Output:        io.Discard,
+		Capture:       captured,
+		CaptureFormat: "jsonl",
+	}
+	if err := upload(context.Background(), cfg, port); err != nil {
+		t.Fatalf("upload() = %v", err)
+	}
+	b, err := os.ReadFile(captured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var texts []string
+	for _, l := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var r struct{ Text string }
+		if err := json.Unmarshal([]byte(l), &r); err != nil {
+			t.Fatalf("bad capture line %q: %v", l, err)
+		}
+		texts = append(texts, r.Text)
+	}
+	if got, want := strings.Join(texts, ","), "boot,ready"; got != want {
+		t.Errorf("captured %q, want %q", got, want)
+	}
+}
+
+func TestUploadJSONOutput(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "main.py")
+	if err := os.WriteFile(name, []byte("x = 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	port := serialtest.NewPort()
+	port.Feed([]byte("boot\r\nready\r\n"))
+	var out bytes.Buffer
+	cfg := Config{FileName: name, Protocol: "raw", Prompt: "ready", Output: &out, OutputFormat: "json"}
+	if err := upload(context.Background(), cfg, port); err != nil {
+		t.Fatalf("upload() = %v", err)
+	}
+	var events []string
+	for _, l := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var e struct {
+			Time   time.Time
+			Event  string
+			Line   string
+			Offset int64
+		}
+		if err := json.Unmarshal([]byte(l), &e); err != nil {
+			t.Fatalf("bad output line %q: %v", l, err)
+		}
+		if e.Time.IsZero() {
+			t.Errorf("output line %q has no time", l)
+		}
+		switch e.Event {
+		case "line_received", "prompt_seen":
+			events = append(events, e.Event+" "+e.Line)
+		case "chunk_sent":
+			events = append(events, fmt.Sprintf("%s %d", e.Event, e.Offset))
+		case "sending", "sent", "done":
+			events = append(events, e.Event)
+		}
+	}
+	want := "line_received boot,line_received ready,prompt_seen ready,sending,chunk_sent 6,sent,done"
+	if got := strings.Join(events, ","); got != want {
+		t.Errorf("events %q, want %q", got, want)
+	}
+}
+
+func TestUploadJSONSchema(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "main.py")
+	if err := os.WriteFile(name, []byte("x = 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	port := serialtest.NewPort()
+	port.Feed([]byte("boot\r\nready\r\n"))
+	var out bytes.Buffer
+	cfg := Config{FileName: name, Protocol: "raw", Prompt: "ready", Output: &out, OutputFormat: "json"}
+	if err := upload(context.Background(), cfg, port); err != nil {
+		t.Fatalf("upload() = %v", err)
+	}
+	// Each object, without its time, which varies.
+	var got []string
+	for _, l := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var e map[string]any
+		if err := json.Unmarshal([]byte(l), &e); err != nil {
+			t.Fatalf("bad output line %q: %v", l, err)
+		}
+		if _, ok := e["time"].(string); !ok {
+			t.Errorf("output line %q has no time", l)
+		}
+		delete(e, "time")
+		if e["event"] == "data_received" {
+			// How the data received is split up varies.
+			continue
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(b))
+	}
+	want := []string{
+		`{"event":"prompt_wait","line":"ready"}`,
+		`{"event":"line_received","line":"boot","offset":0,"count":1}`,
+		`{"event":"line_received","line":"ready","offset":6,"count":2}`,
+		`{"event":"prompt_seen","line":"ready"}`,
+		`{"event":"sending"}`,
+		`{"data":"x = 1\n","event":"chunk_sent","offset":6,"source_offset":6}`,
+		`{"event":"sent"}`,
+		`{"event":"done"}`,
+	}
+	// json.Marshal sorts the keys of a map.
+	for i, w := range want {
+		var e map[string]any
+		if err := json.Unmarshal([]byte(w), &e); err != nil {
+			t.Fatal(err)
+		}
+		b, _ := json.Marshal(e)
+		want[i] = string(b)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("output:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestJSONReporterFail(t *testing.T) {
+	var out bytes.Buffer
+	rep, err := newReporter(Config{Output: &out, OutputFormat: "json"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep.fail(context.Canceled)
+	var e struct{ Event, Error string }
+	if err := json.Unmarshal(out.Bytes(), &e); err != nil {
+		t.Fatalf("bad output %q: %v", out.String(), err)
+	}
+	if e.Event != "error" || e.Error != "interrupted" {
+		t.Errorf("reported %+v, want an interrupted error", e)
+	}
+}
+
+func TestUploadUntil(t *testing.T) {
+	tests := []struct {
+		name     string
+		reply    string
+		closed   bool
+		fileName string
+		want     int
+	}{
+		{name: "success", reply: "running\nPASS\n", want: 0},
+		{name: "failure", reply: "FAIL: test_uart\n", want: 1},
+		{name: "timeout", reply: "running\n", want: 2},
+		{name: "closed", reply: "running\n", closed: true, want: 2},
+		{name: "upload failed", fileName: "missing.py", want: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := serialtest.NewPort()
+			cfg := Config{
+				FileName:      cmp.Or(tt.fileName, os.DevNull),
+				Protocol:      "raw",
+				Output:        io.Discard,
+				UntilSuccess:  "^PASS",
+				UntilFailure:  "^FAIL",
+				LingerTimeout: 300 * time.Millisecond,
+			}
+			go func() {
+				// The device answers once the test program is running.
+				time.Sleep(50 * time.Millisecond)
+				port.Feed([]byte(tt.reply))
+				if tt.closed {
+					port.CloseInput()
+				}
+			}()
+			err := upload(context.Background(), cfg, port)
+			if got := cfg.exitCode(err); got != tt.want {
+				t.Errorf("upload() = %v, exit code %d, want %d", err, got, tt.want)
+			}
+		})
+	}
+}
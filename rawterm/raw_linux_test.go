@@ -0,0 +1,58 @@
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build linux
+
+package rawterm
+
+import (
+	"testing"
+
+	"github.com/creack/pty"
+	"golang.org/x/sys/unix"
+)
+
+func TestMakeRaw(t *testing.T) {
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		t.Skipf("no pty: %v", err)
+	}
+	defer ptmx.Close()
+	defer tty.Close()
+
+	fd := int(tty.Fd())
+	if !IsTerminal(fd) {
+		t.Fatal("IsTerminal() = false for a pty")
+	}
+	restore, err := MakeRaw(fd)
+	if err != nil {
+		t.Fatalf("MakeRaw: %v", err)
+	}
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if termios.Lflag&(unix.ECHO|unix.ICANON|unix.ISIG) != 0 {
+		t.Errorf("Lflag = %#x in raw mode, want ECHO, ICANON and ISIG off", termios.Lflag)
+	}
+	if err := restore(); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	termios, err = unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if termios.Lflag&unix.ICANON == 0 {
+		t.Error("ICANON is still off after restore")
+	}
+}
+
+func TestIsTerminalFile(t *testing.T) {
+	f, err := unix.Open(t.TempDir(), unix.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(f)
+	if IsTerminal(f) {
+		t.Error("IsTerminal() = true for a directory")
+	}
+}
@@ -0,0 +1,18 @@
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !linux
+
+package rawterm
+
+import "errors"
+
+// IsTerminal tells whether fd is a terminal. It is always false here.
+func IsTerminal(fd int) bool {
+	return false
+}
+
+// MakeRaw puts the terminal fd into raw mode, which is only supported on
+// Linux.
+func MakeRaw(fd int) (restore func() error, err error) {
+	return nil, errors.New("raw terminal mode is only supported on Linux")
+}
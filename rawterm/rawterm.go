@@ -0,0 +1,34 @@
+// SPDX-License-Identifier: Apache-2.0
+
+// Package rawterm puts the local terminal into raw mode, so that each key
+// typed can be sent to a serial port as it is, including Ctrl-C.
+package rawterm
+
+import "io"
+
+// NewlineWriter returns a writer that writes to w with each LF that does not
+// follow a CR made CRLF, since a terminal in raw mode does not return the
+// cursor to the start of the line at an LF.
+func NewlineWriter(w io.Writer) io.Writer {
+	return &newlineWriter{w: w}
+}
+
+type newlineWriter struct {
+	w       io.Writer
+	afterCR bool
+}
+
+func (n *newlineWriter) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p)+8)
+	for _, b := range p {
+		if b == '\n' && !n.afterCR {
+			out = append(out, '\r')
+		}
+		out = append(out, b)
+		n.afterCR = b == '\r'
+	}
+	if _, err := n.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,21 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package rawterm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNewlineWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewlineWriter(&buf)
+	for _, s := range []string{"a\nb\r", "\nc\n"} {
+		if n, err := w.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", s, n, err)
+		}
+	}
+	if got, want := buf.String(), "a\r\nb\r\nc\r\n"; got != want {
+		t.Errorf("wrote %q, want %q", got, want)
+	}
+}
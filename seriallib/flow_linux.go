@@ -0,0 +1,53 @@
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build linux
+
+package seriallib
+
+import (
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// flowControl changes the RTS/CTS flow control setting of a device, which
+// go-serial leaves alone. It has a file descriptor of its own, opened before
+// go-serial takes exclusive access to the device, after which the device
+// cannot be opened again.
+type flowControl struct {
+	fd        int
+	closeOnce sync.Once
+}
+
+func openFlowControl(path string) (*flowControl, error) {
+	fd, err := unix.Open(path, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &flowControl{fd: fd}, nil
+}
+
+// set turns RTS/CTS flow control on or off.
+func (f *flowControl) set(enable bool) error {
+	t, err := unix.IoctlGetTermios(f.fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+	cflag := t.Cflag &^ unix.CRTSCTS
+	if enable {
+		cflag |= unix.CRTSCTS
+	}
+	if cflag == t.Cflag {
+		return nil
+	}
+	t.Cflag = cflag
+	return unix.IoctlSetTermios(f.fd, unix.TCSETS, t)
+}
+
+// Close closes the file descriptor. Closing it again does nothing, as the
+// port may be closed more than once.
+func (f *flowControl) Close() error {
+	var err error
+	f.closeOnce.Do(func() { err = unix.Close(f.fd) })
+	return err
+}
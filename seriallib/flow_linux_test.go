@@ -0,0 +1,86 @@
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build linux
+
+package seriallib
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/creack/pty"
+	"golang.org/x/sys/unix"
+)
+
+func TestSetModeFlowControl(t *testing.T) {
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		t.Skipf("no pty: %v", err)
+	}
+	defer ptmx.Close()
+	defer tty.Close()
+	p, err := Open(tty.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	// go-serial has taken exclusive access already; the device cannot be
+	// opened again, unless with CAP_SYS_ADMIN.
+	if err := unix.IoctlSetInt(int(tty.Fd()), unix.TIOCEXCL, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, flow := range []FlowControl{FlowRTSCTS, FlowNone} {
+		errc := make(chan error)
+		go func() {
+			// The thread is left locked, so that it goes away with the
+			// goroutine, and the capability with it.
+			runtime.LockOSThread()
+			if err := dropSysAdmin(); err != nil {
+				errc <- err
+				return
+			}
+			errc <- p.SetMode(&Mode{BaudRate: 115200, DataBits: 8, StopBits: 1, Parity: ParityNone, FlowControl: flow})
+		}()
+		if err := <-errc; err != nil {
+			t.Fatalf("SetMode(%v): %v", flow, err)
+		}
+		termios, err := unix.IoctlGetTermios(int(tty.Fd()), unix.TCGETS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := termios.Cflag&unix.CRTSCTS != 0; got != (flow == FlowRTSCTS) {
+			t.Errorf("CRTSCTS = %v after SetMode(%v)", got, flow)
+		}
+	}
+}
+
+// dropSysAdmin gives up CAP_SYS_ADMIN, which lets root open a device held
+// for exclusive access, on the current thread.
+func dropSysAdmin() error {
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return err
+	}
+	data[unix.CAP_SYS_ADMIN/32].Effective &^= 1 << (unix.CAP_SYS_ADMIN % 32)
+	return unix.Capset(&hdr, &data[0])
+}
+
+func TestCloseTwice(t *testing.T) {
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		t.Skipf("no pty: %v", err)
+	}
+	defer ptmx.Close()
+	defer tty.Close()
+	p, err := Open(tty.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := p.Close(); err != nil {
+			t.Errorf("Close() #%d: %v", i+1, err)
+		}
+	}
+}
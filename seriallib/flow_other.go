@@ -0,0 +1,28 @@
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !linux
+
+package seriallib
+
+import "errors"
+
+// flowControl changes the RTS/CTS flow control setting of a device. Only
+// turning it off, which is what go-serial does when opening a port, is
+// supported here.
+type flowControl struct{}
+
+func openFlowControl(path string) (*flowControl, error) {
+	return &flowControl{}, nil
+}
+
+// set turns RTS/CTS flow control on or off.
+func (f *flowControl) set(enable bool) error {
+	if enable {
+		return errors.New("RTS/CTS flow control is only supported on Linux")
+	}
+	return nil
+}
+
+func (f *flowControl) Close() error {
+	return nil
+}
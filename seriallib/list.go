@@ -0,0 +1,111 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package seriallib
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.bug.st/serial"
+)
+
+// PortInfo describes a serial port found by ListPorts. The USB fields are
+// empty for ports that are not on USB, and wherever the information is not
+// available. Identifiers are given in hex, as the kernel reports them.
+type PortInfo struct {
+	// Path is the device path, such as /dev/ttyUSB0.
+	Path string `json:"path"`
+	// VID is the USB vendor ID, such as "0403".
+	VID string `json:"vid,omitempty"`
+	// PID is the USB product ID, such as "6001".
+	PID string `json:"pid,omitempty"`
+	// SerialNumber is the USB device's serial number.
+	SerialNumber string `json:"serial_number,omitempty"`
+	// Manufacturer is the USB device's manufacturer string.
+	Manufacturer string `json:"manufacturer,omitempty"`
+	// Product is the USB device's product string.
+	Product string `json:"product,omitempty"`
+	// Interface is the number of the USB interface that the port belongs
+	// to, such as "00", for devices that have several.
+	Interface string `json:"interface,omitempty"`
+}
+
+// ListPorts returns the serial ports present on the system, sorted by path.
+// On Linux, the USB information is read from sysfs. Elsewhere, only the paths
+// are given.
+func ListPorts() ([]PortInfo, error) {
+	ports, err := listPorts("/sys", "/dev")
+	if errors.Is(err, fs.ErrNotExist) {
+		names, err := serial.GetPortsList()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list serial ports: %w", err)
+		}
+		ports = nil
+		for _, name := range names {
+			ports = append(ports, PortInfo{Path: name})
+		}
+		sort.Slice(ports, func(i, j int) bool { return ports[i].Path < ports[j].Path })
+		return ports, nil
+	}
+	return ports, err
+}
+
+// listPorts lists the serial ports described under the sysfs tree at sysRoot,
+// with device paths under devRoot.
+func listPorts(sysRoot, devRoot string) ([]PortInfo, error) {
+	// Device paths are compared against the root with its links resolved.
+	if root, err := filepath.EvalSymlinks(sysRoot); err == nil {
+		sysRoot = root
+	}
+	classDir := filepath.Join(sysRoot, "class", "tty")
+	entries, err := os.ReadDir(classDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list serial ports: %w", err)
+	}
+
+	var ports []PortInfo
+	for _, e := range entries {
+		// Virtual terminals and pseudo-terminals have no device.
+		dev, err := filepath.EvalSymlinks(filepath.Join(classDir, e.Name(), "device"))
+		if err != nil {
+			continue
+		}
+		// Skip the placeholders for legacy serial ports, which are listed
+		// whether or not the hardware exists.
+		if subsystem, err := os.Readlink(filepath.Join(dev, "subsystem")); err == nil && filepath.Base(subsystem) == "platform" {
+			continue
+		}
+
+		info := PortInfo{Path: filepath.Join(devRoot, e.Name())}
+		for dir := dev; strings.HasPrefix(dir, sysRoot) && dir != sysRoot; dir = filepath.Dir(dir) {
+			if info.Interface == "" {
+				info.Interface = readAttr(dir, "bInterfaceNumber")
+			}
+			if vid := readAttr(dir, "idVendor"); vid != "" {
+				info.VID = vid
+				info.PID = readAttr(dir, "idProduct")
+				info.SerialNumber = readAttr(dir, "serial")
+				info.Manufacturer = readAttr(dir, "manufacturer")
+				info.Product = readAttr(dir, "product")
+				break
+			}
+		}
+		ports = append(ports, info)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Path < ports[j].Path })
+	return ports, nil
+}
+
+// readAttr returns the value of a sysfs attribute, or "" if there is none.
+func readAttr(dir, name string) string {
+	b, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,133 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package seriallib
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fakeSysfs builds a sysfs tree in a temporary directory.
+type fakeSysfs struct {
+	t    *testing.T
+	root string
+}
+
+// attrs writes attribute files into dir, creating it as needed.
+func (f *fakeSysfs) attrs(dir string, attrs map[string]string) {
+	f.t.Helper()
+	path := filepath.Join(f.root, dir)
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		f.t.Fatal(err)
+	}
+	for name, value := range attrs {
+		if err := os.WriteFile(filepath.Join(path, name), []byte(value+"\n"), 0o644); err != nil {
+			f.t.Fatal(err)
+		}
+	}
+}
+
+// link creates a symlink at name, relative to the root, pointing to target.
+func (f *fakeSysfs) link(name, target string) {
+	f.t.Helper()
+	path := filepath.Join(f.root, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		f.t.Fatal(err)
+	}
+	if err := os.Symlink(target, path); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// tty registers a tty whose class directory is at dir, relative to the root,
+// and whose device is at dev, relative to dir. An empty dev means no device.
+func (f *fakeSysfs) tty(name, dir, dev string) {
+	f.t.Helper()
+	f.attrs(dir, nil)
+	if dev != "" {
+		f.link(filepath.Join(dir, "device"), dev)
+	}
+	rel, err := filepath.Rel(filepath.Join(f.root, "class", "tty"), filepath.Join(f.root, dir))
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	f.link(filepath.Join("class", "tty", name), rel)
+}
+
+func TestListPorts(t *testing.T) {
+	f := &fakeSysfs{t: t, root: t.TempDir()}
+	const usb = "devices/pci0000:00/0000:00:14.0/usb1"
+
+	// An FTDI adapter, with a ttyUSB under its interface.
+	f.attrs(usb+"/1-1", map[string]string{
+		"idVendor":     "0403",
+		"idProduct":    "6001",
+		"serial":       "A50285BI",
+		"manufacturer": "FTDI",
+		"product":      "FT232R USB UART",
+	})
+	f.attrs(usb+"/1-1/1-1:1.0", map[string]string{"bInterfaceNumber": "00"})
+	f.attrs(usb+"/1-1/1-1:1.0/ttyUSB0", nil)
+	f.tty("ttyUSB0", usb+"/1-1/1-1:1.0/ttyUSB0/tty/ttyUSB0", "../../../ttyUSB0")
+
+	// A CDC ACM device with no serial number, on its second interface.
+	f.attrs(usb+"/1-2", map[string]string{
+		"idVendor":  "2e8a",
+		"idProduct": "000a",
+		"product":   "Pico",
+	})
+	f.attrs(usb+"/1-2/1-2:1.2", map[string]string{"bInterfaceNumber": "02"})
+	f.tty("ttyACM0", usb+"/1-2/1-2:1.2/tty/ttyACM0", "../../../1-2:1.2")
+
+	// A legacy serial port placeholder, which must be skipped.
+	f.attrs("devices/platform/serial8250", nil)
+	f.link("devices/platform/serial8250/subsystem", "../../../bus/platform")
+	f.tty("ttyS1", "devices/platform/serial8250/tty/ttyS1", "../../../serial8250")
+
+	// A real on-board serial port, which has no USB information.
+	f.attrs("devices/pnp0/00:01", nil)
+	f.link("devices/pnp0/00:01/subsystem", "../../../bus/pnp")
+	f.tty("ttyS0", "devices/pnp0/00:01/tty/ttyS0", "../../../00:01")
+
+	// A virtual terminal, which must be skipped.
+	f.tty("tty1", "devices/virtual/tty/tty1", "")
+
+	got, err := listPorts(f.root, "/dev")
+	if err != nil {
+		t.Fatalf("listPorts: %v", err)
+	}
+	want := []PortInfo{
+		{
+			Path:      "/dev/ttyACM0",
+			VID:       "2e8a",
+			PID:       "000a",
+			Product:   "Pico",
+			Interface: "02",
+		},
+		{
+			Path: "/dev/ttyS0",
+		},
+		{
+			Path:         "/dev/ttyUSB0",
+			VID:          "0403",
+			PID:          "6001",
+			SerialNumber: "A50285BI",
+			Manufacturer: "FTDI",
+			Product:      "FT232R USB UART",
+			Interface:    "00",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("listPorts() =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestListPortsNoSysfs(t *testing.T) {
+	if _, err := listPorts(filepath.Join(t.TempDir(), "missing"), "/dev"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("listPorts() = %v, want a not-exist error", err)
+	}
+}
@@ -0,0 +1,123 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package seriallib
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Pacing slows down writes, for devices that have no flow control and little
+// room to buffer what they receive.
+type Pacing struct {
+	// CharDelay is the time between the starts of successive bytes.
+	CharDelay time.Duration
+	// LineDelay is an extra wait after each LF.
+	LineDelay time.Duration
+	// BytesPerSecond, if set, caps the rate at which bytes are written.
+	BytesPerSecond int
+}
+
+// Enabled tells whether p slows down writes at all.
+func (p Pacing) Enabled() bool {
+	return p.CharDelay > 0 || p.LineDelay > 0 || p.BytesPerSecond > 0
+}
+
+// interval returns the time between the starts of successive bytes.
+func (p Pacing) interval() time.Duration {
+	d := p.CharDelay
+	if p.BytesPerSecond > 0 {
+		d = max(d, time.Second/time.Duration(p.BytesPerSecond))
+	}
+	return d
+}
+
+// Pace returns a Port that writes to p as pacing says, a byte at a time when
+// it needs to. Bytes are scheduled from when the previous one was due, so
+// that timer latency does not add up over a long write, but a pause between
+// writes is not made up for by writing faster. The returned Port is a
+// ContextPort and a Breaker, and forwards everything but writes to p.
+func Pace(p Port, pacing Pacing) Port {
+	return &pacedPort{Port: p, pacing: pacing, interval: pacing.interval()}
+}
+
+type pacedPort struct {
+	Port
+	pacing   Pacing
+	interval time.Duration
+	// next is when the next byte may be written.
+	next time.Time
+}
+
+func (p *pacedPort) Write(b []byte) (int, error) {
+	return p.WriteContext(context.Background(), b)
+}
+
+// WriteContext writes b, waiting between bytes as needed. If ctx is done
+// while waiting, it returns the number of bytes written so far, and the
+// context's error. If the port writes nothing, and reports no error, it
+// returns io.ErrShortWrite.
+func (p *pacedPort) WriteContext(ctx context.Context, b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		if err := p.wait(ctx); err != nil {
+			return written, err
+		}
+		// The schedule is kept while a byte is late by less than the
+		// interval; after a longer pause, it starts again from now.
+		start := p.next
+		if now := time.Now(); now.Sub(start) > p.interval {
+			start = now
+		}
+		// Without a delay between bytes, write up to the end of the line.
+		n := 1
+		if p.interval == 0 {
+			for n < len(b)-written && b[written+n-1] != '\n' {
+				n++
+			}
+		}
+		m, err := WriteContext(ctx, p.Port, b[written:written+n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		if m == 0 {
+			// Trying again could spin forever.
+			return written, io.ErrShortWrite
+		}
+		p.next = start.Add(time.Duration(n) * p.interval)
+		if written > 0 && b[written-1] == '\n' {
+			p.next = p.next.Add(p.pacing.LineDelay)
+		}
+	}
+	return written, nil
+}
+
+// wait waits until the next byte may be written.
+func (p *pacedPort) wait(ctx context.Context) error {
+	d := time.Until(p.next)
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *pacedPort) ReadContext(ctx context.Context, b []byte) (int, error) {
+	return ReadContext(ctx, p.Port, b)
+}
+
+func (p *pacedPort) WaitModemStatus(ctx context.Context, prev ModemStatus) (ModemStatus, error) {
+	return WaitModemStatus(ctx, p.Port, prev)
+}
+
+func (p *pacedPort) Break(d time.Duration) error {
+	return SendBreak(p.Port, d)
+}
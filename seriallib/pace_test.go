@@ -0,0 +1,140 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package seriallib
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+// write is a write made to a writeLog.
+type write struct {
+	data string
+	at   time.Duration
+}
+
+// writeLog is a Port that records when each write was made.
+type writeLog struct {
+	chanPort
+	start  time.Time
+	writes []write
+}
+
+func (p *writeLog) Write(b []byte) (int, error) {
+	p.writes = append(p.writes, write{data: string(b), at: time.Since(p.start)})
+	return len(b), nil
+}
+
+func TestPace(t *testing.T) {
+	tests := []struct {
+		name       string
+		pacing     Pacing
+		data       string
+		wantWrites []string
+		// wantAt is when the last write is due.
+		wantAt time.Duration
+	}{
+		{
+			name:       "char delay",
+			pacing:     Pacing{CharDelay: 10 * time.Millisecond},
+			data:       "abc",
+			wantWrites: []string{"a", "b", "c"},
+			wantAt:     20 * time.Millisecond,
+		},
+		{
+			name:       "line delay",
+			pacing:     Pacing{LineDelay: 30 * time.Millisecond},
+			data:       "ab\ncd\nef",
+			wantWrites: []string{"ab\n", "cd\n", "ef"},
+			wantAt:     60 * time.Millisecond,
+		},
+		{
+			name:       "both",
+			pacing:     Pacing{CharDelay: 10 * time.Millisecond, LineDelay: 30 * time.Millisecond},
+			data:       "a\nb",
+			wantWrites: []string{"a", "\n", "b"},
+			wantAt:     50 * time.Millisecond,
+		},
+		{
+			name:       "rate",
+			pacing:     Pacing{CharDelay: time.Millisecond, BytesPerSecond: 100},
+			data:       "abcd",
+			wantWrites: []string{"a", "b", "c", "d"},
+			wantAt:     30 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := &writeLog{start: time.Now()}
+			p := Pace(log, tt.pacing)
+			if n, err := p.Write([]byte(tt.data)); n != len(tt.data) || err != nil {
+				t.Fatalf("Write() = %d, %v", n, err)
+			}
+			var got []string
+			for _, w := range log.writes {
+				got = append(got, w.data)
+			}
+			if len(got) != len(tt.wantWrites) {
+				t.Fatalf("writes = %q, want %q", got, tt.wantWrites)
+			}
+			for i := range got {
+				if got[i] != tt.wantWrites[i] {
+					t.Fatalf("writes = %q, want %q", got, tt.wantWrites)
+				}
+			}
+			// Timers may fire late, but never early.
+			if at := log.writes[len(log.writes)-1].at; at < tt.wantAt || at > tt.wantAt+200*time.Millisecond {
+				t.Errorf("last write at %v, want %v", at, tt.wantAt)
+			}
+		})
+	}
+}
+
+func TestPaceCanceled(t *testing.T) {
+	log := &writeLog{start: time.Now()}
+	p := Pace(log, Pacing{CharDelay: time.Hour}).(ContextPort)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	n, err := p.WriteContext(ctx, []byte("abc"))
+	if n != 1 || err != context.DeadlineExceeded {
+		t.Errorf("WriteContext() = %d, %v, want 1, %v", n, err, context.DeadlineExceeded)
+	}
+}
+
+// stuckPort is a Port that writes up to n bytes in all, and then reports
+// writes of zero bytes, with no error.
+type stuckPort struct {
+	chanPort
+	n       int
+	written []byte
+}
+
+func (p *stuckPort) Write(b []byte) (int, error) {
+	b = b[:min(len(b), p.n-len(p.written))]
+	p.written = append(p.written, b...)
+	return len(b), nil
+}
+
+func TestPaceZeroWrite(t *testing.T) {
+	for _, pacing := range []Pacing{{CharDelay: time.Microsecond}, {LineDelay: time.Microsecond}} {
+		for _, n := range []int{0, 2} {
+			port := &stuckPort{n: n}
+			p := Pace(port, pacing).(ContextPort)
+			got, err := p.WriteContext(context.Background(), []byte("abc\n"))
+			if got != n || err != io.ErrShortWrite {
+				t.Errorf("%+v: WriteContext() after %d bytes = %d, %v, want %d, %v", pacing, n, got, err, n, io.ErrShortWrite)
+			}
+		}
+	}
+}
+
+func TestPacingEnabled(t *testing.T) {
+	if (Pacing{}).Enabled() {
+		t.Error("zero Pacing is enabled")
+	}
+	if !(Pacing{BytesPerSecond: 10}).Enabled() {
+		t.Error("Pacing with a rate is not enabled")
+	}
+}
@@ -0,0 +1,132 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package seriallib
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// ErrNoPort is returned by Resolve when no port matches a selector.
+	ErrNoPort = errors.New("no serial port matches")
+	// ErrAmbiguousPort is returned by Resolve when several ports match a
+	// selector.
+	ErrAmbiguousPort = errors.New("several serial ports match")
+)
+
+// udevDir is where udev keeps the by-path and by-id links to serial ports.
+const udevDir = "/dev/serial"
+
+// Resolve returns the device path for a port name, which is either a device
+// path, or one of these selectors:
+//
+//   - usb:key=value,... selects the USB port whose attributes all match. The
+//     keys are vid, pid, serial, manufacturer, product and interface, named
+//     as in PortInfo. For example: usb:vid=0403,pid=6001,serial=A50285BI.
+//   - by-path:name selects the port that udev links as
+//     /dev/serial/by-path/name, which depends on where the device is
+//     plugged in.
+//   - by-id:name selects the port that udev links as /dev/serial/by-id/name,
+//     which depends on the device's identity.
+//
+// Names that are not selectors are returned as they are.
+func Resolve(name string) (string, error) {
+	return resolve(name, ListPorts, udevDir)
+}
+
+func resolve(name string, list func() ([]PortInfo, error), linkDir string) (string, error) {
+	kind, arg, ok := strings.Cut(name, ":")
+	if !ok {
+		return name, nil
+	}
+	switch kind {
+	case "usb":
+		return resolveUSB(name, arg, list)
+	case "by-path", "by-id":
+		if arg == "" || strings.Contains(arg, "/") {
+			return "", fmt.Errorf("bad serial port selector %q", name)
+		}
+		path, err := filepath.EvalSymlinks(filepath.Join(linkDir, kind, arg))
+		if err != nil {
+			return "", fmt.Errorf("%w %q: %v", ErrNoPort, name, err)
+		}
+		return path, nil
+	default:
+		// Not a selector, such as a Windows device name.
+		return name, nil
+	}
+}
+
+// resolveUSB finds the single port matching a usb: selector.
+func resolveUSB(name, arg string, list func() ([]PortInfo, error)) (string, error) {
+	var want PortInfo
+	for _, kv := range strings.Split(arg, ",") {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok || value == "" {
+			return "", fmt.Errorf("bad serial port selector %q: want key=value, got %q", name, kv)
+		}
+		switch key {
+		case "vid":
+			want.VID = value
+		case "pid":
+			want.PID = value
+		case "serial":
+			want.SerialNumber = value
+		case "manufacturer":
+			want.Manufacturer = value
+		case "product":
+			want.Product = value
+		case "interface":
+			want.Interface = value
+		default:
+			return "", fmt.Errorf("bad serial port selector %q: unknown key %q", name, key)
+		}
+	}
+
+	ports, err := list()
+	if err != nil {
+		return "", err
+	}
+	var paths []string
+	for _, p := range ports {
+		if want.matches(p) {
+			paths = append(paths, p.Path)
+		}
+	}
+	switch len(paths) {
+	case 0:
+		return "", fmt.Errorf("%w %q", ErrNoPort, name)
+	case 1:
+		return paths[0], nil
+	default:
+		return "", fmt.Errorf("%w %q: %s", ErrAmbiguousPort, name, strings.Join(paths, ", "))
+	}
+}
+
+// matches tells whether p has all the attributes set in want. Hex IDs and
+// interface numbers are compared as numbers, so that "403" matches "0403".
+func (want PortInfo) matches(p PortInfo) bool {
+	return matchHex(want.VID, p.VID) &&
+		matchHex(want.PID, p.PID) &&
+		matchHex(want.Interface, p.Interface) &&
+		(want.SerialNumber == "" || want.SerialNumber == p.SerialNumber) &&
+		(want.Manufacturer == "" || want.Manufacturer == p.Manufacturer) &&
+		(want.Product == "" || want.Product == p.Product)
+}
+
+func matchHex(want, got string) bool {
+	if want == "" {
+		return true
+	}
+	trim := func(s string) string {
+		s = strings.TrimLeft(strings.ToLower(s), "0")
+		if s == "" {
+			return "0"
+		}
+		return s
+	}
+	return got != "" && trim(want) == trim(got)
+}
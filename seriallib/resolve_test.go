@@ -0,0 +1,80 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package seriallib
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	ports := []PortInfo{
+		{Path: "/dev/ttyS0"},
+		{Path: "/dev/ttyUSB0", VID: "0403", PID: "6001", SerialNumber: "A50285BI", Interface: "00"},
+		{Path: "/dev/ttyUSB1", VID: "0403", PID: "6001", SerialNumber: "A7XQ03KX", Interface: "00"},
+		{Path: "/dev/ttyUSB2", VID: "0403", PID: "6010", SerialNumber: "FT2232", Interface: "00"},
+		{Path: "/dev/ttyUSB3", VID: "0403", PID: "6010", SerialNumber: "FT2232", Interface: "01"},
+	}
+	list := func() ([]PortInfo, error) { return ports, nil }
+
+	// udev's links, to files standing in for the devices.
+	dev := t.TempDir()
+	target := filepath.Join(dev, "ttyUSB0")
+	if err := os.WriteFile(target, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range []string{
+		"by-path/pci-0000:00:14.0-usb-0:1:1.0-port0",
+		"by-id/usb-FTDI_FT232R_USB_UART_A50285BI-if00-port0",
+	} {
+		path := filepath.Join(dev, "serial", link)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("../../ttyUSB0", path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		want    string
+		wantErr error
+	}{
+		{name: "/dev/ttyACM0", want: "/dev/ttyACM0"},
+		{name: "COM3", want: "COM3"},
+		{name: "usb:vid=0403,pid=6001,serial=A50285BI", want: "/dev/ttyUSB0"},
+		{name: "usb:serial=A7XQ03KX", want: "/dev/ttyUSB1"},
+		{name: "usb:vid=403,pid=6010,interface=1", want: "/dev/ttyUSB3"},
+		{name: "usb:vid=0403,pid=6001", wantErr: ErrAmbiguousPort},
+		{name: "usb:vid=1a86", wantErr: ErrNoPort},
+		{name: "usb:vid", wantErr: errBadSelector},
+		{name: "usb:color=blue", wantErr: errBadSelector},
+		{name: "by-path:pci-0000:00:14.0-usb-0:1:1.0-port0", want: target},
+		{name: "by-id:usb-FTDI_FT232R_USB_UART_A50285BI-if00-port0", want: target},
+		{name: "by-id:usb-missing", wantErr: ErrNoPort},
+		{name: "by-path:../by-id/x", wantErr: errBadSelector},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolve(tt.name, list, filepath.Join(dev, "serial"))
+			switch {
+			case tt.wantErr == errBadSelector:
+				if err == nil || errors.Is(err, ErrNoPort) || errors.Is(err, ErrAmbiguousPort) {
+					t.Errorf("resolve() = %q, %v, want a bad selector error", got, err)
+				}
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("resolve() = %q, %v, want %v", got, err, tt.wantErr)
+				}
+			case err != nil || got != tt.want:
+				t.Errorf("resolve() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// errBadSelector stands for any error about the form of a selector.
+var errBadSelector = errors.New("bad selector")
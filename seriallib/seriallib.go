@@ -3,8 +3,11 @@
 package seriallib
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"time"
 
 	"go.bug.st/serial"
 )
@@ -13,14 +16,203 @@ import (
 type Port interface {
 	io.ReadWriteCloser
 	SetMode(mode *Mode) error
+	// SetDTR sets the DTR (data terminal ready) output line.
+	SetDTR(dtr bool) error
+	// SetRTS sets the RTS (request to send) output line.
+	SetRTS(rts bool) error
+	// GetModemStatus returns the state of the modem status input lines.
+	GetModemStatus() (ModemStatus, error)
+}
+
+// ModemStatus is the state of the modem status input lines of a port.
+type ModemStatus struct {
+	// CTS is clear to send.
+	CTS bool
+	// DSR is data set ready.
+	DSR bool
+	// RI is the ring indicator.
+	RI bool
+	// DCD is data carrier detect.
+	DCD bool
+}
+
+// ModemStatusWaiter is a Port that can wait for its modem status lines to
+// change.
+type ModemStatusWaiter interface {
+	Port
+	// WaitModemStatus waits until the modem status differs from prev, and
+	// returns the new status, or the context's error if the context is done
+	// first.
+	WaitModemStatus(ctx context.Context, prev ModemStatus) (ModemStatus, error)
+}
+
+// WaitModemStatus waits until the modem status of p differs from prev, and
+// returns the new status. If p is not a ModemStatusWaiter, the status is
+// polled. Changes that are undone between two polls are missed.
+func WaitModemStatus(ctx context.Context, p Port, prev ModemStatus) (ModemStatus, error) {
+	if w, ok := p.(ModemStatusWaiter); ok {
+		return w.WaitModemStatus(ctx, prev)
+	}
+	ticker := time.NewTicker(statusPollInterval)
+	defer ticker.Stop()
+	for {
+		status, err := p.GetModemStatus()
+		if err != nil || status != prev {
+			return status, err
+		}
+		select {
+		case <-ctx.Done():
+			return prev, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// ContextPort is a Port whose reads and writes can be canceled.
+type ContextPort interface {
+	Port
+	// ReadContext is like Read, but returns the context's error if the
+	// context is done before anything was read.
+	ReadContext(ctx context.Context, b []byte) (int, error)
+	// WriteContext is like Write, but returns the context's error if the
+	// context is done before the write starts.
+	WriteContext(ctx context.Context, b []byte) (int, error)
+}
+
+// ReadContext reads from p, unless ctx is done first. If p is not a
+// ContextPort, a read that has started is not interrupted, as with
+// WriteContext; closing the port ends it. NewReader reads such ports in the
+// background instead.
+func ReadContext(ctx context.Context, p Port, b []byte) (int, error) {
+	if cp, ok := p.(ContextPort); ok {
+		return cp.ReadContext(ctx, b)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return p.Read(b)
+}
+
+// NewReader returns a reader of p whose reads return ctx's error once ctx is
+// done. If p is not a ContextPort, a goroutine reads it ahead, until ctx is
+// done or a read fails; the data read ahead and not yet returned once ctx is
+// done is lost.
+func NewReader(ctx context.Context, p Port) io.Reader {
+	if cp, ok := p.(ContextPort); ok {
+		return &contextReader{ctx: ctx, p: cp}
+	}
+	r := &backgroundReader{ctx: ctx, ch: make(chan readResult, 64)}
+	go r.run(p)
+	return r
+}
+
+// contextReader reads a ContextPort with a context.
+type contextReader struct {
+	ctx context.Context
+	p   ContextPort
+}
+
+func (r *contextReader) Read(b []byte) (int, error) {
+	return r.p.ReadContext(r.ctx, b)
+}
+
+// backgroundReader reads a Port ahead in a goroutine, so that its reads can
+// be abandoned once its context is done.
+type backgroundReader struct {
+	ctx context.Context
+	ch  chan readResult
+	// rest is what is left of the data last taken from ch.
+	rest readResult
+}
+
+type readResult struct {
+	data []byte
+	err  error
+}
+
+func (r *backgroundReader) run(p Port) {
+	for {
+		buf := make([]byte, 1024)
+		n, err := p.Read(buf)
+		select {
+		case r.ch <- readResult{buf[:n], err}:
+		case <-r.ctx.Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Read returns the data read ahead, waiting for some if there is none.
+func (r *backgroundReader) Read(b []byte) (int, error) {
+	if len(r.rest.data) == 0 && r.rest.err == nil {
+		select {
+		case r.rest = <-r.ch:
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+	}
+	n := 0
+	for {
+		c := copy(b[n:], r.rest.data)
+		n += c
+		r.rest.data = r.rest.data[c:]
+		if len(r.rest.data) > 0 || r.rest.err != nil {
+			break
+		}
+		select {
+		case r.rest = <-r.ch:
+			continue
+		default:
+		}
+		break
+	}
+	if len(r.rest.data) == 0 && r.rest.err != nil {
+		return n, r.rest.err
+	}
+	return n, nil
+}
+
+// WriteContext writes to p, unless ctx is done first. A write that has
+// started, such as one held up by flow control, is not interrupted; closing
+// the port ends it.
+func WriteContext(ctx context.Context, p Port, b []byte) (int, error) {
+	if cp, ok := p.(ContextPort); ok {
+		return cp.WriteContext(ctx, b)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return p.Write(b)
+}
+
+// Breaker is a Port that can send a break: the line held at zero for longer
+// than a character takes, which some devices take as an attention signal,
+// such as the Linux magic SysRq key.
+type Breaker interface {
+	Port
+	// Break holds the line at zero for d.
+	Break(d time.Duration) error
+}
+
+// SendBreak sends a break of length d over p, if p is a Breaker.
+func SendBreak(p Port, d time.Duration) error {
+	b, ok := p.(Breaker)
+	if !ok {
+		return errors.New("the port cannot send a break")
+	}
+	return b.Break(d)
 }
 
 // Mode represents the serial port settings.
 type Mode struct {
-	BaudRate int
-	DataBits int
-	StopBits int
-	Parity   Parity
+	BaudRate    int
+	DataBits    int
+	StopBits    int
+	Parity      Parity
+	FlowControl FlowControl
 }
 
 // Parity is the parity setting for a serial port.
@@ -35,28 +227,155 @@ const (
 	ParityEven Parity = 'E'
 )
 
+// FlowControl is the flow control setting for a serial port.
+type FlowControl int
+
+const (
+	// FlowXONXOFF is in-band flow control, with the XON and XOFF characters.
+	// The port leaves the characters to the application, which is expected
+	// to stop sending on XOFF and resume on XON. It is the default.
+	FlowXONXOFF FlowControl = iota
+	// FlowNone is no flow control. XON and XOFF are ordinary data.
+	FlowNone
+	// FlowRTSCTS is hardware flow control, with the RTS and CTS lines. XON
+	// and XOFF are ordinary data.
+	FlowRTSCTS
+)
+
+func (f FlowControl) String() string {
+	switch f {
+	case FlowXONXOFF:
+		return "xonxoff"
+	case FlowNone:
+		return "none"
+	case FlowRTSCTS:
+		return "rtscts"
+	default:
+		return fmt.Sprintf("FlowControl(%d)", int(f))
+	}
+}
+
+// ParseFlowControl parses a flow control setting: none, xonxoff or rtscts.
+func ParseFlowControl(s string) (FlowControl, error) {
+	for _, f := range []FlowControl{FlowNone, FlowXONXOFF, FlowRTSCTS} {
+		if s == f.String() {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown flow control: %q", s)
+}
+
+// pollInterval bounds how long a read waits for data before checking whether
+// it was canceled.
+const pollInterval = 100 * time.Millisecond
+
+// statusPollInterval is how often WaitModemStatus polls ports that cannot
+// wait for modem status changes.
+const statusPollInterval = 10 * time.Millisecond
+
+// Open opens the named serial port. The name may be a selector, as accepted
+// by Resolve. The returned Port is a ContextPort.
 func Open(deviceName string) (Port, error) {
-	p, err := serial.Open(deviceName, &serial.Mode{})
+	path, err := Resolve(deviceName)
 	if err != nil {
+		return nil, err
+	}
+	if path != deviceName {
+		deviceName = fmt.Sprintf("%s (%s)", deviceName, path)
+	}
+	// The flow control has to be opened first: go-serial takes exclusive
+	// access to the device.
+	flow, err := openFlowControl(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open device %q: %w", deviceName, err)
+	}
+	p, err := serial.Open(path, &serial.Mode{})
+	if err != nil {
+		flow.Close()
 		return nil, fmt.Errorf("failed to open device %q: %w", deviceName, err)
 	}
-	return &port{p: p}, nil
+	if err := p.SetReadTimeout(pollInterval); err != nil {
+		p.Close()
+		flow.Close()
+		return nil, fmt.Errorf("failed to set read timeout on %q: %w", deviceName, err)
+	}
+	return &port{p: p, flow: flow}, nil
 }
 
 type port struct {
-	p serial.Port
+	p    serial.Port
+	flow *flowControl
+	// rtscts is set while RTS/CTS flow control is on. go-serial turns it
+	// off when opening the port.
+	rtscts bool
 }
 
 func (p *port) Read(b []byte) (int, error) {
-	return p.p.Read(b)
+	return p.ReadContext(context.Background(), b)
+}
+
+func (p *port) ReadContext(ctx context.Context, b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		// With the read timeout set, no data is reported as a zero-length
+		// read.
+		n, err := p.p.Read(b)
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
 }
 
 func (p *port) Write(b []byte) (int, error) {
 	return p.p.Write(b)
 }
 
+func (p *port) WriteContext(ctx context.Context, b []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return p.p.Write(b)
+}
+
 func (p *port) Close() error {
-	return p.p.Close()
+	err := p.p.Close()
+	if ferr := p.flow.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+func (p *port) SetDTR(dtr bool) error {
+	if err := p.p.SetDTR(dtr); err != nil {
+		return fmt.Errorf("failed to set DTR: %w", err)
+	}
+	return nil
+}
+
+func (p *port) SetRTS(rts bool) error {
+	if err := p.p.SetRTS(rts); err != nil {
+		return fmt.Errorf("failed to set RTS: %w", err)
+	}
+	return nil
+}
+
+func (p *port) Break(d time.Duration) error {
+	if err := p.p.Break(d); err != nil {
+		return fmt.Errorf("failed to send break: %w", err)
+	}
+	return nil
+}
+func (p *port) GetModemStatus() (ModemStatus, error) {
+	bits, err := p.p.GetModemStatusBits()
+	if err != nil {
+		return ModemStatus{}, fmt.Errorf("failed to get modem status: %w", err)
+	}
+	return ModemStatus{CTS: bits.CTS, DSR: bits.DSR, RI: bits.RI, DCD: bits.DCD}, nil
 }
 
 func (p *port) SetMode(mode *Mode) error {
@@ -92,5 +411,21 @@ func (p *port) SetMode(mode *Mode) error {
 	if err != nil {
 		return fmt.Errorf("failed to set mode: %w", err)
 	}
+	// go-serial leaves the hardware flow control setting alone.
+	var rtscts bool
+	switch mode.FlowControl {
+	case FlowXONXOFF, FlowNone:
+	case FlowRTSCTS:
+		rtscts = true
+	default:
+		return fmt.Errorf("unknown flow control: %v", mode.FlowControl)
+	}
+	if rtscts == p.rtscts {
+		return nil
+	}
+	if err := p.flow.set(rtscts); err != nil {
+		return fmt.Errorf("failed to set flow control: %w", err)
+	}
+	p.rtscts = rtscts
 	return nil
 }
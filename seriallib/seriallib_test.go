@@ -0,0 +1,114 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package seriallib
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+// chanPort is a Port that is not a ContextPort.
+type chanPort struct {
+	ch chan byte
+}
+
+func (p *chanPort) Read(b []byte) (int, error) {
+	c, ok := <-p.ch
+	if !ok {
+		return 0, io.EOF
+	}
+	b[0] = c
+	return 1, nil
+}
+
+func (p *chanPort) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (p *chanPort) Close() error {
+	return nil
+}
+
+func (p *chanPort) SetMode(mode *Mode) error {
+	return nil
+}
+
+func (p *chanPort) SetDTR(bool) error { return nil }
+
+func (p *chanPort) SetRTS(bool) error { return nil }
+
+func (p *chanPort) GetModemStatus() (ModemStatus, error) {
+	return ModemStatus{}, nil
+}
+
+func TestReadContext(t *testing.T) {
+	p := &chanPort{ch: make(chan byte, 1)}
+	p.ch <- 'x'
+	b := make([]byte, 4)
+	n, err := ReadContext(context.Background(), p, b)
+	if err != nil || n != 1 || b[0] != 'x' {
+		t.Errorf("ReadContext() = %d, %v, read %q; want 1, nil, \"x\"", n, err, b[:n])
+	}
+}
+
+func TestReadContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ReadContext(ctx, &chanPort{}, make([]byte, 4)); err != context.Canceled {
+		t.Errorf("ReadContext() = %v, want context.Canceled", err)
+	}
+}
+
+func TestNewReader(t *testing.T) {
+	p := &chanPort{ch: make(chan byte, 3)}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := NewReader(ctx, p)
+	p.ch <- 'a'
+	p.ch <- 'b'
+	b := make([]byte, 1)
+	var got []byte
+	for range 2 {
+		n, err := r.Read(b)
+		if err != nil {
+			t.Fatalf("Read() = %v", err)
+		}
+		got = append(got, b[:n]...)
+	}
+	if string(got) != "ab" {
+		t.Errorf("read %q, want \"ab\"", got)
+	}
+
+	// A read that waits for data ends when the context is done.
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.Read(b)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("Read() = %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read() did not return once the context was canceled")
+	}
+	close(p.ch)
+}
+
+func TestSendBreakUnsupported(t *testing.T) {
+	if err := SendBreak(&chanPort{}, time.Millisecond); err == nil {
+		t.Error("SendBreak() on a port without breaks succeeded")
+	}
+}
+
+func TestWriteContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := WriteContext(ctx, &chanPort{}, []byte("x")); err != context.Canceled {
+		t.Errorf("WriteContext() = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,245 @@
+// SPDX-License-Identifier: Apache-2.0
+
+// Package serialtest provides a fake serial port for tests.
+package serialtest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/filmil/futility/seriallib"
+)
+
+// Line names an output line of a port.
+type Line string
+
+const (
+	// DTR is the data terminal ready line.
+	DTR Line = "DTR"
+	// RTS is the request to send line.
+	RTS Line = "RTS"
+)
+
+// Change records a change made to an output line.
+type Change struct {
+	Line  Line
+	Value bool
+	// Time is when the change was made.
+	Time time.Time
+}
+
+// Port is a fake seriallib.Port. Data given to Feed is read from the port,
+// and data written to the port is collected. The modem status lines are
+// set by the test, and the changes made to the output lines are recorded.
+//
+// Port implements seriallib.ContextPort, seriallib.ModemStatusWaiter and
+// seriallib.Breaker.
+type Port struct {
+	mu      sync.Mutex
+	changed chan struct{} // closed and replaced on every change
+	input   []byte
+	eof     bool
+	closed  bool
+	written bytes.Buffer
+	mode    *seriallib.Mode
+	dtr     bool
+	rts     bool
+	status  seriallib.ModemStatus
+	changes []Change
+	breaks  []time.Duration
+}
+
+var _ seriallib.ContextPort = (*Port)(nil)
+var _ seriallib.ModemStatusWaiter = (*Port)(nil)
+var _ seriallib.Breaker = (*Port)(nil)
+
+// NewPort returns a new fake port, with no input.
+func NewPort() *Port {
+	return &Port{changed: make(chan struct{})}
+}
+
+// notify wakes whoever waits for a change. p.mu must be held.
+func (p *Port) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// Feed makes data available to read from the port.
+func (p *Port) Feed(data []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.input = append(p.input, data...)
+	p.notify()
+}
+
+// CloseInput makes reads return io.EOF once the data fed so far is read.
+func (p *Port) CloseInput() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.eof = true
+	p.notify()
+}
+
+// Written returns a copy of all the data written to the port.
+func (p *Port) Written() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return bytes.Clone(p.written.Bytes())
+}
+
+// Mode returns the mode last set, or nil.
+func (p *Port) Mode() *seriallib.Mode {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.mode
+}
+
+// Closed tells whether Close was called.
+func (p *Port) Closed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// SetModemStatus sets the modem status lines, as the device would.
+func (p *Port) SetModemStatus(status seriallib.ModemStatus) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status = status
+	p.notify()
+}
+
+// Lines returns the state of the DTR and RTS lines.
+func (p *Port) Lines() (dtr, rts bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dtr, p.rts
+}
+
+// Changes returns the changes made to the output lines, in order.
+func (p *Port) Changes() []Change {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Change(nil), p.changes...)
+}
+
+// Breaks returns the lengths of the breaks sent, in order.
+func (p *Port) Breaks() []time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]time.Duration(nil), p.breaks...)
+}
+
+// wait waits until cond returns true, with p.mu held, or until ctx is done.
+// It returns with p.mu held.
+func (p *Port) wait(ctx context.Context, cond func() bool) error {
+	for !cond() {
+		ch := p.changed
+		p.mu.Unlock()
+		select {
+		case <-ch:
+			p.mu.Lock()
+		case <-ctx.Done():
+			p.mu.Lock()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (p *Port) Read(b []byte) (int, error) {
+	return p.ReadContext(context.Background(), b)
+}
+
+func (p *Port) ReadContext(ctx context.Context, b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err := p.wait(ctx, func() bool { return len(p.input) > 0 || p.eof || p.closed })
+	if err != nil {
+		return 0, err
+	}
+	if len(p.input) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, p.input)
+	p.input = p.input[n:]
+	return n, nil
+}
+
+func (p *Port) Write(b []byte) (int, error) {
+	return p.WriteContext(context.Background(), b)
+}
+
+func (p *Port) WriteContext(ctx context.Context, b []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return 0, io.ErrClosedPipe
+	}
+	return p.written.Write(b)
+}
+
+func (p *Port) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.notify()
+	return nil
+}
+
+func (p *Port) SetMode(mode *seriallib.Mode) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m := *mode
+	p.mode = &m
+	return nil
+}
+
+func (p *Port) SetDTR(dtr bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dtr = dtr
+	p.changes = append(p.changes, Change{Line: DTR, Value: dtr, Time: time.Now()})
+	return nil
+}
+
+func (p *Port) SetRTS(rts bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rts = rts
+	p.changes = append(p.changes, Change{Line: RTS, Value: rts, Time: time.Now()})
+	return nil
+}
+
+// Break records a break, and returns at once.
+func (p *Port) Break(d time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.breaks = append(p.breaks, d)
+	return nil
+}
+
+func (p *Port) GetModemStatus() (seriallib.ModemStatus, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status, nil
+}
+
+func (p *Port) WaitModemStatus(ctx context.Context, prev seriallib.ModemStatus) (seriallib.ModemStatus, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err := p.wait(ctx, func() bool { return p.status != prev })
+	if err != nil {
+		return prev, err
+	}
+	return p.status, nil
+}
@@ -0,0 +1,105 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package serialtest
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/filmil/futility/seriallib"
+)
+
+func TestPortReadWrite(t *testing.T) {
+	p := NewPort()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		p.Feed([]byte("hi"))
+		p.CloseInput()
+	}()
+	b, err := io.ReadAll(p)
+	if err != nil || string(b) != "hi" {
+		t.Errorf("ReadAll() = %q, %v, want \"hi\"", b, err)
+	}
+
+	p.Write([]byte("abc"))
+	p.Write([]byte("def"))
+	if got := string(p.Written()); got != "abcdef" {
+		t.Errorf("Written() = %q, want \"abcdef\"", got)
+	}
+}
+
+func TestPortReadContext(t *testing.T) {
+	p := NewPort()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.ReadContext(ctx, make([]byte, 1)); err != context.DeadlineExceeded {
+		t.Errorf("ReadContext() = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestPortBreak(t *testing.T) {
+	p := NewPort()
+	if err := seriallib.SendBreak(p, 250*time.Millisecond); err != nil {
+		t.Fatalf("SendBreak() = %v", err)
+	}
+	if got := p.Breaks(); len(got) != 1 || got[0] != 250*time.Millisecond {
+		t.Errorf("Breaks() = %v, want [250ms]", got)
+	}
+}
+
+func TestPortLines(t *testing.T) {
+	p := NewPort()
+	p.SetDTR(true)
+	p.SetRTS(true)
+	p.SetDTR(false)
+	if dtr, rts := p.Lines(); dtr || !rts {
+		t.Errorf("Lines() = %v, %v, want false, true", dtr, rts)
+	}
+	changes := p.Changes()
+	want := []Change{{Line: DTR, Value: true}, {Line: RTS, Value: true}, {Line: DTR, Value: false}}
+	if len(changes) != len(want) {
+		t.Fatalf("Changes() = %v, want %v", changes, want)
+	}
+	for i := range want {
+		if changes[i].Line != want[i].Line || changes[i].Value != want[i].Value {
+			t.Errorf("Changes()[%d] = %v, want %v", i, changes[i], want[i])
+		}
+	}
+}
+
+func TestWaitModemStatus(t *testing.T) {
+	p := NewPort()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		p.SetModemStatus(seriallib.ModemStatus{DCD: true})
+	}()
+	status, err := seriallib.WaitModemStatus(context.Background(), p, seriallib.ModemStatus{})
+	if err != nil || !status.DCD {
+		t.Errorf("WaitModemStatus() = %+v, %v, want DCD", status, err)
+	}
+}
+
+// pollingPort hides the fake's WaitModemStatus, so that it is polled.
+type pollingPort struct {
+	seriallib.Port
+}
+
+func TestWaitModemStatusPolling(t *testing.T) {
+	p := NewPort()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		p.SetModemStatus(seriallib.ModemStatus{CTS: true})
+	}()
+	status, err := seriallib.WaitModemStatus(context.Background(), pollingPort{p}, seriallib.ModemStatus{})
+	if err != nil || !status.CTS {
+		t.Errorf("WaitModemStatus() = %+v, %v, want CTS", status, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if _, err := seriallib.WaitModemStatus(ctx, pollingPort{p}, status); err != context.DeadlineExceeded {
+		t.Errorf("WaitModemStatus() = %v, want context.DeadlineExceeded", err)
+	}
+}
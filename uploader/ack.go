@@ -0,0 +1,134 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package uploader
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrNotAcknowledged is returned when the device does not acknowledge a line
+// with Options.Ack, after Options.AckRetries attempts.
+var ErrNotAcknowledged = errors.New("line not acknowledged")
+
+// sendAck sends the data read from br a line at a time, waiting for
+// Options.Ack after each line.
+func (w *rawSender) sendAck(br *bufio.Reader) error {
+	// n is the number of the line sent.
+	n := 0
+	for {
+		w.poll()
+		if w.paused {
+			if err := w.waitResume(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		text, readErr := br.ReadBytes('\n')
+		if len(text) > 0 {
+			n++
+			if err := w.sendLine(text, n); err != nil {
+				return err
+			}
+			if w.s.opts.LineBuffer {
+				w.paused = true
+			}
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return fmt.Errorf("failed to read file: %w", readErr)
+		}
+	}
+}
+
+// sendLine sends text, line n of the data, until the device acknowledges it
+// or the retries run out.
+func (w *rawSender) sendLine(text []byte, n int) error {
+	s := w.s
+	out := w.translate(text)
+	for attempt := 1; ; attempt++ {
+		if err := w.writeRaw(out); err != nil {
+			return err
+		}
+		nak, err := w.waitAck(strings.TrimRight(string(text), "\r\n"))
+		if err == nil && nak == nil {
+			return nil
+		}
+		if err != nil && err != errTimeout {
+			return err
+		}
+
+		if attempt > s.opts.AckRetries {
+			if nak == nil {
+				return fmt.Errorf("%w: line %d: no answer within %v", ErrNotAcknowledged, n, s.opts.AckTimeout)
+			}
+			return fmt.Errorf("%w: line %d: device answered %q", ErrNotAcknowledged, n, nak.text)
+		}
+		e := Event{Type: LineResent, Line: strings.TrimRight(string(text), "\r\n"), Count: n}
+		if nak != nil {
+			e.Data = []byte(nak.text)
+		}
+		s.emit(e)
+	}
+}
+
+// waitAck waits for the device to answer sent, the line just sent. It
+// returns nil if the line was acknowledged, the answer if it matches
+// Options.Nak, or errTimeout after Options.AckTimeout. The first line
+// received that is the same as sent is taken for its echo, and is not
+// matched, as is the start of it while it is received.
+func (w *rawSender) waitAck(sent string) (*line, error) {
+	s := w.s
+	var timeout <-chan time.Time
+	if s.opts.AckTimeout > 0 {
+		t := time.NewTimer(s.opts.AckTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	for {
+		select {
+		case l, ok := <-w.lineCh:
+			if !ok {
+				w.lineCh = nil
+				if s.readErr != nil {
+					return nil, fmt.Errorf("error reading from serial port: %w", s.readErr)
+				}
+				return nil, errors.New("serial port closed while waiting for the acknowledgement")
+			}
+			s.recvLine(l)
+			// A complete line whose start was an answer is not taken for
+			// another answer.
+			if l.seq == w.answered {
+				continue
+			}
+			if sent != "" && (l.text == sent || l.tail && strings.HasPrefix(sent, l.text)) {
+				if !l.tail {
+					sent = ""
+				}
+				continue
+			}
+			switch {
+			case s.opts.Nak != nil && s.opts.Nak.MatchString(l.text):
+				w.answered = l.seq
+				return &l, nil
+			case s.opts.Ack.MatchString(l.text):
+				w.answered = l.seq
+				return nil, nil
+			}
+		case p := <-s.pauseCh:
+			w.paused = p
+		case <-timeout:
+			return nil, errTimeout
+		case <-s.ctx.Done():
+			return nil, s.ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package uploader
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/filmil/futility/seriallib/serialtest"
+)
+
+func TestRunAck(t *testing.T) {
+	const data = "G28\nG1 X10\nM400"
+	for _, answer := range []string{"ok\r\n", "\r\n> "} {
+		t.Run(strings.TrimSpace(answer), func(t *testing.T) {
+			port := &echoPort{Port: serialtest.NewPort(), echo: func([]byte) []byte {
+				return []byte(answer)
+			}}
+			rec := &recorder{}
+			err := Run(context.Background(), port, strings.NewReader(data), Options{
+				Ack:     regexp.MustCompile(`^(ok|> )$`),
+				OnEvent: rec.record,
+			})
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if got := string(port.Written()); got != data {
+				t.Errorf("written %q, want %q", got, data)
+			}
+			for _, e := range rec.events {
+				if e.Type == LineResent {
+					t.Errorf("line %d resent", e.Count)
+				}
+			}
+		})
+	}
+}
+
+func TestRunNak(t *testing.T) {
+	// The device rejects the second line the first time.
+	lines := 0
+	port := &echoPort{Port: serialtest.NewPort(), echo: func([]byte) []byte {
+		lines++
+		if lines == 2 {
+			return []byte("error: checksum\n")
+		}
+		return []byte("ok\n")
+	}}
+	rec := &recorder{}
+	err := Run(context.Background(), port, strings.NewReader("a\nb\nc\n"), Options{
+		Ack:        regexp.MustCompile(`^ok`),
+		Nak:        regexp.MustCompile(`^error`),
+		AckRetries: 1,
+		OnEvent:    rec.record,
+	})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got, want := string(port.Written()), "a\nb\nb\nc\n"; got != want {
+		t.Errorf("written %q, want %q", got, want)
+	}
+	var resent []Event
+	for _, e := range rec.events {
+		if e.Type == LineResent {
+			resent = append(resent, e)
+		}
+	}
+	if len(resent) != 1 || resent[0].Count != 2 || resent[0].Line != "b" || string(resent[0].Data) != "error: checksum" {
+		t.Errorf("got resent lines %+v, want line 2 after \"error: checksum\"", resent)
+	}
+}
+
+func TestRunAckSkipsEcho(t *testing.T) {
+	// The device echoes the line, which has the answer in it, but does not
+	// answer it.
+	port := &echoPort{Port: serialtest.NewPort(), echo: func(p []byte) []byte {
+		return p
+	}}
+	err := Run(context.Background(), port, strings.NewReader("M117 ok\n"), Options{
+		Ack:        regexp.MustCompile(`ok`),
+		AckTimeout: 20 * time.Millisecond,
+	})
+	if !errors.Is(err, ErrNotAcknowledged) {
+		t.Errorf("Run = %v, want ErrNotAcknowledged", err)
+	}
+}
+
+func TestRunAckTimeout(t *testing.T) {
+	port := serialtest.NewPort()
+	err := Run(context.Background(), port, strings.NewReader("a\nb\n"), Options{
+		Ack:        regexp.MustCompile(`ok`),
+		AckTimeout: 20 * time.Millisecond,
+		AckRetries: 1,
+	})
+	if !errors.Is(err, ErrNotAcknowledged) || !strings.Contains(err.Error(), "line 1: no answer") {
+		t.Errorf("Run = %v, want ErrNotAcknowledged for line 1", err)
+	}
+	if got, want := string(port.Written()), "a\na\n"; got != want {
+		t.Errorf("written %q, want %q", got, want)
+	}
+}
+
+func TestRunNakNeedsAck(t *testing.T) {
+	err := Run(context.Background(), serialtest.NewPort(), strings.NewReader("a\n"), Options{
+		Nak: regexp.MustCompile(`error`),
+	})
+	if err == nil || !strings.Contains(err.Error(), "needs an acknowledgement") {
+		t.Errorf("Run = %v, want an error", err)
+	}
+}
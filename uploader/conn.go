@@ -0,0 +1,71 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/filmil/futility/seriallib"
+	"github.com/filmil/futility/xmodem"
+)
+
+// rawConn gives a file transfer protocol direct access to the bytes received
+// from the port, bypassing line splitting. XON and XOFF are still honored.
+type rawConn struct {
+	ctx     context.Context
+	port    seriallib.Port
+	ch      <-chan byte
+	pauseCh <-chan bool
+	// done is closed when the port can no longer be read.
+	done   <-chan struct{}
+	paused bool
+}
+
+func (c *rawConn) Write(p []byte) (int, error) {
+	for {
+		select {
+		case c.paused = <-c.pauseCh:
+			continue
+		default:
+		}
+		if !c.paused {
+			break
+		}
+		select {
+		case c.paused = <-c.pauseCh:
+		case <-c.ctx.Done():
+			return 0, c.ctx.Err()
+		case <-c.done:
+			return 0, fmt.Errorf("serial port closed while paused")
+		}
+	}
+	return seriallib.WriteContext(c.ctx, c.port, p)
+}
+
+func (c *rawConn) ReadByteTimeout(timeout time.Duration) (byte, error) {
+	select {
+	case b, ok := <-c.ch:
+		if !ok {
+			return 0, io.EOF
+		}
+		return b, nil
+	default:
+	}
+	if timeout <= 0 {
+		return 0, xmodem.ErrTimeout
+	}
+	select {
+	case b, ok := <-c.ch:
+		if !ok {
+			return 0, io.EOF
+		}
+		return b, nil
+	case <-c.ctx.Done():
+		return 0, c.ctx.Err()
+	case <-time.After(timeout):
+		return 0, xmodem.ErrTimeout
+	}
+}
@@ -0,0 +1,266 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package uploader
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// EchoMode selects how the echo of the data sent is checked, for devices,
+// such as REPLs, that echo what they receive.
+type EchoMode int
+
+const (
+	// EchoOff does not check the echo. It is the default.
+	EchoOff EchoMode = iota
+	// EchoChar sends one character at a time, and waits for its echo before
+	// sending the next.
+	EchoChar
+	// EchoLine sends a line without its line ending, and waits for its echo
+	// before sending the line ending. A line whose echo differs is never
+	// ended, so that it can be erased and sent again.
+	EchoLine
+)
+
+var echoModeNames = map[EchoMode]string{
+	EchoOff:  "off",
+	EchoChar: "char",
+	EchoLine: "line",
+}
+
+func (m EchoMode) String() string {
+	if name, ok := echoModeNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("EchoMode(%d)", int(m))
+}
+
+// ParseEchoMode parses an echo mode: off, char or line.
+func ParseEchoMode(s string) (EchoMode, error) {
+	for m, name := range echoModeNames {
+		if s == name {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown echo mode: %q", s)
+}
+
+// ErrEchoMismatch is returned when the device does not echo the data sent,
+// after Options.EchoRetries attempts.
+var ErrEchoMismatch = errors.New("echo mismatch")
+
+// errEchoClosed is returned by nextEcho once the port can no longer be read.
+var errEchoClosed = errors.New("serial port closed while waiting for the echo")
+
+const (
+	// defaultEchoTimeout is how long to wait for an echo, unless
+	// Options.EchoTimeout says otherwise.
+	defaultEchoTimeout = time.Second
+	// echoSettle is how long the device must stay quiet after a line ending
+	// or an erase, before the next echo is awaited. What it sends in the
+	// meantime, such as the answer to a line, is not taken for an echo.
+	echoSettle = 20 * time.Millisecond
+)
+
+// sendEcho sends the data read from br, checking its echo as
+// Options.Echo says.
+func (w *rawSender) sendEcho(br *bufio.Reader) error {
+	s := w.s
+	s.echoing.Store(true)
+	defer s.echoing.Store(false)
+
+	// offset is the number of bytes of the data sent so far.
+	var offset int64
+	for {
+		w.poll()
+		if w.paused {
+			if err := w.waitResume(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var unit []byte
+		var readErr error
+		if s.opts.Echo == EchoLine {
+			unit, readErr = br.ReadBytes('\n')
+		} else {
+			var b byte
+			if b, readErr = br.ReadByte(); readErr == nil {
+				unit = []byte{b}
+			}
+		}
+
+		if len(unit) > 0 {
+			text := bytes.TrimRight(unit, "\r\n")
+			ending := unit[len(text):]
+			if len(text) > 0 {
+				if err := w.verify(text, offset); err != nil {
+					return err
+				}
+			}
+			if len(ending) > 0 {
+				if err := w.write(ending); err != nil {
+					return err
+				}
+				if _, err := w.settle(); err != nil {
+					return err
+				}
+			}
+			offset += int64(len(unit))
+			if s.opts.LineBuffer && unit[len(unit)-1] == '\n' {
+				w.paused = true
+			}
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return fmt.Errorf("failed to read file: %w", readErr)
+		}
+	}
+}
+
+// verify sends text, which starts at offset in the data, and checks the
+// echo of its translation. If the echo differs, what the device took is erased with backspaces
+// and text is sent again, up to Options.EchoRetries times.
+func (w *rawSender) verify(text []byte, offset int64) error {
+	s := w.s
+	var tr translator
+	if w.tr != nil {
+		tr = *w.tr
+	}
+	out := w.translate(text)
+	for attempt := 1; ; attempt++ {
+		// Whatever the device sent before now is not an echo of text.
+		w.drainEcho()
+		if err := w.writeRaw(out); err != nil {
+			return err
+		}
+		echo, n, err := w.readEcho(out)
+		if err != nil {
+			return err
+		}
+		if n == len(out) {
+			return nil
+		}
+		if w.tr != nil {
+			n = tr.sourceIndex(text, n)
+		}
+
+		// Take the rest of the echo, to know how much to erase.
+		rest, err := w.settle()
+		if err != nil {
+			return err
+		}
+		echo = append(echo, rest...)
+		at := offset + int64(n)
+		s.emit(Event{Type: EchoMismatch, Line: string(text), Data: echo, Offset: at, Count: attempt})
+		if attempt > s.opts.EchoRetries {
+			return fmt.Errorf("%w at offset %d: sent %q, device echoed %q", ErrEchoMismatch, at, out, echo)
+		}
+		if len(echo) > 0 {
+			if err := w.writeRaw(bytes.Repeat([]byte{'\b'}, len(echo))); err != nil {
+				return err
+			}
+			if _, err := w.settle(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// readEcho reads the echo of text, until it differs from text or the echo
+// timeout passes. It returns the bytes echoed, and how many of them match
+// text.
+func (w *rawSender) readEcho(text []byte) ([]byte, int, error) {
+	timeout := w.s.opts.EchoTimeout
+	if timeout <= 0 {
+		timeout = defaultEchoTimeout
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	var echo []byte
+	for len(echo) < len(text) {
+		b, err := w.nextEcho(t.C)
+		if err == errTimeout {
+			break
+		}
+		if err != nil {
+			return echo, len(echo), err
+		}
+		if b != text[len(echo)] {
+			return append(echo, b), len(echo), nil
+		}
+		echo = append(echo, b)
+	}
+	return echo, len(echo), nil
+}
+
+// settle waits until nothing has been received for echoSettle, or for the
+// echo timeout at most, and returns what was received.
+func (w *rawSender) settle() ([]byte, error) {
+	timeout := w.s.opts.EchoTimeout
+	if timeout <= 0 {
+		timeout = defaultEchoTimeout
+	}
+	start := time.Now()
+	var got []byte
+	for time.Since(start) < timeout {
+		t := time.NewTimer(echoSettle)
+		b, err := w.nextEcho(t.C)
+		t.Stop()
+		if err == errTimeout || err == errEchoClosed {
+			break
+		}
+		if err != nil {
+			return got, err
+		}
+		got = append(got, b)
+	}
+	return got, nil
+}
+
+// nextEcho waits for the next byte received, while handling flow control and
+// received lines. If timeout fires first, it returns errTimeout.
+func (w *rawSender) nextEcho(timeout <-chan time.Time) (byte, error) {
+	s := w.s
+	for {
+		select {
+		case b, ok := <-s.echoCh:
+			if !ok {
+				return 0, errEchoClosed
+			}
+			return b, nil
+		case p := <-s.pauseCh:
+			w.paused = p
+		case line, ok := <-w.lineCh:
+			w.recvLine(line, ok)
+		case <-timeout:
+			return 0, errTimeout
+		case <-s.ctx.Done():
+			return 0, s.ctx.Err()
+		}
+	}
+}
+
+// drainEcho drops the bytes received so far.
+func (w *rawSender) drainEcho() {
+	for {
+		select {
+		case _, ok := <-w.s.echoCh:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
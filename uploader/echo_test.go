@@ -0,0 +1,161 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/filmil/futility/seriallib/serialtest"
+)
+
+// echoPort is a fake port for a device that echoes what it is sent, through
+// echo.
+type echoPort struct {
+	*serialtest.Port
+	echo func([]byte) []byte
+}
+
+func (p *echoPort) Write(b []byte) (int, error) {
+	return p.WriteContext(context.Background(), b)
+}
+
+func (p *echoPort) WriteContext(ctx context.Context, b []byte) (int, error) {
+	n, err := p.Port.WriteContext(ctx, b)
+	if echo := p.echo(b); len(echo) > 0 {
+		p.Feed(echo)
+	}
+	return n, err
+}
+
+// repl echoes like a line editor: line endings as CRLF followed by a prompt,
+// and backspaces as "\b \b".
+func repl(b []byte) []byte {
+	var out []byte
+	for _, c := range b {
+		switch c {
+		case '\n':
+			out = append(out, "\r\n>>> "...)
+		case '\b':
+			out = append(out, "\b \b"...)
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func TestParseEchoMode(t *testing.T) {
+	for _, m := range []EchoMode{EchoOff, EchoChar, EchoLine} {
+		if got, err := ParseEchoMode(m.String()); err != nil || got != m {
+			t.Errorf("ParseEchoMode(%q) = %v, %v", m.String(), got, err)
+		}
+	}
+	if _, err := ParseEchoMode("word"); err == nil {
+		t.Error("ParseEchoMode(\"word\") succeeded, want an error")
+	}
+}
+
+func TestRunEcho(t *testing.T) {
+	const data = "a = 1\nprint(a)\n"
+	for _, mode := range []EchoMode{EchoChar, EchoLine} {
+		t.Run(mode.String(), func(t *testing.T) {
+			port := &echoPort{Port: serialtest.NewPort(), echo: repl}
+			rec := &recorder{}
+			err := Run(context.Background(), port, strings.NewReader(data), Options{Echo: mode, OnEvent: rec.record})
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if got := string(port.Written()); got != data {
+				t.Errorf("written %q, want %q", got, data)
+			}
+			for _, e := range rec.events {
+				if e.Type == EchoMismatch {
+					t.Errorf("unexpected echo mismatch at offset %d", e.Offset)
+				}
+			}
+		})
+	}
+}
+
+func TestRunEchoRetry(t *testing.T) {
+	// The device drops the third character of the first write.
+	dropped := false
+	port := &echoPort{Port: serialtest.NewPort(), echo: func(b []byte) []byte {
+		if !dropped && len(b) > 2 {
+			dropped = true
+			b = append(bytes.Clone(b[:2]), b[3:]...)
+		}
+		return repl(b)
+	}}
+	rec := &recorder{}
+	err := Run(context.Background(), port, strings.NewReader("ok\nhello\n"), Options{
+		Echo:        EchoLine,
+		EchoRetries: 1,
+		OnEvent:     rec.record,
+	})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got, want := string(port.Written()), "ok\nhello\b\b\b\bhello\n"; got != want {
+		t.Errorf("written %q, want %q", got, want)
+	}
+	var mismatches []Event
+	for _, e := range rec.events {
+		if e.Type == EchoMismatch {
+			mismatches = append(mismatches, e)
+		}
+	}
+	if len(mismatches) != 1 || mismatches[0].Offset != 6 || string(mismatches[0].Data) != "helo" {
+		t.Errorf("got mismatches %+v, want one at offset 6 with echo \"helo\"", mismatches)
+	}
+}
+
+func TestRunEchoPausedChatter(t *testing.T) {
+	// After the first line, the device pauses the upload, prints more than
+	// echoCh holds, and resumes it.
+	chatter := strings.Repeat("log line\r\n", 1000)
+	var port *echoPort
+	paused := false
+	port = &echoPort{Port: serialtest.NewPort(), echo: func(b []byte) []byte {
+		out := repl(b)
+		if !paused && bytes.HasSuffix(b, []byte("\n")) {
+			paused = true
+			out = append(out, xoff)
+			time.AfterFunc(100*time.Millisecond, func() {
+				port.Feed(append([]byte(chatter), xon))
+			})
+		}
+		return out
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := Run(ctx, port, strings.NewReader("a = 1\nb = 2\n"), Options{Echo: EchoLine})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got, want := string(port.Written()), "a = 1\nb = 2\n"; got != want {
+		t.Errorf("written %q, want %q", got, want)
+	}
+}
+
+func TestRunEchoMismatch(t *testing.T) {
+	// The device never echoes an x.
+	port := &echoPort{Port: serialtest.NewPort(), echo: func(b []byte) []byte {
+		return bytes.ReplaceAll(b, []byte("x"), nil)
+	}}
+	err := Run(context.Background(), port, strings.NewReader("abxd"), Options{
+		Echo:        EchoChar,
+		EchoTimeout: 50 * time.Millisecond,
+	})
+	if !errors.Is(err, ErrEchoMismatch) || !strings.Contains(err.Error(), "at offset 2:") {
+		t.Errorf("Run = %v, want ErrEchoMismatch at offset 2", err)
+	}
+	if got := string(port.Written()); got != "abx" {
+		t.Errorf("written %q, want %q", got, "abx")
+	}
+}
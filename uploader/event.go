@@ -0,0 +1,202 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package uploader
+
+import (
+	"encoding/json"
+	"time"
+	"unicode/utf8"
+)
+
+// EventType tells what happened during an upload.
+type EventType int
+
+const (
+	// WaitingForPrompt is reported when lines start arriving while the
+	// prompt is awaited.
+	WaitingForPrompt EventType = iota
+	// PromptSeen is reported when the prompt line has been received. Line
+	// holds the prompt.
+	PromptSeen
+	// Sending is reported when the upload starts. When the raw protocol
+	// sends several files, it is also reported before each of them, with
+	// File, and Count the number of the file, starting at 1.
+	Sending
+	// ChunkSent is reported after data has been written to the port. For the
+	// raw protocol, Data holds the bytes written. For the other protocols,
+	// it is reported when data has been acknowledged, and Block, File and
+	// Restarted are set as applicable. Offset is the number of bytes of the
+	// current file sent so far, and Size its size, if known.
+	ChunkSent
+	// Paused is reported when an XOFF is received.
+	Paused
+	// Resumed is reported when an XON is received.
+	Resumed
+	// LineReceived is reported for each line received from the port. Line
+	// holds the line, without its line ending, Count the number of lines
+	// received so far, and Offset the number of bytes received before it.
+	// Partial is set if the line was reported after Options.IdleFlush
+	// without a line ending.
+	LineReceived
+	// Sent is reported when all the data has been sent.
+	Sent
+	// Lingering is reported when the upload is done, and received lines
+	// are still being reported.
+	Lingering
+	// Done is reported last, with the error that the upload ended with, if
+	// any.
+	Done
+	// Resetting is reported before the reset sequence is run.
+	Resetting
+	// DataReceived is reported for the bytes received from the port, as
+	// they arrive. Data holds the bytes, with XON and XOFF handled as
+	// Options.Receive says. Bytes taken by a file transfer protocol are not
+	// reported.
+	DataReceived
+	// WakeSent is reported when Options.Wake is sent. Data holds what was
+	// sent, and Count is the attempt at waiting for the prompt, starting at
+	// 1.
+	WakeSent
+	// PromptTimedOut is reported when the prompt was not seen within
+	// Options.PromptTimeout. Count is the attempt that timed out.
+	PromptTimedOut
+	// ScriptStep is reported before each step of a script is run. Line holds
+	// the step, and Count its line number in the script.
+	ScriptStep
+	// EchoMismatch is reported when the device did not echo the data sent,
+	// as Options.Echo checks. Line holds the data sent, Data the echo,
+	// Offset where in the data they differ, and Count the attempt, starting
+	// at 1.
+	EchoMismatch
+	// LineResent is reported when a line is sent again, because the device
+	// did not acknowledge it with Options.Ack. Line holds the line, Count
+	// its number in the data, starting at 1, and Data the answer that
+	// matched Options.Nak, or nothing if none came in time.
+	LineResent
+	// LocalCommand is reported when a local command is typed in
+	// Options.Terminal. Line describes it, such as "break" or "DTR off", and
+	// Err is set if it failed.
+	LocalCommand
+	// PatternMatched is reported when a line received while lingering
+	// matches Options.Success or Options.Failure. Line holds the line, and
+	// Count its number. Err is set, wrapping ErrFailure, if it matched
+	// Options.Failure.
+	PatternMatched
+)
+
+var eventNames = map[EventType]string{
+	WaitingForPrompt: "prompt_wait",
+	PromptSeen:       "prompt_seen",
+	Sending:          "sending",
+	ChunkSent:        "chunk_sent",
+	Paused:           "xoff",
+	Resumed:          "xon",
+	LineReceived:     "line_received",
+	Sent:             "sent",
+	Lingering:        "lingering",
+	Done:             "done",
+	Resetting:        "resetting",
+	DataReceived:     "data_received",
+	WakeSent:         "wake_sent",
+	PromptTimedOut:   "prompt_timed_out",
+	ScriptStep:       "script_step",
+	EchoMismatch:     "echo_mismatch",
+	LineResent:       "line_resent",
+	LocalCommand:     "local_command",
+	PatternMatched:   "pattern_matched",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Event describes something that happened during an upload. Only the fields
+// that apply to the event type are set.
+type Event struct {
+	Type EventType
+	// Time is when the event happened.
+	Time time.Time
+	// Line is a line received from the port.
+	Line string
+	// Count is the number of lines received so far.
+	Count int
+	// Partial is set for a line that was received without a line ending.
+	Partial bool
+	// Data is the data written to, or received from, the port.
+	Data []byte
+	// File is the name of the file being sent, for protocols that send file
+	// names.
+	File string
+	// Block is the XMODEM or YMODEM block number, starting at 1.
+	Block int
+	// Offset is the number of bytes of the current file sent so far, or for
+	// a line received, the number of bytes received before it.
+	Offset int64
+	// SourceOffset is, for the raw protocol, the number of bytes of the data
+	// read so far. It differs from Offset when Options.EOL or
+	// Options.Charset translate the data.
+	SourceOffset int64
+	// Size is the size of the current file, or zero if it is unknown.
+	Size int64
+	// Restarted is set when a ZMODEM receiver asked for the data to be sent
+	// again from Offset.
+	Restarted bool
+	// Err is the error that the upload, or a local command, ended with.
+	Err error
+}
+
+// MarshalJSON encodes the event as an object with its type, by the name
+// that EventType.String gives, its time, and the fields that are set. Data
+// is a string if it is valid UTF-8, and is base64 encoded as data_base64
+// otherwise.
+func (e Event) MarshalJSON() ([]byte, error) {
+	j := struct {
+		Time         *time.Time `json:"time,omitempty"`
+		Type         string     `json:"event"`
+		Line         string     `json:"line,omitempty"`
+		Count        int        `json:"count,omitempty"`
+		Partial      bool       `json:"partial,omitempty"`
+		Data         *string    `json:"data,omitempty"`
+		DataBase64   []byte     `json:"data_base64,omitempty"`
+		File         string     `json:"file,omitempty"`
+		Block        int        `json:"block,omitempty"`
+		Offset       *int64     `json:"offset,omitempty"`
+		SourceOffset int64      `json:"source_offset,omitempty"`
+		Size         int64      `json:"size,omitempty"`
+		Restarted    bool       `json:"restarted,omitempty"`
+		Err          string     `json:"error,omitempty"`
+	}{
+		Type:         e.Type.String(),
+		Line:         e.Line,
+		Count:        e.Count,
+		Partial:      e.Partial,
+		File:         e.File,
+		Block:        e.Block,
+		SourceOffset: e.SourceOffset,
+		Size:         e.Size,
+		Restarted:    e.Restarted,
+	}
+	if !e.Time.IsZero() {
+		j.Time = &e.Time
+	}
+	// A line received at the start has an offset of 0, which is given all
+	// the same.
+	if e.Offset != 0 || e.Type == LineReceived {
+		j.Offset = &e.Offset
+	}
+	switch {
+	case e.Data == nil:
+	case utf8.Valid(e.Data):
+		data := string(e.Data)
+		j.Data = &data
+	default:
+		j.DataBase64 = e.Data
+	}
+	if e.Err != nil {
+		j.Err = e.Err.Error()
+	}
+	return json.Marshal(j)
+}
@@ -0,0 +1,41 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package uploader
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEventMarshalJSON(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		e    Event
+		want string
+	}{
+		{Event{Type: LineReceived, Time: at, Line: "hi", Count: 3},
+			`{"time":"2024-05-01T12:00:00Z","event":"line_received","line":"hi","count":3,"offset":0}`},
+		{Event{Type: LineReceived, Line: "ok", Count: 4, Offset: 27},
+			`{"event":"line_received","line":"ok","count":4,"offset":27}`},
+		{Event{Type: WaitingForPrompt}, `{"event":"prompt_wait"}`},
+		{Event{Type: Paused}, `{"event":"xoff"}`},
+		{Event{Type: Resumed}, `{"event":"xon"}`},
+		{Event{Type: ChunkSent, Data: []byte("ab\n"), Offset: 3, SourceOffset: 2},
+			`{"event":"chunk_sent","data":"ab\n","offset":3,"source_offset":2}`},
+		{Event{Type: DataReceived, Data: []byte{0xff, 0x00}},
+			`{"event":"data_received","data_base64":"/wA="}`},
+		{Event{Type: Done, Err: errors.New("boom")},
+			`{"event":"done","error":"boom"}`},
+	}
+	for _, tt := range tests {
+		got, err := json.Marshal(tt.e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("json.Marshal(%v event) = %s, want %s", tt.e.Type, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package uploader
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+// BreakLength is how long a break sent from a terminal lasts.
+const BreakLength = 250 * time.Millisecond
+
+// ReadKeys reads r in the background, and sends what it reads on the
+// returned channel, which is closed once r fails. If r is nil, the channel
+// is closed at once.
+func ReadKeys(r io.Reader) <-chan []byte {
+	ch := make(chan []byte)
+	go func() {
+		defer close(ch)
+		if r == nil {
+			return
+		}
+		for {
+			buf := make([]byte, 256)
+			n, err := r.Read(buf)
+			if n > 0 {
+				ch <- buf[:n]
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// Command is a local command of a terminal, typed as the escape character
+// followed by the command's key.
+type Command int
+
+const (
+	// Help lists the commands. Keys that stand for no command give it too.
+	Help Command = iota
+	// Quit ends the session.
+	Quit
+	// LocalEcho toggles the local echo.
+	LocalEcho
+	// HexView toggles the hex view.
+	HexView
+	// InEOL changes the line ending that the device sends.
+	InEOL
+	// OutEOL changes what Enter sends.
+	OutEOL
+	// BaudRate changes the baud rate, which is typed next.
+	BaudRate
+	// Parity changes the parity.
+	Parity
+	// Break sends a break.
+	Break
+	// ToggleDTR toggles the DTR line.
+	ToggleDTR
+	// ToggleRTS toggles the RTS line.
+	ToggleRTS
+	// SendFile sends a file, whose name is typed next.
+	SendFile
+)
+
+// commands are the keys of the local commands, which are the same in every
+// terminal, and what the help says about them. The first key is the one
+// that the help gives.
+var commands = []struct {
+	cmd  Command
+	keys string
+	help string
+}{
+	{Quit, "q.", "quit"},
+	{LocalEcho, "e", "toggle the local echo"},
+	{HexView, "x", "toggle the hex view"},
+	{InEOL, "m", "change the line ending that the device sends"},
+	{OutEOL, "n", "change what Enter sends"},
+	{BaudRate, "b", "change the baud rate"},
+	{Parity, "p", "change the parity"},
+	{Break, "k", "send a break"},
+	{ToggleDTR, "d", "toggle DTR"},
+	{ToggleRTS, "r", "toggle RTS"},
+	{SendFile, "s", "send a file"},
+	{Help, "?h", "list the commands"},
+}
+
+// commandFor returns the command that key stands for.
+func commandFor(key byte) Command {
+	for _, c := range commands {
+		if strings.IndexByte(c.keys, key) >= 0 {
+			return c.cmd
+		}
+	}
+	return Help
+}
+
+// WriteHelp lists the given commands, as typed after escape.
+func WriteHelp(w io.Writer, escape byte, cmds ...Command) {
+	fmt.Fprintf(w, "\r\ncommands, after %s:\r\n", KeyName(escape))
+	for _, c := range commands {
+		if !slices.Contains(cmds, c.cmd) {
+			continue
+		}
+		keys := KeyName(c.keys[0])
+		if len(c.keys) > 1 {
+			keys += " or " + KeyName(c.keys[1])
+		}
+		fmt.Fprintf(w, "  %-7s %s\r\n", keys, c.help)
+	}
+	fmt.Fprintf(w, "  %-7s send %s\r\n", KeyName(escape), KeyName(escape))
+}
+
+// Keys tells the data typed in a terminal from the local commands: the
+// escape character followed by a key. Typing the escape character twice
+// gives it as data. After Ask, the keys typed are taken as the answer to a
+// question instead.
+type Keys struct {
+	// Escape is the character that starts a local command. Defaults to
+	// DefaultEscape.
+	Escape byte
+	// Messages, if set, receives the questions and the answers as they are
+	// typed.
+	Messages io.Writer
+
+	// escaped is set after the escape character.
+	escaped bool
+	// While asking is set, keys are taken for its answer, which is typed
+	// into answer.
+	asking func(answer string) error
+	answer []byte
+}
+
+// Handle handles what was typed. The data is passed to send, and each local
+// command to command, which reports whether the session ends. Handle reports
+// whether it does.
+func (k *Keys) Handle(p []byte, send func([]byte) error, command func(Command) (bool, error)) (bool, error) {
+	escape := k.Escape
+	if escape == 0 {
+		escape = DefaultEscape
+	}
+	var out []byte
+	for _, b := range p {
+		switch {
+		case k.asking != nil:
+			if err := k.answerKey(b); err != nil {
+				return false, err
+			}
+		case k.escaped:
+			k.escaped = false
+			if b == escape {
+				out = append(out, b)
+				continue
+			}
+			if err := send(out); err != nil {
+				return false, err
+			}
+			out = nil
+			quit, err := command(commandFor(b))
+			if err != nil || quit {
+				return quit, err
+			}
+		case b == escape:
+			k.escaped = true
+		default:
+			out = append(out, b)
+		}
+	}
+	return false, send(out)
+}
+
+// Ask asks a question, whose answer is typed next, and passes the answer to
+// f. Enter ends the answer, and Ctrl-C, Esc, or an empty answer cancels it.
+func (k *Keys) Ask(question string, f func(answer string) error) {
+	fmt.Fprintf(k.messages(), "\r\n%s", question)
+	k.asking = f
+	k.answer = nil
+}
+
+// answerKey handles a key typed in answer to a question.
+func (k *Keys) answerKey(b byte) error {
+	msg := k.messages()
+	switch b {
+	case '\r', '\n':
+		f, answer := k.asking, string(k.answer)
+		k.asking = nil
+		fmt.Fprint(msg, "\r\n")
+		if answer == "" {
+			return nil
+		}
+		return f(answer)
+	case 0x03, 0x1b:
+		k.asking = nil
+		fmt.Fprint(msg, "\r\n")
+	case 0x7f, '\b':
+		if len(k.answer) > 0 {
+			k.answer = k.answer[:len(k.answer)-1]
+			fmt.Fprint(msg, "\b \b")
+		}
+	default:
+		if b >= ' ' {
+			k.answer = append(k.answer, b)
+			msg.Write([]byte{b})
+		}
+	}
+	return nil
+}
+
+func (k *Keys) messages() io.Writer {
+	if k.Messages == nil {
+		return io.Discard
+	}
+	return k.Messages
+}
+
+// OnOff describes a setting that is on or off, such as an output line.
+func OnOff(v bool) string {
+	if v {
+		return "on"
+	}
+	return "off"
+}
+
+// KeyName names a key, such as "Ctrl-]".
+func KeyName(b byte) string {
+	if b < ' ' {
+		return "Ctrl-" + string(rune(b+'@'))
+	}
+	return string(rune(b))
+}
@@ -0,0 +1,70 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package uploader
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+func TestKeysHandle(t *testing.T) {
+	var msg bytes.Buffer
+	k := Keys{Messages: &msg}
+	var sent []byte
+	var commands []Command
+	var answers []string
+	send := func(p []byte) error {
+		sent = append(sent, p...)
+		return nil
+	}
+	command := func(c Command) (bool, error) {
+		commands = append(commands, c)
+		switch c {
+		case Quit:
+			return true, nil
+		case SendFile:
+			k.Ask("name: ", func(answer string) error {
+				answers = append(answers, answer)
+				return nil
+			})
+		}
+		return false, nil
+	}
+
+	// The escape twice is data, and a command can be split across calls.
+	for _, p := range []string{"ab\x1d\x1dc\x1d", "d", "e\x1dsfx\x7foo\r", "\x1ds\x1b", "f\x1dqg"} {
+		quit, err := k.Handle([]byte(p), send, command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if quit != (p == "f\x1dqg") {
+			t.Errorf("Handle(%q) quit = %v", p, quit)
+		}
+	}
+	if got, want := string(sent), "ab\x1dcef"; got != want {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+	if got, want := commands, []Command{ToggleDTR, SendFile, SendFile, Quit}; !slices.Equal(got, want) {
+		t.Errorf("commands %v, want %v", got, want)
+	}
+	if got, want := answers, []string{"foo"}; !slices.Equal(got, want) {
+		t.Errorf("answers %q, want %q", got, want)
+	}
+	if got, want := msg.String(), "\r\nname: fx\b \boo\r\n\r\nname: \r\n"; got != want {
+		t.Errorf("messages %q, want %q", got, want)
+	}
+}
+
+func TestCommandKeys(t *testing.T) {
+	for key, want := range map[byte]Command{'q': Quit, '.': Quit, 'k': Break, 'b': BaudRate, '?': Help, 'z': Help} {
+		if got := commandFor(key); got != want {
+			t.Errorf("commandFor(%q) = %v, want %v", key, got, want)
+		}
+	}
+	var help bytes.Buffer
+	WriteHelp(&help, DefaultEscape, Quit, Break)
+	if got, want := help.String(), "\r\ncommands, after Ctrl-]:\r\n  q or .  quit\r\n  k       send a break\r\n  Ctrl-]  send Ctrl-]\r\n"; got != want {
+		t.Errorf("WriteHelp = %q, want %q", got, want)
+	}
+}
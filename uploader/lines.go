@@ -0,0 +1,205 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package uploader
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// LineEnding selects what ends a received line.
+type LineEnding int
+
+const (
+	// LineEndingAny ends lines at CR, LF or CRLF. It is the default.
+	LineEndingAny LineEnding = iota
+	// LineEndingLF ends lines at LF. A CR before the LF is removed.
+	LineEndingLF
+	// LineEndingCR ends lines at CR.
+	LineEndingCR
+	// LineEndingCRLF ends lines at CRLF. A CR or LF alone is kept in the
+	// line.
+	LineEndingCRLF
+)
+
+var lineEndingNames = map[LineEnding]string{
+	LineEndingAny:  "any",
+	LineEndingLF:   "lf",
+	LineEndingCR:   "cr",
+	LineEndingCRLF: "crlf",
+}
+
+func (e LineEnding) String() string {
+	if name, ok := lineEndingNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("LineEnding(%d)", int(e))
+}
+
+// ParseLineEnding parses a line ending: any, lf, cr or crlf.
+func ParseLineEnding(s string) (LineEnding, error) {
+	for e, name := range lineEndingNames {
+		if s == name {
+			return e, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown line ending: %q", s)
+}
+
+// line is a line received from the port.
+type line struct {
+	text string
+	// partial is set when the line was cut short by Options.IdleFlush.
+	partial bool
+	// tail is set when text is the start of a line still being received,
+	// which is given for prompt matching only.
+	tail bool
+	// seq numbers the lines, so that a tail can be told apart from the
+	// line that it is the start of.
+	seq int
+	// offset is the number of bytes received before the line.
+	offset int64
+}
+
+// lineSplitter splits bytes into lines. Lines can be of any length.
+type lineSplitter struct {
+	ending  LineEnding
+	buf     []byte
+	afterCR bool
+	// seq is the sequence number of the line being received.
+	seq int
+	// n is the number of bytes added, and start the number added before
+	// the line being received.
+	n     int64
+	start int64
+}
+
+// add adds a byte, and returns the line that it ends, if any.
+func (l *lineSplitter) add(b byte) (string, bool) {
+	if len(l.buf) == 0 {
+		l.start = l.n
+	}
+	l.n++
+	afterCR := l.afterCR
+	l.afterCR = false
+	switch l.ending {
+	case LineEndingAny:
+		switch b {
+		case '\n':
+			if afterCR {
+				// The end of a CRLF, whose CR ended the line.
+				return "", false
+			}
+			return l.take(), true
+		case '\r':
+			l.afterCR = true
+			return l.take(), true
+		}
+	case LineEndingLF:
+		if b == '\n' {
+			return l.take(), true
+		}
+	case LineEndingCR:
+		if b == '\r' {
+			return l.take(), true
+		}
+	case LineEndingCRLF:
+		if b == '\n' && len(l.buf) > 0 && l.buf[len(l.buf)-1] == '\r' {
+			l.buf = l.buf[:len(l.buf)-1]
+			return l.take(), true
+		}
+	}
+	l.buf = append(l.buf, b)
+	return "", false
+}
+
+// take returns the buffered line, and empties the buffer.
+func (l *lineSplitter) take() string {
+	s := string(l.buf)
+	l.buf = l.buf[:0]
+	l.seq++
+	if l.ending == LineEndingLF && len(s) > 0 && s[len(s)-1] == '\r' {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// tails tells whether the line being received is given for matching, as well
+// as complete lines.
+func (s *session) tails() bool {
+	return s.opts.PromptPartial || s.opts.Ack != nil
+}
+
+// splitLines splits the bytes from byteCh into lines for lineCh, until
+// byteCh is closed. Then it records the error that reading ended with, and
+// closes lineCh.
+func (s *session) splitLines() {
+	defer close(s.lineCh)
+	l := &lineSplitter{ending: s.opts.LineEnding}
+	send := func(text string, partial bool) bool {
+		if !s.checkAbort(text) {
+			return false
+		}
+		// take has already moved on to the next line.
+		return sendContext(s.ctx, s.lineCh, line{text: text, partial: partial, seq: l.seq - 1, offset: l.start}) == nil
+	}
+	// tailLen is the length of the last tail sent.
+	tailLen := 0
+
+	var timer *time.Timer
+	var idle <-chan time.Time
+	if s.opts.IdleFlush > 0 {
+		timer = time.NewTimer(s.opts.IdleFlush)
+		timer.Stop()
+		defer timer.Stop()
+	}
+	for {
+		select {
+		case b, ok := <-s.byteCh:
+			if !ok {
+				if len(l.buf) > 0 {
+					send(l.take(), false)
+				}
+				select {
+				case err := <-s.errCh:
+					if err != io.EOF {
+						s.readErr = err
+					}
+				default:
+				}
+				return
+			}
+			if text, ok := l.add(b); ok {
+				tailLen = 0
+				if !send(text, false) {
+					return
+				}
+			}
+			// Give the tail for prompt matching once the bytes received so
+			// far are handled.
+			if s.tails() && len(l.buf) != tailLen && len(s.byteCh) == 0 {
+				tailLen = len(l.buf)
+				text := string(l.buf)
+				if !s.checkAbort(text) {
+					return
+				}
+				if sendContext(s.ctx, s.lineCh, line{text: text, tail: true, seq: l.seq, offset: l.start}) != nil {
+					return
+				}
+			}
+			if timer != nil && len(l.buf) > 0 {
+				timer.Reset(s.opts.IdleFlush)
+				idle = timer.C
+			}
+		case <-idle:
+			idle = nil
+			tailLen = 0
+			if len(l.buf) > 0 && !send(l.take(), true) {
+				return
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/filmil/futility/seriallib/serialtest"
+)
+
+func TestLineSplitter(t *testing.T) {
+	input := "a\nb\r\nc\rd\n\re"
+	tests := []struct {
+		ending LineEnding
+		want   []string
+		rest   string
+	}{
+		{ending: LineEndingAny, want: []string{"a", "b", "c", "d", ""}, rest: "e"},
+		{ending: LineEndingLF, want: []string{"a", "b", "c\rd"}, rest: "\re"},
+		{ending: LineEndingCR, want: []string{"a\nb", "\nc", "d\n"}, rest: "e"},
+		{ending: LineEndingCRLF, want: []string{"a\nb"}, rest: "c\rd\n\re"},
+	}
+	for _, tt := range tests {
+		l := &lineSplitter{ending: tt.ending}
+		var got []string
+		for _, b := range []byte(input) {
+			if text, ok := l.add(b); ok {
+				got = append(got, text)
+			}
+		}
+		if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tt.want) {
+			t.Errorf("%v: lines = %q, want %q", tt.ending, got, tt.want)
+		}
+		if string(l.buf) != tt.rest {
+			t.Errorf("%v: rest = %q, want %q", tt.ending, l.buf, tt.rest)
+		}
+	}
+}
+
+func TestParseLineEnding(t *testing.T) {
+	for _, e := range []LineEnding{LineEndingAny, LineEndingLF, LineEndingCR, LineEndingCRLF} {
+		if got, err := ParseLineEnding(e.String()); err != nil || got != e {
+			t.Errorf("ParseLineEnding(%q) = %v, %v", e.String(), got, err)
+		}
+	}
+	if _, err := ParseLineEnding("nl"); err == nil {
+		t.Error("ParseLineEnding(\"nl\") succeeded, want an error")
+	}
+}
+
+func TestRunLongLine(t *testing.T) {
+	long := strings.Repeat("x", 1<<20)
+	port := serialtest.NewPort()
+	port.Feed([]byte(long + "\nREADY\n"))
+	rec := &recorder{}
+	err := Run(context.Background(), port, strings.NewReader("data"), Options{Prompt: "READY", OnEvent: rec.record})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	var lines []Event
+	for _, e := range rec.events {
+		if e.Type == LineReceived {
+			lines = append(lines, e)
+		}
+	}
+	if len(lines) != 2 || len(lines[0].Line) != len(long) {
+		t.Errorf("got %d lines, want the long line and the prompt", len(lines))
+	}
+}
+
+func TestRunIdleFlush(t *testing.T) {
+	port := serialtest.NewPort()
+	port.Feed([]byte("login: "))
+	lineCh := make(chan Event, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Run(ctx, port, strings.NewReader(""), Options{
+		Prompt:    "never",
+		IdleFlush: 20 * time.Millisecond,
+		OnEvent: func(e Event) {
+			if e.Type == LineReceived {
+				lineCh <- e
+			}
+		},
+	})
+
+	select {
+	case e := <-lineCh:
+		if e.Line != "login: " || !e.Partial {
+			t.Errorf("got line %q, partial %v, want a partial \"login: \"", e.Line, e.Partial)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("partial line was not flushed")
+	}
+
+	port.Feed([]byte("root\r\n"))
+	select {
+	case e := <-lineCh:
+		if e.Line != "root" || e.Partial {
+			t.Errorf("got line %q, partial %v, want a complete \"root\"", e.Line, e.Partial)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("line was not received")
+	}
+}
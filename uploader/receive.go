@@ -0,0 +1,155 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package uploader
+
+import "fmt"
+
+const (
+	xon  = 0x11
+	xoff = 0x13
+)
+
+// ReceiveMode tells what becomes of the XON and XOFF characters received
+// while XON/XOFF flow control is used. With other kinds of flow control, they
+// are always ordinary data.
+type ReceiveMode int
+
+const (
+	// ReceiveDrop honors XON and XOFF, and drops them from the received
+	// data. It is the default.
+	ReceiveDrop ReceiveMode = iota
+	// ReceivePass honors XON and XOFF, and keeps them in the received data.
+	ReceivePass
+	// ReceiveSendOnly honors XON and XOFF, and drops them, only while data is
+	// being sent. At other times, such as while waiting for the prompt or
+	// lingering, they are ordinary data.
+	ReceiveSendOnly
+	// ReceiveEscape honors XON and XOFF, and replaces them in the received
+	// data with "^Q" and "^S".
+	ReceiveEscape
+)
+
+var receiveModeNames = map[ReceiveMode]string{
+	ReceiveDrop:     "drop",
+	ReceivePass:     "pass",
+	ReceiveSendOnly: "send-only",
+	ReceiveEscape:   "escape",
+}
+
+func (m ReceiveMode) String() string {
+	if name, ok := receiveModeNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("ReceiveMode(%d)", int(m))
+}
+
+// ParseReceiveMode parses a receive mode: drop, pass, send-only or escape.
+func ParseReceiveMode(s string) (ReceiveMode, error) {
+	for m, name := range receiveModeNames {
+		if s == name {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown receive mode: %q", s)
+}
+
+// receive handles bytes read from the port. XON and XOFF are handled as
+// opts.Receive says, and the rest goes to rawCh while a file transfer
+// protocol runs, or to byteCh, to be split into lines, otherwise. Bytes for
+// byteCh are translated if opts.TranslateReceived says so.
+func (s *session) receive(buf []byte) error {
+	var data []byte
+	for _, b := range buf {
+		if s.xonxoff && (b == xon || b == xoff) {
+			mode := s.opts.Receive
+			if mode != ReceiveSendOnly || s.sending.Load() {
+				paused := b == xoff
+				if paused {
+					s.emit(Event{Type: Paused})
+				} else {
+					s.emit(Event{Type: Resumed})
+				}
+				if err := s.setPaused(paused); err != nil {
+					return err
+				}
+				if mode == ReceiveSendOnly {
+					continue
+				}
+			}
+			// File transfer protocols never see flow control characters.
+			if s.raw.Load() {
+				continue
+			}
+			switch mode {
+			case ReceiveDrop:
+				continue
+			case ReceiveEscape:
+				c := byte('Q')
+				if b == xoff {
+					c = 'S'
+				}
+				for _, e := range []byte{'^', c} {
+					data = append(data, e)
+					if err := sendContext(s.ctx, s.byteCh, e); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+		}
+		if s.raw.Load() {
+			if err := sendContext(s.ctx, s.rawCh, b); err != nil {
+				return err
+			}
+			continue
+		}
+		if s.echoing.Load() {
+			select {
+			case s.echoCh <- b:
+			default:
+				// Nothing takes the echo while the upload is paused; rather
+				// than stall, drop the byte, which shows as an echo
+				// mismatch if it was awaited.
+			}
+		}
+		start := len(data)
+		if s.dec != nil {
+			data = s.dec.decode(data, b)
+		} else {
+			data = append(data, b)
+		}
+		for _, c := range data[start:] {
+			if err := sendContext(s.ctx, s.byteCh, c); err != nil {
+				return err
+			}
+		}
+	}
+	if len(data) > 0 {
+		s.emit(Event{Type: DataReceived, Data: data})
+		if s.opts.RawOutput != nil {
+			s.opts.RawOutput.Write(data)
+		}
+	}
+	return nil
+}
+
+// setPaused passes a change of the XON/XOFF flow control state to pauseCh.
+// While data is sent, each change is passed on; at other times nothing reads
+// pauseCh, so only the latest state is kept, to be found by the next sender.
+func (s *session) setPaused(paused bool) error {
+	if s.sending.Load() {
+		return sendContext(s.ctx, s.pauseCh, paused)
+	}
+	for {
+		select {
+		case <-s.pauseCh:
+			continue
+		default:
+		}
+		select {
+		case s.pauseCh <- paused:
+			return nil
+		default:
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/filmil/futility/seriallib"
+	"github.com/filmil/futility/seriallib/serialtest"
+)
+
+func TestReceiveModes(t *testing.T) {
+	// The device sends flow control characters before the prompt, and
+	// binary data after the upload.
+	before := "\x13\x11boot\nREADY\n"
+	after := "\x00\x13\x11\xff\n"
+	tests := []struct {
+		mode       ReceiveMode
+		flow       seriallib.FlowControl
+		wantPauses int
+		want       string
+	}{
+		{mode: ReceiveDrop, wantPauses: 4, want: "boot\nREADY\n\x00\xff\n"},
+		{mode: ReceivePass, wantPauses: 4, want: before + after},
+		{mode: ReceiveSendOnly, wantPauses: 0, want: before + after},
+		{mode: ReceiveEscape, wantPauses: 4, want: "^S^Qboot\nREADY\n\x00^S^Q\xff\n"},
+		{mode: ReceiveDrop, flow: seriallib.FlowNone, wantPauses: 0, want: before + after},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode.String()+"/"+tt.flow.String(), func(t *testing.T) {
+			port := serialtest.NewPort()
+			port.Feed([]byte(before))
+			rec := &recorder{data: true}
+			var raw bytes.Buffer
+			err := Run(context.Background(), port, strings.NewReader("data"), Options{
+				Mode:      &seriallib.Mode{FlowControl: tt.flow},
+				Prompt:    "READY",
+				Linger:    true,
+				Receive:   tt.mode,
+				RawOutput: &raw,
+				OnEvent: func(e Event) {
+					rec.record(e)
+					if e.Type == Lingering {
+						port.Feed([]byte(after))
+						port.CloseInput()
+					}
+				},
+			})
+			// Lingering after a prompt waits for the prompt again, until the
+			// port is closed.
+			if err == nil || err.Error() != "prompt not found" {
+				t.Fatalf("Run: %v", err)
+			}
+			if raw.String() != tt.want {
+				t.Errorf("raw output = %q, want %q", raw.String(), tt.want)
+			}
+			var data []byte
+			pauses := 0
+			for _, e := range rec.events {
+				switch e.Type {
+				case DataReceived:
+					data = append(data, e.Data...)
+				case Paused, Resumed:
+					pauses++
+				}
+			}
+			if string(data) != tt.want {
+				t.Errorf("received data = %q, want %q", data, tt.want)
+			}
+			if pauses != tt.wantPauses {
+				t.Errorf("got %d flow control events, want %d", pauses, tt.wantPauses)
+			}
+		})
+	}
+}
+
+func TestReceiveManyFlowControlBytes(t *testing.T) {
+	// More XON and XOFF than pauseCh holds arrive while waiting for the
+	// prompt and while lingering, when no sender reads them.
+	port := serialtest.NewPort()
+	port.Feed([]byte(strings.Repeat("\x13\x11", 15) + "READY\n"))
+	after := strings.Repeat("\x11", 20) + "end\n"
+	var raw bytes.Buffer
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := Run(ctx, port, strings.NewReader("data"), Options{
+		Prompt:    "READY",
+		Linger:    true,
+		Receive:   ReceivePass,
+		RawOutput: &raw,
+		// The flow control characters are kept in the prompt's line.
+		PromptSubstring: true,
+		OnEvent: func(e Event) {
+			if e.Type == Lingering {
+				port.Feed([]byte(after))
+				port.CloseInput()
+			}
+		},
+	})
+	if err == nil || err.Error() != "prompt not found" {
+		t.Fatalf("Run: %v", err)
+	}
+	// The last state before the prompt was XON, so the data was sent.
+	if got := string(port.Written()); got != "data" {
+		t.Errorf("written = %q, want %q", got, "data")
+	}
+	if !strings.HasSuffix(raw.String(), after) {
+		t.Errorf("raw output = %q, want it to end with %q", raw.String(), after)
+	}
+}
+
+func TestParseReceiveMode(t *testing.T) {
+	for _, m := range []ReceiveMode{ReceiveDrop, ReceivePass, ReceiveSendOnly, ReceiveEscape} {
+		if got, err := ParseReceiveMode(m.String()); err != nil || got != m {
+			t.Errorf("ParseReceiveMode(%q) = %v, %v", m.String(), got, err)
+		}
+	}
+	if _, err := ParseReceiveMode("keep"); err == nil {
+		t.Error("ParseReceiveMode(\"keep\") succeeded, want an error")
+	}
+}
@@ -0,0 +1,222 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package uploader
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reopenInterval is how often the reopen step of a reset sequence tries to
+// open the port.
+const reopenInterval = 100 * time.Millisecond
+
+// ResetAction is what a ResetStep does.
+type ResetAction int
+
+const (
+	// SetDTR sets the DTR line to Value.
+	SetDTR ResetAction = iota
+	// SetRTS sets the RTS line to Value.
+	SetRTS
+	// Sleep waits for Delay.
+	Sleep
+	// SetBaudRate switches the port to BaudRate. The port is switched back
+	// to Options.Mode when the sequence ends.
+	SetBaudRate
+	// Reopen closes the port and opens it again with Options.Reopen, trying
+	// for up to Delay, for devices that go away from the bus and come back
+	// after a reset. The mode is applied to the new port.
+	Reopen
+)
+
+// ResetStep is one step of a reset sequence, which changes the modem control
+// lines of the port to make the device reset, or enter its bootloader.
+type ResetStep struct {
+	Action   ResetAction
+	Value    bool
+	Delay    time.Duration
+	BaudRate int
+}
+
+func (s ResetStep) String() string {
+	switch s.Action {
+	case SetDTR, SetRTS:
+		v := 0
+		if s.Value {
+			v = 1
+		}
+		if s.Action == SetDTR {
+			return fmt.Sprintf("dtr=%d", v)
+		}
+		return fmt.Sprintf("rts=%d", v)
+	case Sleep:
+		return fmt.Sprintf("sleep=%v", s.Delay)
+	case SetBaudRate:
+		return fmt.Sprintf("baud=%d", s.BaudRate)
+	case Reopen:
+		return fmt.Sprintf("reopen=%v", s.Delay)
+	default:
+		return "unknown"
+	}
+}
+
+// resetPresets are the named reset sequences. A line set to 1 is asserted,
+// which drives the pin of most USB adapters low.
+var resetPresets = map[string]string{
+	// esptool's classic reset: hold EN low with RTS, then release it while
+	// holding IO0 low with DTR, so that the chip boots into its bootloader.
+	"esp32-classic": "dtr=0,rts=1,sleep=100ms,dtr=1,rts=0,sleep=50ms,dtr=0",
+	// Opening the port at 1200 baud and dropping DTR makes boards with
+	// native USB, such as the Leonardo, reset into their bootloader. The
+	// bootloader comes up as a new USB device, which is opened again.
+	"arduino-1200bps-touch": "baud=1200,dtr=1,sleep=50ms,dtr=0,sleep=500ms,reopen=10s",
+	// A short DTR pulse, which resets classic Arduino boards through the
+	// capacitor on their reset line.
+	"pulse-dtr": "dtr=0,sleep=100ms,dtr=1,sleep=100ms,dtr=0",
+}
+
+// ResetPresets returns the names of the preset reset sequences.
+func ResetPresets() []string {
+	var names []string
+	for name := range resetPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseResetSequence parses a reset sequence, which is either the name of a
+// preset, or a comma-separated list of steps: dtr=0 or dtr=1, rts=0 or rts=1,
+// sleep=DURATION, baud=RATE, and reopen=DURATION. For example: "dtr=0,rts=1,sleep=100ms,rts=0".
+func ParseResetSequence(s string) ([]ResetStep, error) {
+	if preset, ok := resetPresets[s]; ok {
+		s = preset
+	}
+	var steps []ResetStep
+	for _, field := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return nil, fmt.Errorf("bad reset step %q: want a preset (%s) or key=value", field, strings.Join(ResetPresets(), ", "))
+		}
+		var step ResetStep
+		switch key {
+		case "dtr", "rts":
+			step.Action = SetDTR
+			if key == "rts" {
+				step.Action = SetRTS
+			}
+			switch value {
+			case "0":
+			case "1":
+				step.Value = true
+			default:
+				return nil, fmt.Errorf("bad reset step %q: want 0 or 1", field)
+			}
+		case "sleep":
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("bad reset step %q: want a duration such as 100ms", field)
+			}
+			step.Action = Sleep
+			step.Delay = d
+		case "baud":
+			rate, err := strconv.Atoi(value)
+			if err != nil || rate <= 0 {
+				return nil, fmt.Errorf("bad reset step %q: want a baud rate", field)
+			}
+			step.Action = SetBaudRate
+			step.BaudRate = rate
+		case "reopen":
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("bad reset step %q: want a duration such as 10s", field)
+			}
+			step.Action = Reopen
+			step.Delay = d
+		default:
+			return nil, fmt.Errorf("bad reset step %q: unknown key %q", field, key)
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// reset runs the reset sequence.
+func (s *session) reset() error {
+	if len(s.opts.ResetSequence) == 0 {
+		return nil
+	}
+	s.emit(Event{Type: Resetting})
+	baudChanged := false
+	for _, step := range s.opts.ResetSequence {
+		var err error
+		switch step.Action {
+		case SetDTR:
+			err = s.port.SetDTR(step.Value)
+		case SetRTS:
+			err = s.port.SetRTS(step.Value)
+		case Sleep:
+			t := time.NewTimer(step.Delay)
+			select {
+			case <-t.C:
+			case <-s.ctx.Done():
+				t.Stop()
+				return s.ctx.Err()
+			}
+		case SetBaudRate:
+			if s.opts.Mode == nil {
+				return fmt.Errorf("reset step %v needs a serial port mode", step)
+			}
+			mode := *s.opts.Mode
+			mode.BaudRate = step.BaudRate
+			err = s.port.SetMode(&mode)
+			baudChanged = true
+		case Reopen:
+			if s.opts.Reopen == nil {
+				return fmt.Errorf("reset step %v needs a way to open the port again", step)
+			}
+			err = s.reopen(step.Delay)
+			// The new port starts out in its own mode.
+			baudChanged = s.opts.Mode != nil
+		default:
+			err = fmt.Errorf("unknown reset action: %d", step.Action)
+		}
+		if err != nil {
+			return fmt.Errorf("reset step %v failed: %w", step, err)
+		}
+	}
+	if baudChanged {
+		if err := s.port.SetMode(s.opts.Mode); err != nil {
+			return fmt.Errorf("failed to restore serial port mode after reset: %w", err)
+		}
+	}
+	return nil
+}
+
+// reopen closes the port and opens it again, trying every reopenInterval
+// until timeout has passed.
+func (s *session) reopen(timeout time.Duration) error {
+	s.port.Close()
+	deadline := time.Now().Add(timeout)
+	for {
+		p, err := s.opts.Reopen()
+		if err == nil {
+			s.port = p
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		t := time.NewTimer(reopenInterval)
+		select {
+		case <-t.C:
+		case <-s.ctx.Done():
+			t.Stop()
+			return s.ctx.Err()
+		}
+	}
+}
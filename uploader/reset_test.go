@@ -0,0 +1,161 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/filmil/futility/seriallib"
+	"github.com/filmil/futility/seriallib/serialtest"
+)
+
+func TestParseResetSequence(t *testing.T) {
+	tests := []struct {
+		seq     string
+		want    string
+		wantErr bool
+	}{
+		{seq: "dtr=1,sleep=100ms,dtr=0", want: "[dtr=1 sleep=100ms dtr=0]"},
+		{seq: "rts=1, baud=1200", want: "[rts=1 baud=1200]"},
+		{seq: "dtr=0,reopen=5s", want: "[dtr=0 reopen=5s]"},
+		{seq: "esp32-classic", want: "[dtr=0 rts=1 sleep=100ms dtr=1 rts=0 sleep=50ms dtr=0]"},
+		{seq: "dtr=2", wantErr: true},
+		{seq: "sleep=soon", wantErr: true},
+		{seq: "baud=0", wantErr: true},
+		{seq: "reopen=later", wantErr: true},
+		{seq: "cts=1", wantErr: true},
+		{seq: "no-such-preset", wantErr: true},
+	}
+	for _, tt := range tests {
+		steps, err := ParseResetSequence(tt.seq)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseResetSequence(%q) = %v, want an error", tt.seq, steps)
+			}
+			continue
+		}
+		if err != nil || fmt.Sprint(steps) != tt.want {
+			t.Errorf("ParseResetSequence(%q) = %v, %v, want %s", tt.seq, steps, err, tt.want)
+		}
+	}
+	for _, name := range ResetPresets() {
+		if _, err := ParseResetSequence(name); err != nil {
+			t.Errorf("preset %q: %v", name, err)
+		}
+	}
+}
+
+func TestRunResetSequence(t *testing.T) {
+	steps, err := ParseResetSequence("baud=1200,dtr=1,rts=1,sleep=50ms,dtr=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := serialtest.NewPort()
+	port.Feed([]byte("READY\n"))
+	mode := &seriallib.Mode{BaudRate: 115200, DataBits: 8, StopBits: 1, Parity: seriallib.ParityNone}
+	rec := &recorder{}
+	err = Run(context.Background(), port, strings.NewReader("data"), Options{
+		Mode:          mode,
+		ResetSequence: steps,
+		Prompt:        "READY",
+		OnEvent:       rec.record,
+	})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	changes := port.Changes()
+	var got []string
+	for _, c := range changes {
+		got = append(got, fmt.Sprintf("%s=%v", c.Line, c.Value))
+	}
+	if want := "[DTR=true RTS=true DTR=false]"; fmt.Sprint(got) != want {
+		t.Errorf("line changes = %v, want %s", got, want)
+	}
+	if d := changes[2].Time.Sub(changes[1].Time); d < 50*time.Millisecond {
+		t.Errorf("DTR dropped %v after RTS was set, want at least 50ms", d)
+	}
+	if m := port.Mode(); m == nil || m.BaudRate != 115200 {
+		t.Errorf("mode after reset = %+v, want 115200 baud", m)
+	}
+	if types := rec.types(); types[0] != Resetting {
+		t.Errorf("events = %v, want resetting first", types)
+	}
+	if got := string(port.Written()); got != "data" {
+		t.Errorf("written = %q, want \"data\"", got)
+	}
+}
+
+func TestRunResetCanceled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := Run(ctx, serialtest.NewPort(), strings.NewReader(""), Options{
+		ResetSequence: []ResetStep{{Action: Sleep, Delay: time.Hour}},
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("Run() = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestRunResetReopen(t *testing.T) {
+	steps, err := ParseResetSequence("arduino-1200bps-touch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The device goes away after the touch, and its bootloader shows up as
+	// another port after a couple of tries.
+	old, bootloader := serialtest.NewPort(), serialtest.NewPort()
+	bootloader.Feed([]byte("READY\n"))
+	tries := 0
+	reopen := func() (seriallib.Port, error) {
+		if !old.Closed() {
+			t.Error("port opened again before it was closed")
+		}
+		if tries++; tries < 3 {
+			return nil, errors.New("no such device")
+		}
+		return bootloader, nil
+	}
+	mode := &seriallib.Mode{BaudRate: 115200, DataBits: 8, StopBits: 1, Parity: seriallib.ParityNone}
+	err = Run(context.Background(), old, strings.NewReader("data"), Options{
+		Mode:          mode,
+		ResetSequence: steps,
+		Reopen:        reopen,
+		Prompt:        "READY",
+	})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if tries != 3 {
+		t.Errorf("tried to open the port %d times, want 3", tries)
+	}
+	if got := string(old.Written()); got != "" {
+		t.Errorf("written to the old port = %q, want nothing", got)
+	}
+	if got := string(bootloader.Written()); got != "data" {
+		t.Errorf("written to the new port = %q, want \"data\"", got)
+	}
+	if m := bootloader.Mode(); m == nil || m.BaudRate != 115200 {
+		t.Errorf("mode of the new port = %+v, want 115200 baud", m)
+	}
+	if !bootloader.Closed() {
+		t.Error("new port not closed when the session ended")
+	}
+}
+
+func TestRunResetReopenFails(t *testing.T) {
+	err := Run(context.Background(), serialtest.NewPort(), strings.NewReader(""), Options{
+		ResetSequence: []ResetStep{{Action: Reopen, Delay: 50 * time.Millisecond}},
+		Reopen: func() (seriallib.Port, error) {
+			return nil, errors.New("no such device")
+		},
+	})
+	if err == nil || !strings.Contains(err.Error(), "no such device") {
+		t.Errorf("Run() = %v, want the error opening the port", err)
+	}
+}
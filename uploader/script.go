@@ -0,0 +1,345 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package uploader
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/filmil/futility/seriallib"
+)
+
+var (
+	// ErrExpectTimeout is returned when a script's expect step does not see
+	// what it expects in time.
+	ErrExpectTimeout = errors.New("expected text not seen")
+	// ErrAborted is returned when a line received while running a script
+	// matches one of its abort patterns.
+	ErrAborted = errors.New("aborted")
+)
+
+// defaultExpectTimeout is how long expect steps wait, until a timeout step
+// says otherwise.
+const defaultExpectTimeout = 10 * time.Second
+
+// Script is a list of steps to run over a serial port, parsed by ParseScript.
+//
+// Each line of a script holds one step, a command and its argument.
+// Arguments may be written as Go string literals, in double quotes or
+// backquotes, to give escapes or leading and trailing spaces. ${name} is
+// replaced with the value of the variable name in the arguments of expect,
+// send, sendfile and set. Empty lines, and lines starting with #, are
+// ignored. The commands are:
+//
+//	expect REGEXP     wait for a received line, or the start of the line
+//	                  being received, in which REGEXP finds a match; named
+//	                  groups, such as (?P<ip>\S+), set variables
+//	send STRING       send STRING
+//	sendfile PATH     send the contents of the file at PATH
+//	sleep DURATION    wait, such as sleep 500ms
+//	timeout DURATION  set how long the next expect steps wait (10s at first)
+//	abort REGEXP      end the script with an error if a received line
+//	                  matches REGEXP, from now on
+//	set NAME VALUE    set the variable NAME
+//
+// For example:
+//
+//	abort "Login incorrect"
+//	expect "login: $"
+//	send "${user}\r"
+//	expect "[#$] $"
+//	send "cat > /tmp/app.py\r"
+//	sendfile app.py
+//	send "\x04"
+//	expect "[#$] $"
+type Script struct {
+	steps []step
+}
+
+// step is one step of a script.
+type step struct {
+	// line is the line number of the step in the script.
+	line int
+	// text is the step as written.
+	text string
+	cmd  string
+	arg  string
+	// name is the variable that a set step sets.
+	name string
+	// re is the regular expression of an expect or abort step, if it has no
+	// variables to replace.
+	re *regexp.Regexp
+	d  time.Duration
+}
+
+// ParseScript reads a script.
+func ParseScript(r io.Reader) (*Script, error) {
+	sc := &Script{}
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		st, err := parseStep(text)
+		if err != nil {
+			return nil, fmt.Errorf("script line %d: %w", n, err)
+		}
+		st.line = n
+		sc.steps = append(sc.steps, st)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read script: %w", err)
+	}
+	return sc, nil
+}
+
+func parseStep(text string) (step, error) {
+	cmd, rest, _ := strings.Cut(text, " ")
+	rest = strings.TrimSpace(rest)
+	st := step{text: text, cmd: cmd}
+	if cmd == "set" {
+		name, value, _ := strings.Cut(rest, " ")
+		if !regexp.MustCompile(`^\w+$`).MatchString(name) {
+			return st, fmt.Errorf("bad variable name %q", name)
+		}
+		st.name = name
+		rest = strings.TrimSpace(value)
+	}
+	arg, err := parseArg(rest)
+	if err != nil {
+		return st, err
+	}
+	st.arg = arg
+
+	switch cmd {
+	case "expect", "abort":
+		if arg == "" {
+			return st, fmt.Errorf("%s needs a regular expression", cmd)
+		}
+		if !strings.Contains(arg, "${") {
+			if st.re, err = regexp.Compile(arg); err != nil {
+				return st, err
+			}
+		}
+	case "send", "set":
+	case "sendfile":
+		if arg == "" {
+			return st, errors.New("sendfile needs a file name")
+		}
+	case "sleep", "timeout":
+		if st.d, err = time.ParseDuration(arg); err != nil || st.d < 0 {
+			return st, fmt.Errorf("%s needs a duration, such as 500ms, got %q", cmd, arg)
+		}
+	default:
+		return st, fmt.Errorf("unknown command %q", cmd)
+	}
+	return st, nil
+}
+
+// parseArg returns the argument of a step, unquoting it if it starts with a
+// quote. Other arguments, such as \"abc\", are taken as they are.
+func parseArg(s string) (string, error) {
+	if s == "" || (s[0] != '"' && s[0] != '`') {
+		return s, nil
+	}
+	if !terminated(s) {
+		return "", fmt.Errorf("unterminated quoted argument %s", s)
+	}
+	arg, err := strconv.Unquote(s)
+	if err != nil {
+		return "", fmt.Errorf("bad quoted argument %s", s)
+	}
+	return arg, nil
+}
+
+// terminated tells whether s, which starts with a quote, ends with the same
+// quote. A double quote preceded by an odd number of backslashes is escaped,
+// and does not end s.
+func terminated(s string) bool {
+	if len(s) < 2 || s[len(s)-1] != s[0] {
+		return false
+	}
+	if s[0] == '`' {
+		return true
+	}
+	body := s[1 : len(s)-1]
+	backslashes := len(body) - len(strings.TrimRight(body, `\`))
+	return backslashes%2 == 0
+}
+
+// variableRE matches a variable in a script argument.
+var variableRE = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// expand replaces the variables in s with their values.
+func expand(s string, vars map[string]string) (string, error) {
+	var err error
+	s = variableRE.ReplaceAllStringFunc(s, func(v string) string {
+		name := v[2 : len(v)-1]
+		value, ok := vars[name]
+		if !ok && err == nil {
+			err = fmt.Errorf("variable %q is not set", name)
+		}
+		return value
+	})
+	return s, err
+}
+
+// RunScript runs a script over port. The options that set up the port and
+// receive data apply, as do Linger, LineBuffer and OnEvent; the prompt and
+// protocol options do not. Paths in sendfile steps are relative to the
+// current directory.
+//
+// If ctx is done before the script ends, RunScript returns the context's
+// error.
+func RunScript(ctx context.Context, port seriallib.Port, script *Script, opts Options) error {
+	// Expect steps match the line being received.
+	opts.PromptPartial = true
+	return runSession(ctx, port, opts, func(s *session) error {
+		s.holdLines = true
+		return s.runScript(script)
+	})
+}
+
+func (s *session) runScript(script *Script) error {
+	if err := s.setup(); err != nil {
+		return err
+	}
+	r := &scriptRun{s: s, vars: map[string]string{}, timeout: defaultExpectTimeout, matched: -1}
+	for _, st := range script.steps {
+		s.emit(Event{Type: ScriptStep, Line: st.text, Count: st.line})
+		if err := r.run(st); err != nil {
+			return fmt.Errorf("script line %d: %w", st.line, err)
+		}
+	}
+	if s.opts.Linger {
+		return s.linger()
+	}
+	return nil
+}
+
+// scriptRun holds the state of a running script.
+type scriptRun struct {
+	s       *session
+	vars    map[string]string
+	timeout time.Duration
+	// matched is the sequence number of the line that the last expect step
+	// matched, so that the rest of that line is not matched again.
+	matched int
+}
+
+func (r *scriptRun) run(st step) error {
+	s := r.s
+	arg := st.arg
+	switch st.cmd {
+	case "expect", "send", "sendfile", "set", "abort":
+		var err error
+		if arg, err = expand(arg, r.vars); err != nil {
+			return err
+		}
+	}
+	re := st.re
+	if re == nil && (st.cmd == "expect" || st.cmd == "abort") {
+		var err error
+		if re, err = regexp.Compile(arg); err != nil {
+			return err
+		}
+	}
+
+	switch st.cmd {
+	case "expect":
+		return r.expect(re)
+	case "send":
+		return s.sendRaw(strings.NewReader(arg))
+	case "sendfile":
+		f, err := os.Open(arg)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		s.emit(Event{Type: Sending, File: arg})
+		if err := s.sendRaw(f); err != nil {
+			return err
+		}
+		s.emit(Event{Type: Sent, File: arg})
+	case "sleep":
+		t := time.NewTimer(st.d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	case "timeout":
+		r.timeout = st.d
+	case "abort":
+		s.abortMu.Lock()
+		s.abortOn = append(s.abortOn, re)
+		s.abortMu.Unlock()
+	case "set":
+		r.vars[st.name] = arg
+	}
+	return nil
+}
+
+// expect waits for a line that re matches.
+func (r *scriptRun) expect(re *regexp.Regexp) error {
+	s := r.s
+	t := time.NewTimer(r.timeout)
+	defer t.Stop()
+	for {
+		l, ok, err := s.nextLine(t.C)
+		if err == errTimeout {
+			return fmt.Errorf("%w within %v: %q", ErrExpectTimeout, r.timeout, re)
+		}
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if s.readErr != nil {
+				return fmt.Errorf("error reading from serial port: %w", s.readErr)
+			}
+			return fmt.Errorf("port closed while expecting %q", re)
+		}
+		s.recvLine(l)
+		if l.seq == r.matched {
+			continue
+		}
+		m := re.FindStringSubmatch(l.text)
+		if m == nil {
+			continue
+		}
+		r.matched = l.seq
+		for i, name := range re.SubexpNames() {
+			if name != "" {
+				r.vars[name] = m[i]
+			}
+		}
+		s.emit(Event{Type: PromptSeen, Line: l.text})
+		return nil
+	}
+}
+
+// checkAbort ends the session if text matches an abort pattern. It reports
+// whether the session goes on.
+func (s *session) checkAbort(text string) bool {
+	s.abortMu.Lock()
+	defer s.abortMu.Unlock()
+	for _, re := range s.abortOn {
+		if re.MatchString(text) {
+			s.cancel(fmt.Errorf("%w: received %q, which matches %q", ErrAborted, text, re))
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,133 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package uploader
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/filmil/futility/seriallib/serialtest"
+)
+
+func parseScript(t *testing.T, text string) *Script {
+	t.Helper()
+	sc, err := ParseScript(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("ParseScript: %v", err)
+	}
+	return sc
+}
+
+func TestParseScriptErrors(t *testing.T) {
+	tests := []struct {
+		script string
+		want   string
+	}{
+		{script: "jump 3", want: `script line 1: unknown command "jump"`},
+		{script: "# login\n\nexpect (", want: "script line 3: error parsing regexp"},
+		{script: "expect", want: "script line 1: expect needs a regular expression"},
+		{script: "sleep soon", want: `script line 1: sleep needs a duration, such as 500ms, got "soon"`},
+		{script: `send "a\q"`, want: `script line 1: bad quoted argument "a\q"`},
+		{script: "set a-b 1", want: `script line 1: bad variable name "a-b"`},
+		{script: "sendfile", want: "script line 1: sendfile needs a file name"},
+	}
+	for _, tt := range tests {
+		_, err := ParseScript(strings.NewReader(tt.script))
+		if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("ParseScript(%q) = %v, want %q", tt.script, err, tt.want)
+		}
+	}
+}
+
+func TestParseArg(t *testing.T) {
+	tests := map[string]string{
+		`abc`:            `abc`,
+		`"abc\r"`:        "abc\r",
+		"`a\\b`":         `a\b`,
+		`\"abc\"`:        `\"abc\"`,
+		`"a\\"`:          `a\`,
+		`'single'`:       `'single'`,
+		`"${user}@${h}"`: `${user}@${h}`,
+	}
+	for arg, want := range tests {
+		got, err := parseArg(arg)
+		if err != nil || got != want {
+			t.Errorf("parseArg(%s) = %q, %v, want %q", arg, got, err, want)
+		}
+	}
+	for _, arg := range []string{`"abc`, `"say \"hi\"`, `"`, "`abc"} {
+		if got, err := parseArg(arg); err == nil || !strings.Contains(err.Error(), "unterminated") {
+			t.Errorf("parseArg(%s) = %q, %v, want an unterminated quote error", arg, got, err)
+		}
+	}
+}
+
+func TestRunScript(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "app.txt")
+	if err := os.WriteFile(file, []byte("file data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	port := serialtest.NewPort()
+	port.Feed([]byte("boot\r\nip=10.0.0.5\r\n# "))
+	sc := parseScript(t, `
+# Wait for the address, then for the shell prompt.
+expect ip=(?P<ip>\S+)
+set user root
+send "${user}@${ip}\r"
+expect "^# $"
+sendfile `+file+`
+`)
+	rec := &recorder{}
+	if err := RunScript(context.Background(), port, sc, Options{OnEvent: rec.record}); err != nil {
+		t.Fatalf("RunScript: %v", err)
+	}
+	if got, want := string(port.Written()), "root@10.0.0.5\rfile data"; got != want {
+		t.Errorf("written %q, want %q", got, want)
+	}
+	var steps []int
+	for _, e := range rec.events {
+		if e.Type == ScriptStep {
+			steps = append(steps, e.Count)
+		}
+	}
+	if len(steps) != 5 || steps[0] != 3 || steps[4] != 7 {
+		t.Errorf("script steps at lines %v, want 3 to 7", steps)
+	}
+}
+
+func TestRunScriptExpectTimeout(t *testing.T) {
+	port := serialtest.NewPort()
+	port.Feed([]byte("boot\n"))
+	sc := parseScript(t, "timeout 20ms\nexpect login")
+	err := RunScript(context.Background(), port, sc, Options{})
+	if !errors.Is(err, ErrExpectTimeout) || !strings.HasPrefix(err.Error(), "script line 2: ") {
+		t.Errorf("RunScript = %v, want ErrExpectTimeout at line 2", err)
+	}
+}
+
+func TestRunScriptAbort(t *testing.T) {
+	port := serialtest.NewPort()
+	sc := parseScript(t, "abort `(?i)panic`\nsend go\nexpect done")
+	err := RunScript(context.Background(), port, sc, Options{
+		OnEvent: func(e Event) {
+			if e.Type == ScriptStep && e.Count == 3 {
+				port.Feed([]byte("Kernel PANIC\n"))
+			}
+		},
+	})
+	if !errors.Is(err, ErrAborted) {
+		t.Errorf("RunScript = %v, want ErrAborted", err)
+	}
+}
+
+func TestRunScriptUnsetVariable(t *testing.T) {
+	port := serialtest.NewPort()
+	err := RunScript(context.Background(), port, parseScript(t, "send ${name}"), Options{})
+	if err == nil || err.Error() != `script line 1: variable "name" is not set` {
+		t.Errorf("RunScript = %v, want an unset variable error", err)
+	}
+}
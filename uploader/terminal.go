@@ -0,0 +1,201 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package uploader
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/filmil/futility/seriallib"
+)
+
+// DefaultEscape is the character that starts a local command in an
+// interactive terminal, unless Terminal.Escape says otherwise: Ctrl-], as in
+// telnet.
+const DefaultEscape = 0x1d
+
+// Terminal makes lingering interactive: what is typed is sent to the port,
+// and the escape character followed by a key runs a local command:
+//
+//	q or .  quit
+//	k       send a break
+//	d       toggle the DTR line
+//	r       toggle the RTS line
+//	s       send a file, whose name is typed next
+//	? or h  list the commands
+//
+// The keys are those of every terminal; see Command. Typing the escape
+// character twice sends it.
+type Terminal struct {
+	// Input is what is typed, such as stdin in raw mode. Reading it is not
+	// interrupted when the session ends.
+	Input io.Reader
+	// Escape is the character that starts a local command. Defaults to
+	// DefaultEscape.
+	Escape byte
+	// Messages, if set, receives the list of commands, and the file name
+	// being typed.
+	Messages io.Writer
+	// Start, if set, is called when the interaction starts, such as to put
+	// the terminal into raw mode. The function that it returns, if any, is
+	// called when the interaction ends.
+	Start func() (func(), error)
+}
+
+// terminal holds the state of an interaction.
+type terminal struct {
+	s   *session
+	cfg *Terminal
+	msg io.Writer
+	tr  *translator
+	// keys tells what is typed from the local commands.
+	keys Keys
+	// dtr and rts are the states that the output lines were last set to.
+	dtr, rts bool
+}
+
+// interact reports the lines received, and sends what is typed, until the
+// port closes or the quit command is typed.
+func (s *session) interact() error {
+	cfg := s.opts.Terminal
+	t := &terminal{s: s, cfg: cfg, msg: cfg.Messages, tr: newTranslator(s.opts), dtr: true, rts: true}
+	if t.msg == nil {
+		t.msg = io.Discard
+	}
+	if t.cfg.Escape == 0 {
+		// A copy, so that the caller's Terminal is left alone.
+		c := *cfg
+		c.Escape = DefaultEscape
+		t.cfg = &c
+	}
+	t.keys = Keys{Escape: t.cfg.Escape, Messages: t.msg}
+	// The lines are as the reset sequence left them, or else as opening the
+	// port left them: asserted.
+	for _, step := range s.opts.ResetSequence {
+		switch step.Action {
+		case SetDTR:
+			t.dtr = step.Value
+		case SetRTS:
+			t.rts = step.Value
+		}
+	}
+	if cfg.Start != nil {
+		restore, err := cfg.Start()
+		if err != nil {
+			return fmt.Errorf("failed to start the terminal: %w", err)
+		}
+		if restore != nil {
+			defer restore()
+		}
+	}
+
+	s.startLinger()
+	keys := ReadKeys(cfg.Input)
+	for {
+		select {
+		case l, ok := <-s.lineCh:
+			if !ok {
+				return s.lingerClosed()
+			}
+			s.recvLine(l)
+			if done, err := s.lingerOutcome(l); done {
+				return err
+			}
+		case <-s.lingerTimeout():
+			return s.lingerTimeoutErr()
+		case p, ok := <-keys:
+			if !ok {
+				// Nothing more can be typed; keep reporting what is
+				// received.
+				keys = nil
+				continue
+			}
+			quit, err := t.keys.Handle(p, t.send, t.command)
+			if err != nil || quit {
+				return err
+			}
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+}
+
+// send sends what was typed, translated as the data sent is.
+func (t *terminal) send(p []byte) error {
+	if t.tr != nil {
+		p = t.tr.translate(p)
+	}
+	if len(p) == 0 {
+		return nil
+	}
+	if _, err := seriallib.WriteContext(t.s.ctx, t.s.port, p); err != nil {
+		return fmt.Errorf("failed to write to serial port: %w", err)
+	}
+	return nil
+}
+
+// command runs a local command. It reports whether the command is quit.
+// Failed commands are reported with a LocalCommand event, and do not end
+// the session.
+func (t *terminal) command(c Command) (bool, error) {
+	s := t.s
+	switch c {
+	case Quit:
+		s.emit(Event{Type: LocalCommand, Line: "quit"})
+		return true, nil
+	case Break:
+		err := seriallib.SendBreak(s.port, BreakLength)
+		s.emit(Event{Type: LocalCommand, Line: "break", Err: err})
+	case ToggleDTR:
+		err := s.port.SetDTR(!t.dtr)
+		if err == nil {
+			t.dtr = !t.dtr
+		}
+		s.emit(Event{Type: LocalCommand, Line: "DTR " + OnOff(t.dtr), Err: err})
+	case ToggleRTS:
+		err := s.port.SetRTS(!t.rts)
+		if err == nil {
+			t.rts = !t.rts
+		}
+		s.emit(Event{Type: LocalCommand, Line: "RTS " + OnOff(t.rts), Err: err})
+	case SendFile:
+		t.keys.Ask("file to send: ", t.sendFile)
+	default:
+		t.help()
+	}
+	return false, nil
+}
+
+// help lists the local commands.
+func (t *terminal) help() {
+	WriteHelp(t.msg, t.cfg.Escape, Quit, Break, ToggleDTR, ToggleRTS, SendFile, Help)
+	fmt.Fprintf(t.msg, "now: DTR %s, RTS %s\r\n", OnOff(t.dtr), OnOff(t.rts))
+}
+
+// sendFile sends the named file with the raw protocol. Errors, other than
+// the session ending, are reported with a LocalCommand event.
+func (t *terminal) sendFile(name string) error {
+	s := t.s
+	f, err := os.Open(name)
+	if err != nil {
+		s.emit(Event{Type: LocalCommand, Line: "send " + name, Err: err})
+		return nil
+	}
+	defer f.Close()
+	file := filepath.Base(name)
+	s.emit(Event{Type: Sending, File: file})
+	s.sending.Store(true)
+	err = s.sendRaw(f)
+	s.sending.Store(false)
+	if err != nil {
+		if s.ctx.Err() != nil {
+			return err
+		}
+		s.emit(Event{Type: LocalCommand, Line: "send " + name, Err: err})
+		return nil
+	}
+	s.emit(Event{Type: Sent, File: file})
+	return nil
+}
@@ -0,0 +1,140 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/filmil/futility/seriallib/serialtest"
+)
+
+func TestRunTerminal(t *testing.T) {
+	port := serialtest.NewPort()
+	rec := &recorder{}
+	started, restored := false, false
+	err := Run(context.Background(), port, strings.NewReader("a"), Options{
+		Linger: true,
+		Terminal: &Terminal{
+			Input: strings.NewReader("ls\r\x1d\x1d\x1dk\x1dd\x1dr\x1dqignored"),
+			Start: func() (func(), error) {
+				started = true
+				return func() { restored = true }, nil
+			},
+		},
+		OnEvent: rec.record,
+	})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got, want := string(port.Written()), "als\r\x1d"; got != want {
+		t.Errorf("written %q, want %q", got, want)
+	}
+	if got := port.Breaks(); len(got) != 1 {
+		t.Errorf("breaks = %v, want one", got)
+	}
+	if dtr, rts := port.Lines(); dtr || rts {
+		t.Errorf("lines = %v, %v, want both off", dtr, rts)
+	}
+	var commands []string
+	for _, e := range rec.events {
+		if e.Type == LocalCommand {
+			if e.Err != nil {
+				t.Errorf("command %q failed: %v", e.Line, e.Err)
+			}
+			commands = append(commands, e.Line)
+		}
+	}
+	if got, want := strings.Join(commands, ","), "break,DTR off,RTS off,quit"; got != want {
+		t.Errorf("commands %q, want %q", got, want)
+	}
+	if !started || !restored {
+		t.Errorf("started %v, restored %v, want both", started, restored)
+	}
+}
+
+func TestRunTerminalSendFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "app.py")
+	if err := os.WriteFile(name, []byte("print(1)\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	port := serialtest.NewPort()
+	rec := &recorder{}
+	var msg bytes.Buffer
+	err := Run(context.Background(), port, strings.NewReader(""), Options{
+		Linger: true,
+		Terminal: &Terminal{
+			// The name is typed with a mistake, erased with a backspace.
+			Input:    strings.NewReader("\x1ds" + name + "x\x7f\r\x1dsmissing\r\x1d?\x1dq"),
+			Messages: &msg,
+		},
+		OnEvent: rec.record,
+	})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got, want := string(port.Written()), "print(1)\n"; got != want {
+		t.Errorf("written %q, want %q", got, want)
+	}
+	sent, failed := false, false
+	for _, e := range rec.events {
+		switch {
+		case e.Type == Sent && e.File == "app.py":
+			sent = true
+		case e.Type == LocalCommand && e.Line == "send missing":
+			failed = e.Err != nil
+		}
+	}
+	if !sent || !failed {
+		t.Errorf("sent %v, missing file failed %v, want both", sent, failed)
+	}
+	if !strings.Contains(msg.String(), "file to send: ") || !strings.Contains(msg.String(), "send a break") {
+		t.Errorf("messages %q lack the file name prompt or the help", msg.String())
+	}
+}
+
+func TestRunTerminalNeedsLinger(t *testing.T) {
+	err := Run(context.Background(), serialtest.NewPort(), strings.NewReader(""), Options{
+		Terminal: &Terminal{Input: strings.NewReader("")},
+	})
+	if err == nil {
+		t.Error("Run with a terminal and no lingering succeeded")
+	}
+}
+
+func TestRunTerminalUntil(t *testing.T) {
+	port := serialtest.NewPort()
+	keys, typed := io.Pipe()
+	defer typed.Close()
+	err := Run(context.Background(), port, strings.NewReader(""), Options{
+		Linger:        true,
+		Terminal:      &Terminal{Input: keys},
+		Failure:       regexp.MustCompile("FAIL"),
+		LingerTimeout: 5 * time.Second,
+		OnEvent: func(e Event) {
+			if e.Type == Lingering {
+				port.Feed([]byte("FAIL\n"))
+			}
+		},
+	})
+	if !errors.Is(err, ErrFailure) {
+		t.Fatalf("Run() = %v, want ErrFailure", err)
+	}
+
+	err = Run(context.Background(), serialtest.NewPort(), strings.NewReader(""), Options{
+		Linger:        true,
+		Terminal:      &Terminal{Input: keys},
+		LingerTimeout: 20 * time.Millisecond,
+	})
+	if !errors.Is(err, ErrLingerTimeout) {
+		t.Errorf("Run() = %v, want ErrLingerTimeout", err)
+	}
+}
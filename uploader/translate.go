@@ -0,0 +1,200 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package uploader
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// Charset is the character set that a device expects.
+type Charset int
+
+const (
+	// CharsetUTF8 sends data as it is. It is the default.
+	CharsetUTF8 Charset = iota
+	// CharsetLatin1 sends UTF-8 text as ISO-8859-1. Characters that
+	// ISO-8859-1 does not have are sent as '?'.
+	CharsetLatin1
+	// CharsetASCII sends UTF-8 text as ASCII. Characters other than ASCII
+	// are sent as '?'.
+	CharsetASCII
+)
+
+var charsetNames = map[Charset]string{
+	CharsetUTF8:   "utf-8",
+	CharsetLatin1: "latin1",
+	CharsetASCII:  "ascii",
+}
+
+func (c Charset) String() string {
+	if name, ok := charsetNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Charset(%d)", int(c))
+}
+
+// ParseCharset parses a character set: utf-8, latin1 (or iso-8859-1) or
+// ascii.
+func ParseCharset(s string) (Charset, error) {
+	if s == "iso-8859-1" {
+		return CharsetLatin1, nil
+	}
+	for c, name := range charsetNames {
+		if s == name {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown character set: %q", s)
+}
+
+// encode returns the byte that r is sent as.
+func (c Charset) encode(r rune) byte {
+	limit := rune(0xff)
+	if c == CharsetASCII {
+		limit = 0x7f
+	}
+	if r > limit {
+		return '?'
+	}
+	return byte(r)
+}
+
+// Bytes returns the line ending that e sends: LF for LineEndingAny.
+func (e LineEnding) Bytes() []byte {
+	switch e {
+	case LineEndingCR:
+		return []byte{'\r'}
+	case LineEndingCRLF:
+		return []byte{'\r', '\n'}
+	default:
+		return []byte{'\n'}
+	}
+}
+
+// translator translates the data sent as Options.EOL and Options.Charset say.
+// It works on a stream: data may be split anywhere between calls.
+type translator struct {
+	eol     LineEnding
+	charset Charset
+	afterCR bool
+	// pending holds the start of a UTF-8 sequence that the data so far ends
+	// with.
+	pending []byte
+}
+
+// newTranslator returns a translator for opts, or nil if the data is sent
+// as it is.
+func newTranslator(opts Options) *translator {
+	if opts.EOL == LineEndingAny && opts.Charset == CharsetUTF8 {
+		return nil
+	}
+	return &translator{eol: opts.EOL, charset: opts.Charset}
+}
+
+// translate returns the translation of p. CR, LF and CRLF all become the
+// line ending, and bytes that are not UTF-8 are sent as they are.
+func (t *translator) translate(p []byte) []byte {
+	buf := p
+	if len(t.pending) > 0 {
+		buf = append(t.pending, p...)
+		t.pending = nil
+	}
+	var out []byte
+	for i := 0; i < len(buf); {
+		b := buf[i]
+		if t.eol != LineEndingAny && (b == '\r' || b == '\n') {
+			if !(b == '\n' && t.afterCR) {
+				out = append(out, t.eol.Bytes()...)
+			}
+			t.afterCR = b == '\r'
+			i++
+			continue
+		}
+		t.afterCR = false
+		if t.charset == CharsetUTF8 || b < utf8.RuneSelf {
+			out = append(out, b)
+			i++
+			continue
+		}
+		if !utf8.FullRune(buf[i:]) {
+			t.pending = append([]byte(nil), buf[i:]...)
+			break
+		}
+		r, size := utf8.DecodeRune(buf[i:])
+		if r == utf8.RuneError && size == 1 {
+			out = append(out, b)
+		} else {
+			out = append(out, t.charset.encode(r))
+		}
+		i += size
+	}
+	return out
+}
+
+// flush returns what is held back at the end of the data: the start of a
+// UTF-8 sequence that never ended, which is sent as it is.
+func (t *translator) flush() []byte {
+	p := t.pending
+	t.pending = nil
+	return p
+}
+
+// sourceIndex returns the index in p of the byte whose translation holds
+// byte n of the translation of p, as t, in the state before p, translates
+// it.
+func (t translator) sourceIndex(p []byte, n int) int {
+	t.pending = append([]byte(nil), t.pending...)
+	// start is the start of the character that byte i is part of.
+	start := 0
+	for i := range p {
+		if len(t.pending) == 0 {
+			start = i
+		}
+		out := t.translate(p[i : i+1])
+		if len(out) > n {
+			return start
+		}
+		n -= len(out)
+	}
+	return len(p)
+}
+
+// decoder translates the data received when Options.TranslateReceived is
+// set: from Options.Charset to UTF-8, and if Options.EOL is set, with CR, LF
+// and CRLF all made LF.
+type decoder struct {
+	eol     bool
+	charset Charset
+	afterCR bool
+}
+
+// newDecoder returns a decoder for opts, or nil if the data received is kept
+// as it is.
+func newDecoder(opts Options) *decoder {
+	if !opts.TranslateReceived || (opts.EOL == LineEndingAny && opts.Charset == CharsetUTF8) {
+		return nil
+	}
+	return &decoder{eol: opts.EOL != LineEndingAny, charset: opts.Charset}
+}
+
+// decode appends the translation of b to dst.
+func (d *decoder) decode(dst []byte, b byte) []byte {
+	if d.eol && (b == '\r' || b == '\n') {
+		afterCR := d.afterCR
+		d.afterCR = b == '\r'
+		if b == '\n' && afterCR {
+			return dst
+		}
+		return append(dst, '\n')
+	}
+	d.afterCR = false
+	switch {
+	case b < utf8.RuneSelf || d.charset == CharsetUTF8:
+		return append(dst, b)
+	case d.charset == CharsetLatin1:
+		return utf8.AppendRune(dst, rune(b))
+	default:
+		return utf8.AppendRune(dst, utf8.RuneError)
+	}
+}
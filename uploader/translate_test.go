@@ -0,0 +1,123 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/filmil/futility/seriallib/serialtest"
+)
+
+func TestParseCharset(t *testing.T) {
+	for _, c := range []Charset{CharsetUTF8, CharsetLatin1, CharsetASCII} {
+		if got, err := ParseCharset(c.String()); err != nil || got != c {
+			t.Errorf("ParseCharset(%q) = %v, %v", c.String(), got, err)
+		}
+	}
+	if got, err := ParseCharset("iso-8859-1"); err != nil || got != CharsetLatin1 {
+		t.Errorf("ParseCharset(\"iso-8859-1\") = %v, %v, want latin1", got, err)
+	}
+	if _, err := ParseCharset("ebcdic"); err == nil {
+		t.Error("ParseCharset(\"ebcdic\") succeeded, want an error")
+	}
+}
+
+func TestTranslator(t *testing.T) {
+	tests := []struct {
+		eol     LineEnding
+		charset Charset
+		// chunks are translated one after the other.
+		chunks []string
+		want   string
+	}{
+		{eol: LineEndingCRLF, chunks: []string{"a\nb\r\nc\rd\n"}, want: "a\r\nb\r\nc\r\nd\r\n"},
+		{eol: LineEndingCR, chunks: []string{"a\r", "\nb\n"}, want: "a\rb\r"},
+		{eol: LineEndingLF, chunks: []string{"a\r\n"}, want: "a\n"},
+		{charset: CharsetLatin1, chunks: []string{"caf\xc3", "\xa9 €"}, want: "caf\xe9 ?"},
+		{charset: CharsetASCII, chunks: []string{"café"}, want: "caf?"},
+		{charset: CharsetLatin1, chunks: []string{"\xff\xe9x"}, want: "\xff\xe9x"},
+		{eol: LineEndingCRLF, charset: CharsetLatin1, chunks: []string{"é\n"}, want: "\xe9\r\n"},
+	}
+	for _, tt := range tests {
+		tr := newTranslator(Options{EOL: tt.eol, Charset: tt.charset})
+		var got []byte
+		for _, c := range tt.chunks {
+			got = append(got, tr.translate([]byte(c))...)
+		}
+		got = append(got, tr.flush()...)
+		if string(got) != tt.want {
+			t.Errorf("%v/%v: translate(%q) = %q, want %q", tt.eol, tt.charset, tt.chunks, got, tt.want)
+		}
+	}
+	if tr := newTranslator(Options{}); tr != nil {
+		t.Error("newTranslator with no translation is not nil")
+	}
+}
+
+func TestTranslatorFlush(t *testing.T) {
+	tr := newTranslator(Options{Charset: CharsetLatin1})
+	if got := tr.translate([]byte("a\xe2\x82")); string(got) != "a" {
+		t.Errorf("translate = %q, want \"a\"", got)
+	}
+	if got := tr.flush(); string(got) != "\xe2\x82" {
+		t.Errorf("flush = %q, want the unfinished sequence", got)
+	}
+}
+
+func TestSourceIndex(t *testing.T) {
+	tr := translator{charset: CharsetLatin1, eol: LineEndingCRLF}
+	text := []byte("aé€\nb")
+	// The translation is "a\xe9?\r\nb".
+	for n, want := range []int{0, 1, 3, 6, 6, 7} {
+		if got := tr.sourceIndex(text, n); got != want {
+			t.Errorf("sourceIndex(%d) = %d, want %d", n, got, want)
+		}
+	}
+}
+
+func TestRunTranslate(t *testing.T) {
+	port := serialtest.NewPort()
+	rec := &recorder{}
+	err := Run(context.Background(), port, strings.NewReader("éé\n"), Options{
+		EOL:     LineEndingCRLF,
+		Charset: CharsetLatin1,
+		OnEvent: rec.record,
+	})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got, want := string(port.Written()), "\xe9\xe9\r\n"; got != want {
+		t.Errorf("written %q, want %q", got, want)
+	}
+	var last Event
+	for _, e := range rec.events {
+		if e.Type == ChunkSent {
+			last = e
+		}
+	}
+	if last.Offset != 4 || last.SourceOffset != 5 {
+		t.Errorf("last chunk at offset %d, source offset %d, want 4 and 5", last.Offset, last.SourceOffset)
+	}
+}
+
+func TestRunTranslateReceived(t *testing.T) {
+	port := serialtest.NewPort()
+	port.Feed([]byte("caf\xe9\r\n"))
+	var raw bytes.Buffer
+	err := Run(context.Background(), port, strings.NewReader("x"), Options{
+		Prompt:            "café",
+		EOL:               LineEndingLF,
+		Charset:           CharsetLatin1,
+		TranslateReceived: true,
+		RawOutput:         &raw,
+	})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got, want := raw.String(), "café\n"; got != want {
+		t.Errorf("raw output %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,1068 @@
+// SPDX-License-Identifier: Apache-2.0
+
+// Package uploader sends data to a device over a serial port. It can wait for
+// a prompt from the device before sending, honors XON/XOFF flow control,
+// supports several file transfer protocols, and reports what the device sends
+// back.
+package uploader
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/filmil/futility/seriallib"
+	"github.com/filmil/futility/xmodem"
+	"github.com/filmil/futility/zmodem"
+)
+
+// ErrPromptTimeout is returned when the prompt was not seen within
+// Options.PromptTimeout, on any attempt.
+var ErrPromptTimeout = errors.New("prompt not seen")
+
+var (
+	// ErrFailure is returned when a line received while lingering matches
+	// Options.Failure.
+	ErrFailure = errors.New("failure seen")
+	// ErrLingerTimeout is returned when lingering lasted
+	// Options.LingerTimeout without a line matching Options.Success or
+	// Options.Failure.
+	ErrLingerTimeout = errors.New("lingering timed out")
+	// ErrNoOutcome is returned when the port closes while lingering, before
+	// a line matched Options.Success, if it is set.
+	ErrNoOutcome = errors.New("port closed before success was seen")
+)
+
+// Protocol selects how data is sent.
+type Protocol string
+
+const (
+	// Raw sends the data unmodified.
+	Raw Protocol = "raw"
+	// XModem sends the data with XMODEM, using a checksum or a CRC-16 as the
+	// receiver asks.
+	XModem Protocol = "xmodem"
+	// XModemCRC sends the data with XMODEM, using a CRC-16.
+	XModemCRC Protocol = "xmodem-crc"
+	// XModem1K sends the data with XMODEM-1K.
+	XModem1K Protocol = "xmodem-1k"
+	// YModem sends files in a YMODEM batch.
+	YModem Protocol = "ymodem"
+	// ZModem sends files with ZMODEM.
+	ZModem Protocol = "zmodem"
+)
+
+// batch reports whether the protocol can send more than one file.
+func (p Protocol) batch() bool {
+	return p == YModem || p == ZModem
+}
+
+// Options configure an upload.
+type Options struct {
+	// Mode, if set, is applied to the port before anything else is done.
+	// Received XON and XOFF characters pause and resume sending, unless
+	// Mode sets another kind of flow control.
+	Mode *seriallib.Mode
+	// ResetSequence, if set, is run after the mode is set, before waiting
+	// for the prompt. See ParseResetSequence.
+	ResetSequence []ResetStep
+	// Reopen, if set, opens the port again, for the reopen step of a reset
+	// sequence. That step closes the port given to Run: the port that Reopen
+	// returns is used from then on, and is closed before Run returns.
+	Reopen func() (seriallib.Port, error)
+	// Prompt is the line to wait for before sending. If empty, and
+	// PromptRegexp is not set, sending starts immediately.
+	Prompt string
+	// PromptSubstring makes any line containing Prompt match, rather than
+	// only the line equal to it.
+	PromptSubstring bool
+	// PromptRegexp, if set, is the prompt to wait for, instead of Prompt.
+	// It matches lines in which it finds a match.
+	PromptRegexp *regexp.Regexp
+	// PromptTimeout, if set, is how long to wait for the prompt before
+	// giving up, or trying again as PromptRetries says.
+	PromptTimeout time.Duration
+	// PromptRetries is the number of times to wait for the prompt again
+	// after PromptTimeout.
+	PromptRetries int
+	// Wake, if set, is sent when starting to wait for the prompt, and again
+	// on each retry, to wake the device up. It could be "\r\n", or a Ctrl-C.
+	Wake []byte
+	// WakeInterval, if set, sends Wake again that often while the prompt is
+	// awaited, whether or not PromptTimeout is set.
+	WakeInterval time.Duration
+	// PromptPartial also matches the prompt against the start of the line
+	// being received, as it arrives, so that prompts that are not followed
+	// by a line ending, such as "root@board:~# ", are seen at once.
+	PromptPartial bool
+	// Linger keeps reporting received lines after the data has been sent,
+	// until the port is closed.
+	Linger bool
+	// Terminal, if set, makes lingering interactive: what is typed is sent
+	// to the port. It needs Linger.
+	Terminal *Terminal
+	// Success and Failure, if set, end lingering once a line received
+	// matches them: with no error for Success, and with ErrFailure for
+	// Failure, which is checked first. If the port closes before a line
+	// matched Success, lingering ends with ErrNoOutcome. They need Linger.
+	Success *regexp.Regexp
+	Failure *regexp.Regexp
+	// LingerTimeout, if set, ends lingering with ErrLingerTimeout once it
+	// has lasted this long. It needs Linger.
+	LingerTimeout time.Duration
+	// LineBuffer waits for an XON after each line sent, before sending the
+	// next one. It needs XON/XOFF flow control.
+	LineBuffer bool
+	// Ack, if set, is what the device answers each line sent with, such as
+	// "ok", with the raw protocol. A line is sent only once the one before
+	// it has been acknowledged. Ack is matched against the lines received,
+	// and against the line being received, for answers such as "> " that
+	// have no line ending. The echo of the line sent, the first line
+	// received that is the same as it, is not matched.
+	Ack *regexp.Regexp
+	// Nak, if set, is what the device answers a line that it wants sent
+	// again with. It needs Ack.
+	Nak *regexp.Regexp
+	// AckTimeout, if set, is how long to wait for the answer to a line,
+	// before sending it again.
+	AckTimeout time.Duration
+	// AckRetries is the number of times a line is sent again, after Nak or
+	// AckTimeout, before giving up with ErrNotAcknowledged.
+	AckRetries int
+	// EOL, if set, is the line ending that the raw protocol sends lines
+	// with, whether they end with CR, LF or CRLF in the data.
+	EOL LineEnding
+	// Charset is the character set that the raw protocol sends UTF-8 text
+	// in.
+	Charset Charset
+	// TranslateReceived also translates the data received from Charset to
+	// UTF-8, and if EOL is set, makes all its line endings LF.
+	TranslateReceived bool
+	// Pacing, if enabled, slows down the writes of the raw protocol, for
+	// devices with no flow control and little room to buffer.
+	Pacing seriallib.Pacing
+	// Echo checks that the device echoes the data sent, for the raw
+	// protocol, so that characters dropped by a device that cannot keep up
+	// are caught.
+	Echo EchoMode
+	// EchoTimeout is how long to wait for the echo. Defaults to a second.
+	EchoTimeout time.Duration
+	// EchoRetries is the number of times data whose echo differs is erased
+	// and sent again, before giving up with ErrEchoMismatch.
+	EchoRetries int
+	// Separator, if set, is sent between the files that the raw protocol
+	// sends, as it is.
+	Separator []byte
+	// PromptEach waits for the prompt again before each file that the raw
+	// protocol sends, rather than only before the first.
+	PromptEach bool
+	// Protocol selects how data is sent. Defaults to Raw.
+	Protocol Protocol
+	// FileName is the file name that Run gives to YMODEM and ZMODEM
+	// receivers.
+	FileName string
+	// Resume asks a ZMODEM receiver to continue files that it has partially
+	// received.
+	Resume bool
+	// Output, if set, receives a copy of each line received from the port.
+	Output io.Writer
+	// LineEnding selects what ends received lines.
+	LineEnding LineEnding
+	// IdleFlush, if set, reports the partial line received so far once
+	// nothing has been received for this long, so that output without a line
+	// ending is not held back.
+	IdleFlush time.Duration
+	// RawOutput, if set, receives a copy of the bytes received from the
+	// port, as they arrive, except those taken by a file transfer protocol.
+	RawOutput io.Writer
+	// Receive tells what becomes of received XON and XOFF characters.
+	Receive ReceiveMode
+	// OnEvent, if set, is called for each event during the upload. It may be
+	// called from different goroutines, but never concurrently, and it holds
+	// up the upload while it runs.
+	OnEvent func(Event)
+}
+
+// File is a file to upload.
+type File struct {
+	// Name is the file name given to YMODEM and ZMODEM receivers.
+	Name string
+	// Size is the length of the file. If zero, and Data is an io.Seeker, the
+	// size is found by seeking to the end.
+	Size int64
+	// ModTime is the modification time given to YMODEM and ZMODEM
+	// receivers, if not zero.
+	ModTime time.Time
+	// Data is the contents of the file. It must be an io.ReadSeeker for
+	// ZMODEM.
+	Data io.Reader
+}
+
+// Run sends the contents of r over port. For YMODEM and ZMODEM, r is sent as
+// a single file named after Options.FileName.
+//
+// If ctx is done before the upload ends, Run returns the context's error.
+// Run stops reading from port before it returns, so that the caller may go
+// on using it.
+func Run(ctx context.Context, port seriallib.Port, r io.Reader, opts Options) error {
+	return RunFiles(ctx, port, []File{{Name: opts.FileName, Data: r}}, opts)
+}
+
+// RunFiles sends files over port. The raw protocol, YMODEM and ZMODEM can
+// send more than one file; the raw protocol sends them one after the other.
+func RunFiles(ctx context.Context, port seriallib.Port, files []File, opts Options) error {
+	return runSession(ctx, port, opts, func(s *session) error {
+		return s.run(files)
+	})
+}
+
+// runSession runs f with a new session, and reports Done with the error
+// that it returns. It stops reading from the port first, so that the caller
+// can read the port again once it returns.
+func runSession(ctx context.Context, port seriallib.Port, opts Options, f func(*session) error) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	s := &session{ctx: ctx, cancel: cancel, port: port, opts: opts}
+	err := f(s)
+	if err != nil && ctx.Err() != nil {
+		// Whatever failed, it was because the session was canceled.
+		err = context.Cause(ctx)
+	}
+	cancel(nil)
+	if s.closed != nil {
+		<-s.closed
+	}
+	if s.lingerTimer != nil {
+		s.lingerTimer.Stop()
+	}
+	if s.port != port {
+		// The reset sequence opened the port again.
+		s.port.Close()
+	}
+	s.emit(Event{Type: Done, Err: err})
+	return err
+}
+
+// session holds the state of one upload.
+type session struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	port   seriallib.Port
+	opts   Options
+
+	// eventMu serializes calls to opts.OnEvent.
+	eventMu sync.Mutex
+
+	byteCh  chan byte
+	errCh   chan error
+	pauseCh chan bool
+	lineCh  chan line
+	// readErr is the error that reading from the port ended with, other than
+	// io.EOF. It is set before lineCh is closed.
+	readErr error
+
+	// xonxoff is set when received XON and XOFF characters are taken for
+	// flow control.
+	xonxoff bool
+	// sending is set while data is sent.
+	sending atomic.Bool
+
+	// While raw is set, received bytes other than XON and XOFF are diverted
+	// to rawCh, for use by a file transfer protocol.
+	raw    atomic.Bool
+	rawCh  chan byte
+	closed chan struct{}
+	// While echoing is set, received bytes other than XON and XOFF are also
+	// copied to echoCh, unless it is full, to check the echo of the data
+	// sent.
+	echoing atomic.Bool
+	echoCh  chan byte
+	// dec translates the received bytes, if Options.TranslateReceived says
+	// so.
+	dec *decoder
+
+	recvLineCount int
+
+	// holdLines keeps sendRaw from taking the received lines, which a
+	// script expects later.
+	holdLines bool
+	// abortOn are the patterns that end the session when a received line
+	// matches.
+	abortMu sync.Mutex
+	abortOn []*regexp.Regexp
+
+	// lingering is set once lingering has started, and lingerTimer, if set,
+	// fires after Options.LingerTimeout.
+	lingering   bool
+	lingerTimer *time.Timer
+
+	// wakeTick, if set, receives when Options.Wake is to be sent again.
+	wakeTick <-chan time.Time
+}
+
+func (s *session) emit(e Event) {
+	if s.opts.OnEvent == nil {
+		return
+	}
+	s.eventMu.Lock()
+	defer s.eventMu.Unlock()
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	s.opts.OnEvent(e)
+}
+
+func (s *session) run(files []File) error {
+	switch s.opts.Protocol {
+	case "":
+		s.opts.Protocol = Raw
+	case Raw, XModem, XModemCRC, XModem1K, YModem, ZModem:
+	default:
+		return fmt.Errorf("unknown protocol: %q", s.opts.Protocol)
+	}
+	if s.opts.Echo != EchoOff && s.opts.Protocol != Raw {
+		return fmt.Errorf("the echo can only be checked with the raw protocol, not %s", s.opts.Protocol)
+	}
+	if s.opts.Ack != nil && s.opts.Protocol != Raw {
+		return fmt.Errorf("lines can only be acknowledged with the raw protocol, not %s", s.opts.Protocol)
+	}
+	if newTranslator(s.opts) != nil && s.opts.Protocol != Raw {
+		return fmt.Errorf("data can only be translated with the raw protocol, not %s", s.opts.Protocol)
+	}
+	if len(files) > 1 && !s.opts.Protocol.batch() && s.opts.Protocol != Raw {
+		return fmt.Errorf("only the raw, ymodem and zmodem protocols can upload more than one file, got %d", len(files))
+	}
+	if err := s.setup(); err != nil {
+		return err
+	}
+
+	// next is the index of the next file that the raw protocol sends.
+	next := 0
+	send := func() error {
+		if next == 0 {
+			s.emit(Event{Type: Sending})
+		}
+		s.sending.Store(true)
+		defer s.sending.Store(false)
+		var err error
+		switch s.opts.Protocol {
+		case Raw:
+			err = s.sendRawFiles(files, &next)
+			if err == nil && next < len(files) {
+				// The prompt is awaited before the next file.
+				return nil
+			}
+		case XModem, XModemCRC, XModem1K:
+			err = s.sendXModem(files[0])
+		default:
+			err = s.sendBatch(files)
+		}
+		if err != nil {
+			return err
+		}
+		s.emit(Event{Type: Sent})
+		return nil
+	}
+
+	// With no prompt configured, upload immediately without waiting.
+	if !s.hasPrompt() {
+		if err := send(); err != nil {
+			return err
+		}
+		if s.opts.Linger {
+			return s.linger()
+		}
+		return nil
+	}
+
+	// Each wait for the prompt before a file is sent may time out, and is
+	// an attempt of its own; once lingering, the wait does not time out.
+	attempt := 0
+	var timer *time.Timer
+	var timeout <-chan time.Time
+	var wakeTicker *time.Ticker
+	sendWake := func() error {
+		s.emit(Event{Type: WakeSent, Data: s.opts.Wake, Count: attempt})
+		if _, err := seriallib.WriteContext(s.ctx, s.port, s.opts.Wake); err != nil {
+			return fmt.Errorf("failed to send wake-up string: %w", err)
+		}
+		return nil
+	}
+	startAttempt := func() error {
+		attempt++
+		if len(s.opts.Wake) > 0 {
+			if err := sendWake(); err != nil {
+				return err
+			}
+			if s.opts.WakeInterval > 0 {
+				if wakeTicker == nil {
+					wakeTicker = time.NewTicker(s.opts.WakeInterval)
+				} else {
+					wakeTicker.Reset(s.opts.WakeInterval)
+				}
+				s.wakeTick = wakeTicker.C
+			}
+		}
+		if s.opts.PromptTimeout > 0 {
+			if timer == nil {
+				timer = time.NewTimer(s.opts.PromptTimeout)
+			} else {
+				timer.Reset(s.opts.PromptTimeout)
+			}
+			timeout = timer.C
+		}
+		return nil
+	}
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		if wakeTicker != nil {
+			wakeTicker.Stop()
+		}
+		s.wakeTick = nil
+	}()
+	if err := startAttempt(); err != nil {
+		return err
+	}
+
+	prompt := true
+	// matched is the sequence number of the line that the prompt was last
+	// found in, so that a line whose start matched is not matched again
+	// once it is complete.
+	matched := -1
+	for {
+		l, ok, err := s.nextLine(timeout)
+		if err == errWake {
+			if err := sendWake(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err == errTimeout {
+			s.emit(Event{Type: PromptTimedOut, Count: attempt})
+			if attempt > s.opts.PromptRetries {
+				return fmt.Errorf("%w after %d attempts of %v", ErrPromptTimeout, attempt, s.opts.PromptTimeout)
+			}
+			if err := startAttempt(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if l.tail && !s.opts.PromptPartial {
+			continue
+		}
+		if prompt {
+			s.emit(Event{Type: WaitingForPrompt, Line: s.promptString()})
+			prompt = false
+		}
+		s.recvLine(l)
+		if done, err := s.lingerOutcome(l); done {
+			return err
+		}
+		if l.seq != matched && s.matchPrompt(l.text) {
+			matched = l.seq
+			timeout = nil
+			s.wakeTick = nil
+			s.emit(Event{Type: PromptSeen, Line: l.text})
+			if err := send(); err != nil {
+				return err
+			}
+			if next > 0 && next < len(files) {
+				// Wait for the prompt again, as for the first file.
+				prompt = true
+				attempt = 0
+				if err := startAttempt(); err != nil {
+					return err
+				}
+				continue
+			}
+			if !s.opts.Linger {
+				return nil
+			}
+			if s.opts.Terminal != nil {
+				return s.interact()
+			}
+			s.startLinger()
+			prompt = true
+		}
+	}
+
+	if s.lingering || s.readErr != nil {
+		if err := s.lingerClosed(); err != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("prompt not found")
+}
+
+// hasPrompt tells whether a prompt is to be waited for.
+func (s *session) hasPrompt() bool {
+	return s.opts.Prompt != "" || s.opts.PromptRegexp != nil
+}
+
+// promptString describes the prompt that is waited for.
+func (s *session) promptString() string {
+	if s.opts.PromptRegexp != nil {
+		return s.opts.PromptRegexp.String()
+	}
+	return s.opts.Prompt
+}
+
+// matchPrompt tells whether text matches the prompt.
+func (s *session) matchPrompt(text string) bool {
+	switch {
+	case s.opts.PromptRegexp != nil:
+		return s.opts.PromptRegexp.MatchString(text)
+	case s.opts.PromptSubstring:
+		return strings.Contains(text, s.opts.Prompt)
+	default:
+		return text == s.opts.Prompt
+	}
+}
+
+// setup applies the mode to the port, runs the reset sequence, and starts
+// reading from the port.
+func (s *session) setup() error {
+	s.xonxoff = s.opts.Mode == nil || s.opts.Mode.FlowControl == seriallib.FlowXONXOFF
+	if s.opts.Nak != nil && s.opts.Ack == nil {
+		return errors.New("a negative acknowledgement needs an acknowledgement")
+	}
+	if s.opts.Ack != nil && s.opts.Echo != EchoOff {
+		return errors.New("lines cannot be both acknowledged and checked for their echo")
+	}
+	if s.opts.Terminal != nil && !s.opts.Linger {
+		return errors.New("an interactive terminal needs lingering")
+	}
+	if (s.opts.Success != nil || s.opts.Failure != nil || s.opts.LingerTimeout > 0) && !s.opts.Linger {
+		return errors.New("success and failure patterns, and a linger timeout, need lingering")
+	}
+	if s.opts.LineBuffer && !s.xonxoff {
+		return fmt.Errorf("line buffering needs xonxoff flow control, got %v", s.opts.Mode.FlowControl)
+	}
+
+	if s.opts.Mode != nil {
+		if err := s.port.SetMode(s.opts.Mode); err != nil {
+			return fmt.Errorf("failed to set serial port mode: %w", err)
+		}
+	}
+
+	if err := s.reset(); err != nil {
+		return err
+	}
+
+	s.dec = newDecoder(s.opts)
+	s.start()
+	return nil
+}
+
+// start begins reading from the port. Received bytes are split into XON and
+// XOFF, which go to pauseCh if XON/XOFF flow control is used, and the rest,
+// which are split into lines for lineCh, or go to rawCh while a file transfer
+// protocol runs.
+func (s *session) start() {
+	s.byteCh = make(chan byte, 1024*1024)
+	s.errCh = make(chan error, 1)
+	s.pauseCh = make(chan bool, 10)
+	s.rawCh = make(chan byte, 4096)
+	s.echoCh = make(chan byte, 4096)
+	s.closed = make(chan struct{})
+
+	r := seriallib.NewReader(s.ctx, s.port)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := r.Read(buf)
+			if recvErr := s.receive(buf[:n]); recvErr != nil {
+				err = recvErr
+			}
+			if err != nil {
+				s.errCh <- err
+				close(s.byteCh)
+				close(s.rawCh)
+				close(s.echoCh)
+				close(s.closed)
+				return
+			}
+		}
+	}()
+
+	s.lineCh = make(chan line, 1024)
+	go s.splitLines()
+}
+
+// sendContext sends v on ch, unless ctx is done first.
+func sendContext[T any](ctx context.Context, ch chan<- T, v T) error {
+	select {
+	case ch <- v:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// errTimeout is returned by nextLine when its timeout fires.
+var errTimeout = errors.New("timeout")
+
+// errWake is returned by nextLine when Options.Wake is to be sent again.
+var errWake = errors.New("wake")
+
+// nextLine waits for the next line received from the port. It reports false
+// once no more lines will arrive. If timeout fires first, it returns
+// errTimeout, and if Options.Wake is due first, errWake.
+func (s *session) nextLine(timeout <-chan time.Time) (line, bool, error) {
+	select {
+	case l, ok := <-s.lineCh:
+		return l, ok, nil
+	case <-timeout:
+		return line{}, false, errTimeout
+	case <-s.wakeTick:
+		return line{}, false, errWake
+	case <-s.lingerTimeout():
+		return line{}, false, s.lingerTimeoutErr()
+	case <-s.ctx.Done():
+		return line{}, false, s.ctx.Err()
+	}
+}
+
+// recvLine reports, and optionally copies, a line received from the port.
+func (s *session) recvLine(l line) {
+	if l.tail {
+		return
+	}
+	s.recvLineCount++
+	s.emit(Event{Type: LineReceived, Line: l.text, Count: s.recvLineCount, Partial: l.partial, Offset: l.offset})
+	if s.opts.Output != nil {
+		fmt.Fprintln(s.opts.Output, l.text)
+	}
+}
+
+// linger reports any further lines received from the port until it closes,
+// or with Options.Terminal, interacts with the device.
+func (s *session) linger() error {
+	if s.opts.Terminal != nil {
+		return s.interact()
+	}
+	s.startLinger()
+	for {
+		line, ok, err := s.nextLine(nil)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		s.recvLine(line)
+		if done, err := s.lingerOutcome(line); done {
+			return err
+		}
+	}
+	return s.lingerClosed()
+}
+
+// lingerClosed returns the error that lingering ends with once the port has
+// closed.
+func (s *session) lingerClosed() error {
+	switch {
+	case s.readErr != nil:
+		return fmt.Errorf("error reading from serial port: %w", s.readErr)
+	case s.opts.Success != nil:
+		return ErrNoOutcome
+	}
+	return nil
+}
+
+// startLinger reports that lingering has started, and starts the wait for
+// Options.LingerTimeout, unless it has been started already.
+func (s *session) startLinger() {
+	s.emit(Event{Type: Lingering})
+	if !s.lingering && s.opts.LingerTimeout > 0 {
+		s.lingerTimer = time.NewTimer(s.opts.LingerTimeout)
+	}
+	s.lingering = true
+}
+
+// lingerTimeout returns a channel that receives once Options.LingerTimeout
+// has passed since lingering started, or nil if there is no such timeout.
+func (s *session) lingerTimeout() <-chan time.Time {
+	if s.lingerTimer == nil {
+		return nil
+	}
+	return s.lingerTimer.C
+}
+
+// lingerTimeoutErr returns the error that lingering ends with at
+// Options.LingerTimeout.
+func (s *session) lingerTimeoutErr() error {
+	return fmt.Errorf("%w after %v", ErrLingerTimeout, s.opts.LingerTimeout)
+}
+
+// lingerOutcome checks a line received while lingering against
+// Options.Failure and Options.Success, and reports the one that matched. It
+// tells whether lingering is over, and if so, the error that it ends with.
+func (s *session) lingerOutcome(l line) (bool, error) {
+	if !s.lingering || l.tail {
+		return false, nil
+	}
+	switch {
+	case s.opts.Failure != nil && s.opts.Failure.MatchString(l.text):
+		err := fmt.Errorf("%w: received %q, which matches %q", ErrFailure, l.text, s.opts.Failure)
+		s.emit(Event{Type: PatternMatched, Line: l.text, Count: s.recvLineCount, Err: err})
+		return true, err
+	case s.opts.Success != nil && s.opts.Success.MatchString(l.text):
+		s.emit(Event{Type: PatternMatched, Line: l.text, Count: s.recvLineCount})
+		return true, nil
+	}
+	return false, nil
+}
+
+// sendRawFiles sends files with the raw protocol, starting at *next, with
+// Options.Separator between them. With Options.PromptEach and a prompt, it
+// returns after each file, and the prompt is awaited before the next.
+func (s *session) sendRawFiles(files []File, next *int) error {
+	for *next < len(files) {
+		i := *next
+		if i > 0 && len(s.opts.Separator) > 0 {
+			if err := s.newRawSender().writeRaw(s.opts.Separator); err != nil {
+				return err
+			}
+		}
+		if len(files) > 1 {
+			s.emit(Event{Type: Sending, File: files[i].Name, Count: i + 1})
+		}
+		if err := s.sendRaw(files[i].Data); err != nil {
+			if len(files) > 1 {
+				return fmt.Errorf("%s: %w", files[i].Name, err)
+			}
+			return err
+		}
+		*next = i + 1
+		if s.opts.PromptEach && s.hasPrompt() {
+			return nil
+		}
+	}
+	return nil
+}
+
+// newRawSender returns a rawSender for the session's options.
+func (s *session) newRawSender() *rawSender {
+	w := &rawSender{s: s, port: s.port, lineCh: s.lineCh, answered: -1, tr: newTranslator(s.opts)}
+	if s.opts.Pacing.Enabled() {
+		w.port = seriallib.Pace(s.port, s.opts.Pacing)
+	}
+	if s.holdLines && s.opts.Ack == nil {
+		w.lineCh = nil
+	}
+	return w
+}
+
+// sendRaw writes r to the serial port, honoring XON/XOFF flow control, the
+// optional line-buffering mode, pacing, echo verification and
+// acknowledgements.
+func (s *session) sendRaw(r io.Reader) error {
+	w := s.newRawSender()
+	br := bufio.NewReader(r)
+	var err error
+	switch {
+	case s.opts.Echo != EchoOff:
+		err = w.sendEcho(br)
+	case s.opts.Ack != nil:
+		err = w.sendAck(br)
+	default:
+		err = w.send(br)
+	}
+	if err != nil || w.tr == nil {
+		return err
+	}
+	return w.writeRaw(w.tr.flush())
+}
+
+// send writes the data read from br as it comes.
+func (w *rawSender) send(br *bufio.Reader) error {
+	s := w.s
+	buf := make([]byte, 64)
+	for {
+		w.poll()
+		if w.paused {
+			if err := w.waitResume(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var toWrite []byte
+		var readErr error
+
+		if s.opts.LineBuffer {
+			toWrite, readErr = br.ReadBytes('\n')
+		} else {
+			n, err := br.Read(buf)
+			if n > 0 {
+				toWrite = buf[:n]
+			}
+			readErr = err
+		}
+
+		if len(toWrite) > 0 {
+			if err := w.write(toWrite); err != nil {
+				return err
+			}
+			if s.opts.LineBuffer {
+				w.paused = true
+			}
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return fmt.Errorf("failed to read file: %w", readErr)
+		}
+	}
+}
+
+// rawSender holds the state of sendRaw.
+type rawSender struct {
+	s *session
+	// port is what the data is written to, which paces the writes if
+	// needed.
+	port   seriallib.Port
+	paused bool
+	// lineCh is set to nil once it is closed, so that it is never selected
+	// again.
+	lineCh chan line
+	// sent is the number of bytes sent so far.
+	sent int64
+	// answered is the sequence number of the line last taken for an answer
+	// to a line sent, with Options.Ack.
+	answered int
+	// tr translates the data, if Options.EOL or Options.Charset say so.
+	tr *translator
+	// source is the number of bytes of the data read so far, before
+	// translation.
+	source int64
+}
+
+// poll handles the pending flow control changes and received lines.
+func (w *rawSender) poll() {
+	for {
+		select {
+		case p := <-w.s.pauseCh:
+			w.paused = p
+			continue
+		case line, ok := <-w.lineCh:
+			w.recvLine(line, ok)
+			continue
+		default:
+		}
+		return
+	}
+}
+
+// waitResume waits for something to happen while paused.
+func (w *rawSender) waitResume() error {
+	select {
+	case p := <-w.s.pauseCh:
+		w.paused = p
+	case err := <-w.s.errCh:
+		return err
+	case <-w.s.ctx.Done():
+		return w.s.ctx.Err()
+	case line, ok := <-w.lineCh:
+		w.recvLine(line, ok)
+	}
+	return nil
+}
+
+func (w *rawSender) recvLine(l line, ok bool) {
+	if ok {
+		w.s.recvLine(l)
+	} else {
+		w.lineCh = nil
+	}
+}
+
+// write translates p, which is part of the data, and writes it to the port.
+func (w *rawSender) write(p []byte) error {
+	for len(p) > 0 {
+		piece := p[:min(len(p), 64)]
+		if err := w.writeRaw(w.translate(piece)); err != nil {
+			return err
+		}
+		p = p[len(piece):]
+	}
+	return nil
+}
+
+// translate returns the translation of p, which is the next part of the
+// data.
+func (w *rawSender) translate(p []byte) []byte {
+	w.source += int64(len(p))
+	if w.tr == nil {
+		return p
+	}
+	return w.tr.translate(p)
+}
+
+// writeRaw writes p to the port in chunks, waiting while paused.
+func (w *rawSender) writeRaw(p []byte) error {
+	for len(p) > 0 {
+		w.poll()
+		if w.paused {
+			if err := w.waitResume(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		chunk := p[:min(len(p), 64)]
+		if _, err := seriallib.WriteContext(w.s.ctx, w.port, chunk); err != nil {
+			return fmt.Errorf("failed to write to serial port: %w", err)
+		}
+		w.sent += int64(len(chunk))
+		w.s.emit(Event{Type: ChunkSent, Data: chunk, Offset: w.sent, SourceOffset: w.source})
+		p = p[len(chunk):]
+	}
+	return nil
+}
+
+// newRawConn returns a link for a file transfer protocol, which must be used
+// while s.raw is set.
+func (s *session) newRawConn() *rawConn {
+	return &rawConn{ctx: s.ctx, port: s.port, ch: s.rawCh, pauseCh: s.pauseCh, done: s.closed}
+}
+
+// sendXModem sends f using one of the XMODEM protocols.
+func (s *session) sendXModem(f File) error {
+	var proto xmodem.Protocol
+	switch s.opts.Protocol {
+	case XModem:
+		proto = xmodem.XModem
+	case XModemCRC:
+		proto = xmodem.XModemCRC
+	case XModem1K:
+		proto = xmodem.XModem1K
+	}
+	s.raw.Store(true)
+	defer s.raw.Store(false)
+	err := xmodem.Send(s.newRawConn(), f.Data, xmodem.Options{
+		Protocol: proto,
+		Progress: func(p xmodem.Progress) {
+			s.emit(Event{Type: ChunkSent, Block: p.Block, Offset: p.Bytes, Size: f.Size})
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("%s upload failed: %w", s.opts.Protocol, err)
+	}
+	return nil
+}
+
+// sendBatch sends files in a single YMODEM or ZMODEM session.
+func (s *session) sendBatch(files []File) error {
+	var ymodemFiles []xmodem.File
+	var zmodemFiles []zmodem.File
+	// sizes holds the size of each file, by its index.
+	sizes := make([]int64, len(files))
+	names := make(map[string]bool)
+	for i, f := range files {
+		// The receiver would write each file with the same name over the
+		// one before.
+		if names[f.Name] {
+			return fmt.Errorf("%s: the file name is used twice in the batch", f.Name)
+		}
+		names[f.Name] = true
+		size, err := fileSize(f)
+		if err != nil {
+			return err
+		}
+		sizes[i] = size
+		ymodemFiles = append(ymodemFiles, xmodem.File{
+			Name:    f.Name,
+			Size:    size,
+			ModTime: f.ModTime,
+			Data:    f.Data,
+		})
+		if s.opts.Protocol == ZModem {
+			rs, ok := f.Data.(io.ReadSeeker)
+			if ok {
+				// A pipe has a Seek method, which fails.
+				_, err = rs.Seek(0, io.SeekCurrent)
+			}
+			if !ok || err != nil {
+				return fmt.Errorf("%s: zmodem needs a seekable file", f.Name)
+			}
+			zmodemFiles = append(zmodemFiles, zmodem.File{
+				Name:    f.Name,
+				Size:    size,
+				ModTime: f.ModTime,
+				Data:    rs,
+			})
+		}
+	}
+
+	s.raw.Store(true)
+	defer s.raw.Store(false)
+	var err error
+	if s.opts.Protocol == ZModem {
+		err = zmodem.Send(s.newRawConn(), zmodemFiles, zmodem.Options{
+			Resume: s.opts.Resume,
+			Progress: func(p zmodem.Progress) {
+				s.emit(Event{
+					Type:      ChunkSent,
+					File:      p.File,
+					Offset:    p.Offset,
+					Size:      sizes[p.Index],
+					Restarted: p.Restarted,
+				})
+			},
+		})
+	} else {
+		err = xmodem.SendBatch(s.newRawConn(), ymodemFiles, xmodem.Options{
+			Progress: func(p xmodem.Progress) {
+				s.emit(Event{Type: ChunkSent, File: p.File, Block: p.Block, Offset: p.Bytes, Size: sizes[p.Index]})
+			},
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("%s upload failed: %w", s.opts.Protocol, err)
+	}
+	return nil
+}
+
+// fileSize returns the size of f, seeking to find it if need be, or zero if
+// it is unknown, as for a pipe, which cannot seek.
+func fileSize(f File) (int64, error) {
+	if f.Size != 0 {
+		return f.Size, nil
+	}
+	seeker, ok := f.Data.(io.Seeker)
+	if !ok {
+		return 0, nil
+	}
+	cur, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, nil
+	}
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, nil
+	}
+	if _, err := seeker.Seek(cur, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("%s: failed to find size: %w", f.Name, err)
+	}
+	return end - cur, nil
+}
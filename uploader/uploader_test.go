@@ -0,0 +1,732 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filmil/futility/seriallib"
+	"github.com/filmil/futility/seriallib/serialtest"
+)
+
+// fakePort is a serial port whose input is fed by the test, and whose output
+// is collected for the test to inspect.
+type fakePort struct {
+	readCh  chan byte
+	writeCh chan []byte
+}
+
+func newFakePort() *fakePort {
+	return &fakePort{
+		readCh:  make(chan byte, 1024),
+		writeCh: make(chan []byte, 1024),
+	}
+}
+
+func (p *fakePort) Read(b []byte) (int, error) {
+	c, ok := <-p.readCh
+	if !ok {
+		return 0, io.EOF
+	}
+	b[0] = c
+	return 1, nil
+}
+
+func (p *fakePort) Write(b []byte) (int, error) {
+	c := make([]byte, len(b))
+	copy(c, b)
+	p.writeCh <- c
+	return len(b), nil
+}
+
+func (p *fakePort) Close() error {
+	return nil
+}
+
+func (p *fakePort) SetMode(mode *seriallib.Mode) error {
+	return nil
+}
+
+func (p *fakePort) SetDTR(bool) error { return nil }
+
+func (p *fakePort) SetRTS(bool) error { return nil }
+
+func (p *fakePort) GetModemStatus() (seriallib.ModemStatus, error) {
+	return seriallib.ModemStatus{}, nil
+}
+
+// send makes the port receive s.
+func (p *fakePort) send(s string) {
+	for _, b := range []byte(s) {
+		p.readCh <- b
+	}
+}
+
+// recorder collects events. DataReceived events are only collected if data
+// is set.
+type recorder struct {
+	mu     sync.Mutex
+	events []Event
+	data   bool
+}
+
+func (r *recorder) record(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e.Type == DataReceived && !r.data {
+		return
+	}
+	r.events = append(r.events, e)
+}
+
+func (r *recorder) types() []EventType {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var types []EventType
+	for _, e := range r.events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func TestRunEvents(t *testing.T) {
+	port := newFakePort()
+	rec := &recorder{}
+	var out bytes.Buffer
+
+	port.send("booting\nREADY\n")
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- Run(context.Background(), port, strings.NewReader("hello"), Options{
+			Prompt:  "READY",
+			Output:  &out,
+			OnEvent: rec.record,
+		})
+	}()
+
+	select {
+	case b := <-port.writeCh:
+		if string(b) != "hello" {
+			t.Errorf("got %q, want %q", b, "hello")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for upload")
+	}
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return")
+	}
+
+	want := []EventType{
+		WaitingForPrompt,
+		LineReceived,
+		LineReceived,
+		PromptSeen,
+		Sending,
+		ChunkSent,
+		Sent,
+		Done,
+	}
+	got := rec.types()
+	if len(got) != len(want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("events = %v, want %v", got, want)
+		}
+	}
+	if e := rec.events[2]; e.Line != "READY" || e.Count != 2 {
+		t.Errorf("second line event = %+v", e)
+	}
+	if e := rec.events[5]; string(e.Data) != "hello" || e.Offset != 5 {
+		t.Errorf("chunk event = %+v", e)
+	}
+	if out.String() != "booting\nREADY\n" {
+		t.Errorf("output = %q", out.String())
+	}
+}
+
+// pollingPort is a port whose reads notice that they are canceled only
+// between polls, as those of seriallib.Open do.
+type pollingPort struct {
+	*serialtest.Port
+}
+
+func (p pollingPort) ReadContext(ctx context.Context, b []byte) (int, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		poll, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		n, err := p.Port.ReadContext(poll, b)
+		cancel()
+		if err != context.DeadlineExceeded {
+			return n, err
+		}
+	}
+}
+
+func TestRunStopsReading(t *testing.T) {
+	port := pollingPort{serialtest.NewPort()}
+	// Waiting for the prompt leaves a read in progress when Run is done.
+	port.Feed([]byte("ok\n"))
+	if err := Run(context.Background(), port, strings.NewReader("x"), Options{Prompt: "ok"}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	// Nothing is left reading the port to take these bytes.
+	port.Feed([]byte("after"))
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	buf := make([]byte, 16)
+	n, err := port.ReadContext(ctx, buf)
+	if err != nil || string(buf[:n]) != "after" {
+		t.Errorf("ReadContext() after Run = %q, %v, want \"after\"", buf[:n], err)
+	}
+}
+
+func TestRunPausedResumed(t *testing.T) {
+	port := newFakePort()
+	rec := &recorder{}
+	// XOFF before the prompt, so that nothing is sent.
+	port.readCh <- 0x13
+	port.send("GO\n")
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- Run(context.Background(), port, strings.NewReader("data"), Options{Prompt: "GO", OnEvent: rec.record})
+	}()
+
+	select {
+	case <-port.writeCh:
+		t.Fatal("wrote data while paused")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	port.readCh <- 0x11
+	select {
+	case <-port.writeCh:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for upload after XON")
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	var flow []EventType
+	for _, typ := range rec.types() {
+		if typ == Paused || typ == Resumed {
+			flow = append(flow, typ)
+		}
+	}
+	if len(flow) != 2 || flow[0] != Paused || flow[1] != Resumed {
+		t.Errorf("flow control events = %v, want [paused resumed]", flow)
+	}
+}
+
+func TestRunFilesNeedsBatchProtocol(t *testing.T) {
+	rec := &recorder{}
+	files := []File{
+		{Name: "a", Data: strings.NewReader("a")},
+		{Name: "b", Data: strings.NewReader("b")},
+	}
+	err := RunFiles(context.Background(), newFakePort(), files, Options{Protocol: XModem, OnEvent: rec.record})
+	if err == nil {
+		t.Fatal("RunFiles succeeded, want an error")
+	}
+	if got := rec.events; len(got) != 1 || got[0].Type != Done || got[0].Err != err {
+		t.Errorf("events = %+v, want a single Done with the error", got)
+	}
+}
+
+func TestRunFilesDuplicateNames(t *testing.T) {
+	for _, protocol := range []Protocol{YModem, ZModem} {
+		t.Run(string(protocol), func(t *testing.T) {
+			files := []File{
+				{Name: "main.py", Data: strings.NewReader("a")},
+				{Name: "lib.py", Data: strings.NewReader("b")},
+				{Name: "main.py", Data: strings.NewReader("c")},
+			}
+			port := serialtest.NewPort()
+			err := RunFiles(context.Background(), port, files, Options{Protocol: protocol})
+			if err == nil || !strings.Contains(err.Error(), "main.py") {
+				t.Errorf("RunFiles() = %v, want an error for main.py", err)
+			}
+			if got := port.Written(); len(got) != 0 {
+				t.Errorf("written %q, want nothing", got)
+			}
+		})
+	}
+}
+
+func TestRunFilesRaw(t *testing.T) {
+	port := serialtest.NewPort()
+	rec := &recorder{}
+	files := []File{
+		{Name: "a.py", Data: strings.NewReader("one")},
+		{Name: "b.py", Data: strings.NewReader("two")},
+	}
+	err := RunFiles(context.Background(), port, files, Options{Separator: []byte("\x04"), OnEvent: rec.record})
+	if err != nil {
+		t.Fatalf("RunFiles: %v", err)
+	}
+	if got, want := string(port.Written()), "one\x04two"; got != want {
+		t.Errorf("written = %q, want %q", got, want)
+	}
+	var sending []string
+	for _, e := range rec.events {
+		if e.Type == Sending && e.File != "" {
+			sending = append(sending, fmt.Sprintf("%d:%s", e.Count, e.File))
+		}
+	}
+	if got := strings.Join(sending, ","); got != "1:a.py,2:b.py" {
+		t.Errorf("files sent = %s, want 1:a.py,2:b.py", got)
+	}
+}
+
+func TestRunFilesPromptEach(t *testing.T) {
+	// The device gives the prompt once only, so the second file waits.
+	port := serialtest.NewPort()
+	port.Feed([]byte(">>> \n"))
+	files := []File{
+		{Name: "a.py", Data: strings.NewReader("one")},
+		{Name: "b.py", Data: strings.NewReader("two")},
+	}
+	err := RunFiles(context.Background(), port, files, Options{
+		Prompt:        ">>> ",
+		PromptEach:    true,
+		PromptTimeout: 50 * time.Millisecond,
+	})
+	if !errors.Is(err, ErrPromptTimeout) {
+		t.Errorf("RunFiles = %v, want ErrPromptTimeout", err)
+	}
+	if got := string(port.Written()); got != "one" {
+		t.Errorf("written = %q, want \"one\"", got)
+	}
+}
+
+func TestRunUnknownProtocol(t *testing.T) {
+	err := Run(context.Background(), newFakePort(), strings.NewReader(""), Options{Protocol: "kermit"})
+	if err == nil {
+		t.Fatal("Run succeeded, want an error")
+	}
+}
+
+func TestRawConnPause(t *testing.T) {
+	port := newFakePort()
+	pauseCh := make(chan bool, 10)
+	c := &rawConn{ctx: context.Background(), port: port, pauseCh: pauseCh, done: make(chan struct{})}
+
+	pauseCh <- true
+	go c.Write([]byte("data"))
+
+	select {
+	case <-port.writeCh:
+		t.Fatal("wrote data while paused")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	pauseCh <- false
+	select {
+	case b := <-port.writeCh:
+		if string(b) != "data" {
+			t.Errorf("got %q, want %q", b, "data")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for write after XON")
+	}
+}
+
+func TestFileSize(t *testing.T) {
+	r := strings.NewReader("0123456789")
+	r.Seek(4, io.SeekStart)
+	size, err := fileSize(File{Data: r})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 6 {
+		t.Errorf("size = %d, want 6", size)
+	}
+	if pos, _ := r.Seek(0, io.SeekCurrent); pos != 4 {
+		t.Errorf("position = %d after finding the size, want 4", pos)
+	}
+}
+
+// receiverPort is a port that acknowledges each write as an XMODEM or
+// YMODEM receiver would, asking for the next block with a 'C'.
+type receiverPort struct {
+	*serialtest.Port
+}
+
+func (p receiverPort) WriteContext(ctx context.Context, b []byte) (int, error) {
+	n, err := p.Port.WriteContext(ctx, b)
+	p.Feed([]byte{0x06, 'C'})
+	return n, err
+}
+
+func (p receiverPort) Write(b []byte) (int, error) {
+	return p.WriteContext(context.Background(), b)
+}
+
+func TestRunFilesPipe(t *testing.T) {
+	data := strings.Repeat("x", 300)
+	for _, proto := range []Protocol{XModemCRC, YModem, ZModem} {
+		t.Run(string(proto), func(t *testing.T) {
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			go func() {
+				w.WriteString(data)
+				w.Close()
+			}()
+			port := receiverPort{serialtest.NewPort()}
+			port.Feed([]byte("C"))
+			err = RunFiles(context.Background(), port, []File{{Name: "fw.bin", Data: r}}, Options{Protocol: proto})
+			if proto == ZModem {
+				if err == nil || !strings.Contains(err.Error(), "seekable") {
+					t.Errorf("RunFiles() = %v, want an error for the pipe", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RunFiles() = %v", err)
+			}
+			if got := port.Written(); !bytes.Contains(got, []byte(data[:100])) {
+				t.Errorf("written %d bytes without the data", len(got))
+			}
+		})
+	}
+}
+
+func TestRunCanceled(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol Protocol
+		prompt   string
+	}{
+		{name: "waiting for prompt", prompt: "READY"},
+		{name: "xmodem handshake", protocol: XModemCRC},
+		{name: "zmodem handshake", protocol: ZModem},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			rec := &recorder{}
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- Run(ctx, newFakePort(), strings.NewReader("data"), Options{
+					Prompt:   tt.prompt,
+					Protocol: tt.protocol,
+					OnEvent:  rec.record,
+				})
+			}()
+
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+			select {
+			case err := <-errCh:
+				if err != context.Canceled {
+					t.Errorf("Run() = %v, want context.Canceled", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Run did not return after cancel")
+			}
+			events := rec.events
+			if last := events[len(events)-1]; last.Type != Done || last.Err != context.Canceled {
+				t.Errorf("last event = %+v, want Done with context.Canceled", last)
+			}
+		})
+	}
+}
+
+func TestRunDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	port := newFakePort()
+	// XOFF, so that the upload stays paused.
+	port.readCh <- 0x13
+	port.send("GO\n")
+	err := Run(ctx, port, strings.NewReader("data"), Options{Prompt: "GO"})
+	if err != context.DeadlineExceeded {
+		t.Errorf("Run() = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestRunHardwareFlowControl(t *testing.T) {
+	port := serialtest.NewPort()
+	// XON and XOFF are ordinary data with hardware flow control.
+	port.Feed([]byte("\x13READY\x11\n"))
+	rec := &recorder{}
+	err := Run(context.Background(), port, strings.NewReader("data"), Options{
+		Mode:    &seriallib.Mode{BaudRate: 115200, DataBits: 8, StopBits: 1, Parity: seriallib.ParityNone, FlowControl: seriallib.FlowRTSCTS},
+		Prompt:  "\x13READY\x11",
+		OnEvent: rec.record,
+	})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got := string(port.Written()); got != "data" {
+		t.Errorf("written = %q, want \"data\"", got)
+	}
+	for _, typ := range rec.types() {
+		if typ == Paused || typ == Resumed {
+			t.Errorf("got a %v event with hardware flow control", typ)
+		}
+	}
+	if m := port.Mode(); m.FlowControl != seriallib.FlowRTSCTS {
+		t.Errorf("flow control = %v, want rtscts", m.FlowControl)
+	}
+}
+
+func TestRunPacing(t *testing.T) {
+	port := serialtest.NewPort()
+	start := time.Now()
+	err := Run(context.Background(), port, strings.NewReader("a\nb\nc"), Options{
+		Pacing: seriallib.Pacing{LineDelay: 20 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got := string(port.Written()); got != "a\nb\nc" {
+		t.Errorf("written = %q, want %q", got, "a\nb\nc")
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Errorf("upload took %v, want at least two line delays", d)
+	}
+}
+
+func TestRunLineBufferNeedsXONXOFF(t *testing.T) {
+	err := Run(context.Background(), serialtest.NewPort(), strings.NewReader("data"), Options{
+		Mode:       &seriallib.Mode{FlowControl: seriallib.FlowNone},
+		LineBuffer: true,
+	})
+	if err == nil {
+		t.Error("Run succeeded, want an error")
+	}
+}
+
+func TestRunPromptMatching(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		opts  Options
+	}{
+		{
+			name:  "substring",
+			input: "boot done, READY for upload\n",
+			opts:  Options{Prompt: "READY", PromptSubstring: true},
+		},
+		{
+			name:  "regexp",
+			input: "U-Boot 2024.01 ready\n",
+			opts:  Options{PromptRegexp: regexp.MustCompile(`^U-Boot \S+ ready$`)},
+		},
+		{
+			name:  "partial line",
+			input: "Hit any key\n=> ",
+			opts:  Options{Prompt: "=> ", PromptPartial: true},
+		},
+		{
+			name:  "partial regexp",
+			input: "root@board:~# ",
+			opts:  Options{PromptRegexp: regexp.MustCompile(`[#$] $`), PromptPartial: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := serialtest.NewPort()
+			port.Feed([]byte(tt.input))
+			opts := tt.opts
+			opts.Linger = true
+			opts.OnEvent = func(e Event) {
+				if e.Type == Sent {
+					// The device echoes what was sent, which completes the
+					// line with the prompt.
+					port.Feed([]byte("data\n"))
+					port.CloseInput()
+				}
+			}
+			err := Run(context.Background(), port, strings.NewReader("data"), opts)
+			if err == nil || err.Error() != "prompt not found" {
+				t.Fatalf("Run: %v", err)
+			}
+			if got := string(port.Written()); got != "data" {
+				t.Errorf("written = %q, want the data sent once", got)
+			}
+		})
+	}
+}
+
+func TestRunPartialPromptNotMatched(t *testing.T) {
+	port := serialtest.NewPort()
+	// Without PromptPartial, the prompt has to end its line.
+	port.Feed([]byte("=> "))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := Run(ctx, port, strings.NewReader("data"), Options{Prompt: "=> "})
+	if err != context.DeadlineExceeded {
+		t.Errorf("Run() = %v, want context.DeadlineExceeded", err)
+	}
+	if got := port.Written(); len(got) != 0 {
+		t.Errorf("written = %q, want nothing", got)
+	}
+}
+
+func TestRunPromptTimeout(t *testing.T) {
+	port := serialtest.NewPort()
+	rec := &recorder{}
+	start := time.Now()
+	err := Run(context.Background(), port, strings.NewReader("data"), Options{
+		Prompt:        "READY",
+		PromptTimeout: 20 * time.Millisecond,
+		PromptRetries: 2,
+		Wake:          []byte("\r\n"),
+		OnEvent:       rec.record,
+	})
+	if !errors.Is(err, ErrPromptTimeout) {
+		t.Fatalf("Run() = %v, want ErrPromptTimeout", err)
+	}
+	if d := time.Since(start); d < 60*time.Millisecond {
+		t.Errorf("Run returned after %v, want three attempts of 20ms", d)
+	}
+	if got := string(port.Written()); got != "\r\n\r\n\r\n" {
+		t.Errorf("written = %q, want a wake-up string per attempt", got)
+	}
+	var timeouts []int
+	for _, e := range rec.events {
+		if e.Type == PromptTimedOut {
+			timeouts = append(timeouts, e.Count)
+		}
+	}
+	if fmt.Sprint(timeouts) != "[1 2 3]" {
+		t.Errorf("timed out attempts = %v, want [1 2 3]", timeouts)
+	}
+}
+
+func TestRunWakeUp(t *testing.T) {
+	port := serialtest.NewPort()
+	err := Run(context.Background(), port, strings.NewReader("data"), Options{
+		Prompt:        "READY",
+		PromptTimeout: 20 * time.Millisecond,
+		PromptRetries: 5,
+		Wake:          []byte("\x03"),
+		OnEvent: func(e Event) {
+			// The device answers the second wake-up.
+			if e.Type == WakeSent && e.Count == 2 {
+				port.Feed([]byte("READY\n"))
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got := string(port.Written()); got != "\x03\x03data" {
+		t.Errorf("written = %q, want two wake-ups and the data", got)
+	}
+}
+
+func TestRunWakeInterval(t *testing.T) {
+	port := serialtest.NewPort()
+	var wakes []int
+	err := Run(context.Background(), port, strings.NewReader("data"), Options{
+		Prompt: "READY",
+		// With no PromptTimeout, the wait has a single attempt.
+		Wake:         []byte("\r"),
+		WakeInterval: 5 * time.Millisecond,
+		OnEvent: func(e Event) {
+			if e.Type == WakeSent {
+				wakes = append(wakes, e.Count)
+				// The device answers the third wake-up.
+				if len(wakes) == 3 {
+					port.Feed([]byte("READY\n"))
+				}
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got := string(port.Written()); !strings.HasPrefix(got, "\r\r\r") || !strings.HasSuffix(got, "data") {
+		t.Errorf("written = %q, want three wake-ups or more, then the data", got)
+	}
+	if fmt.Sprint(wakes[:3]) != "[1 1 1]" {
+		t.Errorf("wake-up attempts = %v, want all in the first attempt", wakes)
+	}
+}
+
+func TestRunUntil(t *testing.T) {
+	tests := []struct {
+		name    string
+		prompt  string
+		linger  string
+		closed  bool
+		wantErr error
+		want    string
+	}{
+		{name: "success", linger: "running\nPASS 3/3\n", want: "PASS 3/3"},
+		{name: "failure", linger: "FAIL: test_uart\nPASS\n", wantErr: ErrFailure, want: "FAIL: test_uart"},
+		{name: "timeout", linger: "running\n", wantErr: ErrLingerTimeout},
+		{name: "after prompt", prompt: "READY", linger: "PASS\n", want: "PASS"},
+		{name: "closed", linger: "running\n", closed: true, wantErr: ErrNoOutcome},
+		{name: "closed after prompt", prompt: "READY", linger: "running\n", closed: true, wantErr: ErrNoOutcome},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := serialtest.NewPort()
+			if tt.prompt != "" {
+				port.Feed([]byte(tt.prompt + "\n"))
+			}
+			var matched []string
+			err := Run(context.Background(), port, strings.NewReader("run()\n"), Options{
+				Prompt:        tt.prompt,
+				Linger:        true,
+				Success:       regexp.MustCompile(`^PASS`),
+				Failure:       regexp.MustCompile(`^FAIL`),
+				LingerTimeout: 50 * time.Millisecond,
+				OnEvent: func(e Event) {
+					switch e.Type {
+					case Lingering:
+						port.Feed([]byte(tt.linger))
+						if tt.closed {
+							port.CloseInput()
+						}
+					case PatternMatched:
+						matched = append(matched, e.Line)
+					}
+				},
+			})
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("Run() = %v, want %v", err, tt.wantErr)
+			}
+			if got := strings.Join(matched, ","); got != tt.want {
+				t.Errorf("matched %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunUntilNeedsLinger(t *testing.T) {
+	err := Run(context.Background(), serialtest.NewPort(), strings.NewReader("data"), Options{
+		Success: regexp.MustCompile("PASS"),
+	})
+	if err == nil {
+		t.Error("Run() with Success and without Linger succeeded")
+	}
+}
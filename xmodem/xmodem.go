@@ -0,0 +1,386 @@
+// SPDX-License-Identifier: Apache-2.0
+
+// Package xmodem implements the sending side of the XMODEM family of file
+// transfer protocols, including YMODEM batch transfers.
+package xmodem
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	soh = 0x01
+	stx = 0x02
+	eot = 0x04
+	ack = 0x06
+	nak = 0x15
+	can = 0x18
+	sub = 0x1a
+
+	// crcRequest is sent by a receiver that wants CRC-16 blocks.
+	crcRequest = 'C'
+)
+
+var (
+	// ErrTimeout is returned by Conn.ReadByteTimeout when no byte arrived in time.
+	ErrTimeout = errors.New("timeout")
+	// ErrCanceled is returned when the receiver cancels the transfer.
+	ErrCanceled = errors.New("transfer canceled by receiver")
+)
+
+// Conn is the link a transfer runs over.
+type Conn interface {
+	io.Writer
+	// ReadByteTimeout reads a single byte, waiting at most timeout for it to
+	// arrive. It must return ErrTimeout if nothing arrived in time.
+	ReadByteTimeout(timeout time.Duration) (byte, error)
+}
+
+// Protocol selects the XMODEM variant.
+type Protocol int
+
+const (
+	// XModem sends 128-byte blocks with an 8-bit checksum, or with a CRC-16
+	// if the receiver asks for one.
+	XModem Protocol = iota
+	// XModemCRC sends 128-byte blocks with a CRC-16.
+	XModemCRC
+	// XModem1K sends 1024-byte blocks with a CRC-16.
+	XModem1K
+)
+
+// Progress describes a block that the receiver has acknowledged.
+type Progress struct {
+	// File is the name of the file being sent in a batch transfer, and empty
+	// otherwise.
+	File string
+	// Index is the index of the file in the batch, starting at 0.
+	Index int
+	// Block is the sequence number of the block, starting at 1. It does not
+	// wrap around at 256.
+	Block int
+	// Bytes is the number of file bytes acknowledged so far.
+	Bytes int64
+}
+
+// Options configure a transfer.
+type Options struct {
+	// Protocol is the XMODEM variant used by Send. SendBatch ignores it.
+	Protocol Protocol
+	// HandshakeTimeout bounds the wait for the receiver to start the
+	// transfer. Defaults to one minute.
+	HandshakeTimeout time.Duration
+	// Timeout bounds the wait for each reply from the receiver. Defaults to
+	// ten seconds.
+	Timeout time.Duration
+	// MaxRetries is the number of times a block is resent before giving up.
+	// Defaults to ten.
+	MaxRetries int
+	// Progress, if set, is called after each acknowledged block.
+	Progress func(Progress)
+}
+
+func (o *Options) setDefaults() {
+	if o.HandshakeTimeout == 0 {
+		o.HandshakeTimeout = time.Minute
+	}
+	if o.Timeout == 0 {
+		o.Timeout = 10 * time.Second
+	}
+	if o.MaxRetries == 0 {
+		o.MaxRetries = 10
+	}
+}
+
+// Send transfers the contents of r over conn. The receiver must be ready to
+// start the transfer, that is, it is expected to be sending NAK or 'C'.
+func Send(conn Conn, r io.Reader, opts Options) error {
+	opts.setDefaults()
+	s := &sender{conn: conn, opts: opts}
+
+	useCRC, err := s.handshake()
+	if err != nil {
+		return err
+	}
+	s.useCRC = useCRC
+
+	blockSize := 128
+	if opts.Protocol == XModem1K {
+		blockSize = 1024
+	}
+	if err := s.sendData("", r, blockSize); err != nil {
+		return err
+	}
+	return s.finish()
+}
+
+// File is a file sent in a YMODEM batch.
+type File struct {
+	// Name is the file name given to the receiver.
+	Name string
+	// Size is the length of the file in bytes. The receiver uses it to strip
+	// the padding from the last block.
+	Size int64
+	// ModTime is the modification time given to the receiver, if not zero.
+	ModTime time.Time
+	// Data is the contents of the file.
+	Data io.Reader
+}
+
+// SendBatch transfers files over conn using YMODEM: each file is preceded by
+// a header block with its name and size, and the batch ends with an empty
+// header. Data is sent in 1024-byte blocks with a CRC-16. The receiver must be
+// ready to start the transfer, that is, it is expected to be sending 'C'.
+func SendBatch(conn Conn, files []File, opts Options) error {
+	opts.setDefaults()
+	opts.Protocol = XModem1K
+	s := &sender{conn: conn, opts: opts, useCRC: true}
+
+	for i, f := range files {
+		s.index = i
+		if _, err := s.handshake(); err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+		if err := s.sendBlock(0, header(f), 0); err != nil {
+			return fmt.Errorf("%s: header: %w", f.Name, err)
+		}
+		// The receiver asks for the data with a fresh 'C'.
+		if _, err := s.handshake(); err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+		if err := s.sendData(f.Name, f.Data, 1024); err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+		if err := s.finish(); err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+	}
+
+	if _, err := s.handshake(); err != nil {
+		return fmt.Errorf("end of batch: %w", err)
+	}
+	if err := s.sendBlock(0, nil, 0); err != nil {
+		return fmt.Errorf("end of batch: %w", err)
+	}
+	return nil
+}
+
+// header returns the contents of the YMODEM header block for f: the file
+// name, a NUL, then the size in decimal and the modification time in octal.
+func header(f File) []byte {
+	h := append([]byte(f.Name), 0)
+	h = fmt.Appendf(h, "%d", f.Size)
+	if !f.ModTime.IsZero() {
+		h = fmt.Appendf(h, " %o", f.ModTime.Unix())
+	}
+	return h
+}
+
+// sendData sends the contents of r as numbered blocks of blockSize, starting
+// at block 1, reporting progress as the blocks are acknowledged.
+func (s *sender) sendData(name string, r io.Reader, blockSize int) error {
+	buf := make([]byte, blockSize)
+	var sent int64
+	for block := 1; ; block++ {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			s.cancel()
+			return fmt.Errorf("failed to read file: %w", err)
+		}
+		if err := s.sendBlock(byte(block), buf[:n], sub); err != nil {
+			return fmt.Errorf("block %d: %w", block, err)
+		}
+		sent += int64(n)
+		if s.opts.Progress != nil {
+			s.opts.Progress(Progress{File: name, Index: s.index, Block: block, Bytes: sent})
+		}
+		if n < blockSize {
+			return nil
+		}
+	}
+}
+
+type sender struct {
+	conn   Conn
+	opts   Options
+	useCRC bool
+	// index is the index of the file being sent in a batch.
+	index int
+	// pushback holds a byte that was read but not consumed.
+	pushback []byte
+}
+
+// handshake waits for the receiver to request the first block, and reports
+// whether it asked for CRC-16 blocks.
+func (s *sender) handshake() (bool, error) {
+	deadline := time.Now().Add(s.opts.HandshakeTimeout)
+	for {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return false, fmt.Errorf("receiver did not start the transfer: %w", ErrTimeout)
+		}
+		b, err := s.readByte(left)
+		if err == ErrTimeout {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		switch b {
+		case crcRequest:
+			return true, nil
+		case nak:
+			// A receiver that does not get a CRC block after asking for one
+			// falls back to checksums; only the plain protocol follows it.
+			if s.opts.Protocol == XModem {
+				return false, nil
+			}
+		case can:
+			if s.canceled() {
+				return false, ErrCanceled
+			}
+		}
+		// Anything else is line noise, or the tail of the command that
+		// started the receiver.
+	}
+}
+
+// sendBlock sends one block, padding it with pad as needed, and retries until
+// the receiver acknowledges it.
+func (s *sender) sendBlock(num byte, data []byte, pad byte) error {
+	size := 128
+	header := byte(soh)
+	if len(data) > 128 {
+		size = 1024
+		header = stx
+	}
+	pkt := make([]byte, 0, 3+size+2)
+	pkt = append(pkt, header, num, ^num)
+	pkt = append(pkt, data...)
+	for len(pkt) < 3+size {
+		pkt = append(pkt, pad)
+	}
+	payload := pkt[3:]
+	if s.useCRC {
+		c := CRC16(payload)
+		pkt = append(pkt, byte(c>>8), byte(c))
+	} else {
+		pkt = append(pkt, checksum(payload))
+	}
+	return s.sendWithRetry(pkt)
+}
+
+// finish ends the transfer with EOT.
+func (s *sender) finish() error {
+	if err := s.sendWithRetry([]byte{eot}); err != nil {
+		return fmt.Errorf("end of transfer: %w", err)
+	}
+	return nil
+}
+
+// sendWithRetry writes pkt and waits for the receiver's reply, resending on
+// NAK or timeout.
+func (s *sender) sendWithRetry(pkt []byte) error {
+	for try := 0; try <= s.opts.MaxRetries; try++ {
+		if _, err := s.conn.Write(pkt); err != nil {
+			return fmt.Errorf("failed to write: %w", err)
+		}
+		reply, err := s.awaitReply()
+		if err == ErrTimeout {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if reply == ack {
+			return nil
+		}
+	}
+	s.cancel()
+	return fmt.Errorf("no acknowledgement after %d retries", s.opts.MaxRetries)
+}
+
+// awaitReply returns ack or nak, skipping over any other bytes.
+func (s *sender) awaitReply() (byte, error) {
+	deadline := time.Now().Add(s.opts.Timeout)
+	for {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return 0, ErrTimeout
+		}
+		b, err := s.readByte(left)
+		if err != nil {
+			return 0, err
+		}
+		switch b {
+		case ack, nak:
+			return b, nil
+		case can:
+			if s.canceled() {
+				return 0, ErrCanceled
+			}
+		}
+	}
+}
+
+// canceled reports whether the CAN just received is followed by another,
+// which is how a receiver aborts a transfer. A byte other than CAN is kept
+// for the next read, so that a lone CAN, such as line noise, does not cost
+// the reply that follows it.
+func (s *sender) canceled() bool {
+	b, err := s.readByte(time.Second)
+	if err != nil {
+		return false
+	}
+	if b != can {
+		s.pushback = append(s.pushback, b)
+		return false
+	}
+	return true
+}
+
+// readByte reads a byte, taking the one kept by canceled first.
+func (s *sender) readByte(timeout time.Duration) (byte, error) {
+	if len(s.pushback) > 0 {
+		b := s.pushback[0]
+		s.pushback = s.pushback[1:]
+		return b, nil
+	}
+	return s.conn.ReadByteTimeout(timeout)
+}
+
+// cancel tells the receiver that the sender is giving up.
+func (s *sender) cancel() {
+	s.conn.Write([]byte{can, can})
+}
+
+func checksum(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum += b
+	}
+	return sum
+}
+
+// CRC16 computes the CRC-16/XMODEM of data, as used by XMODEM-CRC, YMODEM
+// and ZMODEM.
+func CRC16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,375 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package xmodem
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeReceiver is an in-memory XMODEM receiver. Each Write is treated as one
+// packet from the sender, and the receiver's reply is queued for
+// ReadByteTimeout.
+type fakeReceiver struct {
+	t       *testing.T
+	crc     bool
+	replies []byte
+	got     bytes.Buffer
+	blocks  []int
+	// nakFirst makes the receiver reject the first copy of each block.
+	nakFirst bool
+	naked    map[byte]bool
+	done     bool
+}
+
+func newFakeReceiver(t *testing.T, crc bool) *fakeReceiver {
+	r := &fakeReceiver{t: t, crc: crc, naked: map[byte]bool{}}
+	if crc {
+		r.replies = []byte{crcRequest}
+	} else {
+		r.replies = []byte{nak}
+	}
+	return r
+}
+
+func (r *fakeReceiver) ReadByteTimeout(timeout time.Duration) (byte, error) {
+	if len(r.replies) == 0 {
+		return 0, ErrTimeout
+	}
+	b := r.replies[0]
+	r.replies = r.replies[1:]
+	return b, nil
+}
+
+func (r *fakeReceiver) Write(p []byte) (int, error) {
+	if len(p) == 1 && p[0] == eot {
+		r.done = true
+		r.replies = append(r.replies, ack)
+		return 1, nil
+	}
+	size := 128
+	switch p[0] {
+	case soh:
+	case stx:
+		size = 1024
+	default:
+		r.t.Fatalf("unexpected packet header %#x", p[0])
+	}
+	trailer := 1
+	if r.crc {
+		trailer = 2
+	}
+	if len(p) != 3+size+trailer {
+		r.t.Fatalf("packet length = %d, want %d", len(p), 3+size+trailer)
+	}
+	if p[1] != ^p[2] {
+		r.t.Fatalf("block number %d does not match its complement %d", p[1], p[2])
+	}
+	data := p[3 : 3+size]
+	if r.crc {
+		c := CRC16(data)
+		if p[3+size] != byte(c>>8) || p[4+size] != byte(c) {
+			r.t.Fatalf("bad CRC in block %d", p[1])
+		}
+	} else if p[3+size] != checksum(data) {
+		r.t.Fatalf("bad checksum in block %d", p[1])
+	}
+	if r.nakFirst && !r.naked[p[1]] {
+		r.naked[p[1]] = true
+		r.replies = append(r.replies, nak)
+		return len(p), nil
+	}
+	r.blocks = append(r.blocks, size)
+	r.got.Write(data)
+	r.replies = append(r.replies, ack)
+	return len(p), nil
+}
+
+func TestSend(t *testing.T) {
+	content := strings.Repeat("0123456789abcdef", 80) + "tail"
+	tests := []struct {
+		name       string
+		protocol   Protocol
+		crc        bool
+		nakFirst   bool
+		wantBlocks []int
+	}{
+		{
+			name:       "checksum",
+			protocol:   XModem,
+			wantBlocks: []int{128, 128, 128, 128, 128, 128, 128, 128, 128, 128, 128},
+		},
+		{
+			name:       "receiver asks for CRC",
+			protocol:   XModem,
+			crc:        true,
+			wantBlocks: []int{128, 128, 128, 128, 128, 128, 128, 128, 128, 128, 128},
+		},
+		{
+			name:       "CRC",
+			protocol:   XModemCRC,
+			crc:        true,
+			wantBlocks: []int{128, 128, 128, 128, 128, 128, 128, 128, 128, 128, 128},
+		},
+		{
+			name:       "1K",
+			protocol:   XModem1K,
+			crc:        true,
+			wantBlocks: []int{1024, 1024},
+		},
+		{
+			name:       "retransmit on NAK",
+			protocol:   XModem1K,
+			crc:        true,
+			nakFirst:   true,
+			wantBlocks: []int{1024, 1024},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newFakeReceiver(t, tt.crc)
+			r.nakFirst = tt.nakFirst
+			var progress []Progress
+			err := Send(r, strings.NewReader(content), Options{
+				Protocol: tt.protocol,
+				Progress: func(p Progress) { progress = append(progress, p) },
+			})
+			if err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			if !r.done {
+				t.Errorf("transfer was not ended with EOT")
+			}
+			got := strings.TrimRight(r.got.String(), "\x1a")
+			if got != content {
+				t.Errorf("received %q, want %q", got, content)
+			}
+			if len(r.blocks) != len(tt.wantBlocks) {
+				t.Fatalf("block sizes = %v, want %v", r.blocks, tt.wantBlocks)
+			}
+			for i := range r.blocks {
+				if r.blocks[i] != tt.wantBlocks[i] {
+					t.Errorf("block sizes = %v, want %v", r.blocks, tt.wantBlocks)
+				}
+			}
+			last := progress[len(progress)-1]
+			if last.Block != len(tt.wantBlocks) || last.Bytes != int64(len(content)) {
+				t.Errorf("last progress = %+v", last)
+			}
+		})
+	}
+}
+
+func TestSendShortLastBlock1K(t *testing.T) {
+	r := newFakeReceiver(t, true)
+	content := strings.Repeat("x", 1024+100)
+	if err := Send(r, strings.NewReader(content), Options{Protocol: XModem1K}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if len(r.blocks) != 2 || r.blocks[0] != 1024 || r.blocks[1] != 128 {
+		t.Errorf("block sizes = %v, want [1024 128]", r.blocks)
+	}
+}
+
+func TestSendCRCIgnoresNAKHandshake(t *testing.T) {
+	r := newFakeReceiver(t, true)
+	r.replies = []byte{nak, nak, crcRequest}
+	if err := Send(r, strings.NewReader("hi"), Options{Protocol: XModemCRC}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+}
+
+func TestSendHandshakeTimeout(t *testing.T) {
+	r := newFakeReceiver(t, true)
+	r.replies = nil
+	err := Send(r, strings.NewReader("hi"), Options{HandshakeTimeout: 10 * time.Millisecond})
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("Send() = %v, want ErrTimeout", err)
+	}
+}
+
+type cancelingReceiver struct {
+	fakeReceiver
+}
+
+func (r *cancelingReceiver) Write(p []byte) (int, error) {
+	r.replies = append(r.replies, can, can)
+	return len(p), nil
+}
+
+func TestSendCanceled(t *testing.T) {
+	r := &cancelingReceiver{fakeReceiver{t: t, replies: []byte{crcRequest}}}
+	err := Send(r, strings.NewReader("hi"), Options{})
+	if !errors.Is(err, ErrCanceled) {
+		t.Errorf("Send() = %v, want ErrCanceled", err)
+	}
+}
+
+// noisyReceiver sends a lone CAN, as line noise might, before each reply.
+type noisyReceiver struct {
+	fakeReceiver
+}
+
+func (r *noisyReceiver) Write(p []byte) (int, error) {
+	n, err := r.fakeReceiver.Write(p)
+	r.replies = append([]byte{can}, r.replies...)
+	return n, err
+}
+
+func TestSendLoneCAN(t *testing.T) {
+	r := &noisyReceiver{*newFakeReceiver(t, true)}
+	r.replies = []byte{can, crcRequest}
+	data := strings.Repeat("x", 300)
+	err := Send(r, strings.NewReader(data), Options{
+		Protocol:         XModemCRC,
+		Timeout:          10 * time.Millisecond,
+		HandshakeTimeout: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Send() = %v", err)
+	}
+	// Each block is sent once: the reply after each CAN is not lost.
+	if len(r.blocks) != 3 {
+		t.Errorf("%d blocks received, want 3", len(r.blocks))
+	}
+	if got := r.got.String(); !strings.HasPrefix(got, data) {
+		t.Errorf("received %q, want %q followed by padding", got, data)
+	}
+}
+
+type silentReceiver struct {
+	fakeReceiver
+	writes int
+}
+
+func (r *silentReceiver) Write(p []byte) (int, error) {
+	r.writes++
+	return len(p), nil
+}
+
+func TestSendRetryLimit(t *testing.T) {
+	r := &silentReceiver{fakeReceiver: fakeReceiver{t: t, replies: []byte{crcRequest}}}
+	err := Send(r, strings.NewReader("hi"), Options{Timeout: time.Millisecond, MaxRetries: 3})
+	if err == nil {
+		t.Fatal("Send() succeeded, want an error")
+	}
+	// Four copies of the block, then the cancel sequence.
+	if r.writes != 5 {
+		t.Errorf("writes = %d, want 5", r.writes)
+	}
+}
+
+func TestCRC16(t *testing.T) {
+	if got := CRC16([]byte("123456789")); got != 0x31c3 {
+		t.Errorf("CRC16 = %#x, want 0x31c3", got)
+	}
+}
+
+// batchReceiver is an in-memory YMODEM receiver.
+type batchReceiver struct {
+	t       *testing.T
+	replies []byte
+	// headers holds the contents of each header block, up to the first NUL
+	// after the file information.
+	headers []string
+	files   []bytes.Buffer
+	eots    int
+}
+
+func (r *batchReceiver) ReadByteTimeout(timeout time.Duration) (byte, error) {
+	if len(r.replies) == 0 {
+		return 0, ErrTimeout
+	}
+	b := r.replies[0]
+	r.replies = r.replies[1:]
+	return b, nil
+}
+
+func (r *batchReceiver) Write(p []byte) (int, error) {
+	if len(p) == 1 && p[0] == eot {
+		// Like most receivers, reject the first EOT to guard against noise.
+		r.eots++
+		if r.eots%2 == 1 {
+			r.replies = append(r.replies, nak)
+		} else {
+			r.replies = append(r.replies, ack, crcRequest)
+		}
+		return 1, nil
+	}
+	size := 128
+	if p[0] == stx {
+		size = 1024
+	}
+	data := p[3 : 3+size]
+	c := CRC16(data)
+	if len(p) != 3+size+2 || p[3+size] != byte(c>>8) || p[4+size] != byte(c) {
+		r.t.Fatalf("bad packet for block %d", p[1])
+	}
+	if p[1] == 0 && (len(r.files) == len(r.headers)) {
+		h := bytes.TrimRight(data, "\x00")
+		r.headers = append(r.headers, string(h))
+		if len(h) > 0 {
+			r.files = append(r.files, bytes.Buffer{})
+			r.replies = append(r.replies, ack, crcRequest)
+		} else {
+			r.replies = append(r.replies, ack)
+		}
+		return len(p), nil
+	}
+	r.files[len(r.files)-1].Write(data)
+	r.replies = append(r.replies, ack)
+	return len(p), nil
+}
+
+func TestSendBatch(t *testing.T) {
+	first := strings.Repeat("a", 1500)
+	second := "short"
+	mtime := time.Unix(0o14000000000, 0)
+	r := &batchReceiver{t: t, replies: []byte{crcRequest}}
+	var progress []Progress
+	err := SendBatch(r, []File{
+		{Name: "first.bin", Size: int64(len(first)), ModTime: mtime, Data: strings.NewReader(first)},
+		{Name: "second.txt", Size: int64(len(second)), Data: strings.NewReader(second)},
+	}, Options{
+		Progress: func(p Progress) { progress = append(progress, p) },
+	})
+	if err != nil {
+		t.Fatalf("SendBatch: %v", err)
+	}
+
+	wantHeaders := []string{
+		"first.bin\x001500 14000000000",
+		"second.txt\x005",
+		"",
+	}
+	if len(r.headers) != len(wantHeaders) {
+		t.Fatalf("headers = %q, want %q", r.headers, wantHeaders)
+	}
+	for i := range wantHeaders {
+		if r.headers[i] != wantHeaders[i] {
+			t.Errorf("header %d = %q, want %q", i, r.headers[i], wantHeaders[i])
+		}
+	}
+	for i, want := range []string{first, second} {
+		got := r.files[i].String()
+		if len(got) < len(want) || got[:len(want)] != want {
+			t.Errorf("file %d = %q, want %q followed by padding", i, got, want)
+		}
+	}
+	wantProgress := []Progress{
+		{File: "first.bin", Block: 1, Bytes: 1024},
+		{File: "first.bin", Block: 2, Bytes: 1500},
+		{File: "second.txt", Index: 1, Block: 1, Bytes: 5},
+	}
+	if len(progress) != len(wantProgress) {
+		t.Fatalf("progress = %+v, want %+v", progress, wantProgress)
+	}
+	for i := range wantProgress {
+		if progress[i] != wantProgress[i] {
+			t.Errorf("progress[%d] = %+v, want %+v", i, progress[i], wantProgress[i])
+		}
+	}
+}
@@ -0,0 +1,674 @@
+// SPDX-License-Identifier: Apache-2.0
+
+// Package zmodem implements the sending side of the ZMODEM file transfer
+// protocol.
+//
+// Data is streamed with 32-bit CRCs when the receiver supports them, and the
+// sender resumes from whatever offset the receiver asks for with ZRPOS, both
+// after a transmission error and when resuming an interrupted transfer.
+// XON and XOFF are always escaped, so that they are never seen on the link
+// except as flow control.
+package zmodem
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/filmil/futility/xmodem"
+)
+
+// Conn is the link a transfer runs over. It is the same as for the xmodem
+// package, and ReadByteTimeout must return ErrTimeout if nothing arrived in
+// time. A timeout of zero polls for a byte that has already arrived.
+type Conn = xmodem.Conn
+
+var (
+	// ErrTimeout is returned by Conn.ReadByteTimeout when no byte arrived in time.
+	ErrTimeout = xmodem.ErrTimeout
+	// ErrCanceled is returned when the receiver cancels the transfer.
+	ErrCanceled = xmodem.ErrCanceled
+
+	errBadHeader = errors.New("garbled header")
+)
+
+const (
+	zpad   = '*'
+	zdle   = 0x18
+	zbin   = 'A'
+	zhex   = 'B'
+	zbin32 = 'C'
+
+	xon  = 0x11
+	xoff = 0x13
+)
+
+// Frame types.
+const (
+	zrqinit    = 0
+	zrinit     = 1
+	zack       = 3
+	zfile      = 4
+	zskip      = 5
+	znak       = 6
+	zabort     = 7
+	zfin       = 8
+	zrpos      = 9
+	zdata      = 10
+	zeof       = 11
+	zferr      = 12
+	zchallenge = 14
+)
+
+// Data subpacket frame ends.
+const (
+	zcrce = 'h' // End of frame, header follows.
+	zcrcg = 'i' // Frame continues without a reply.
+	zcrcq = 'j' // Frame continues, ZACK expected.
+	zcrcw = 'k' // End of frame, ZACK expected.
+)
+
+// ZRINIT capability flags, in ZF0.
+const (
+	canfc32 = 0x20
+	escctl  = 0x40
+)
+
+// ZFILE conversion options, in ZF0.
+const (
+	zcbin   = 1
+	zcresum = 3
+)
+
+// Header byte positions. Positions and sizes are little-endian from p0;
+// flags are numbered from the other end.
+const (
+	p0 = 0
+	p1 = 1
+	f0 = 3
+)
+
+// File is a file to send.
+type File struct {
+	// Name is the file name given to the receiver.
+	Name string
+	// Size is the length of the file in bytes.
+	Size int64
+	// ModTime is the modification time given to the receiver, if not zero.
+	ModTime time.Time
+	// Data is the contents of the file. It must be seekable, since the
+	// receiver decides where each transmission starts.
+	Data io.ReadSeeker
+}
+
+// Progress describes data that has been sent.
+type Progress struct {
+	// File is the name of the file being sent.
+	File string
+	// Index is the index of the file in the files sent, starting at 0.
+	Index int
+	// Offset is the position in the file up to which data has been sent.
+	Offset int64
+	// Restarted is set when the receiver asked for the data to be sent again
+	// from Offset, after an error or to resume an earlier transfer.
+	Restarted bool
+}
+
+// Options configure a transfer.
+type Options struct {
+	// Timeout bounds the wait for each reply from the receiver. Defaults to
+	// ten seconds.
+	Timeout time.Duration
+	// MaxRetries is the number of times a header is resent, or the data
+	// resent from the same offset, before giving up. Defaults to ten.
+	MaxRetries int
+	// BlockSize is the size of data subpackets. Defaults to 1024.
+	BlockSize int
+	// Resume asks the receiver to continue files that it has partially
+	// received already, rather than to overwrite them.
+	Resume bool
+	// Progress, if set, is called after each data subpacket, and when the
+	// receiver asks for data to be resent.
+	Progress func(Progress)
+}
+
+func (o *Options) setDefaults() {
+	if o.Timeout == 0 {
+		o.Timeout = 10 * time.Second
+	}
+	if o.MaxRetries == 0 {
+		o.MaxRetries = 10
+	}
+	if o.BlockSize == 0 {
+		o.BlockSize = 1024
+	}
+}
+
+// Send transfers files over conn in a single ZMODEM session.
+func Send(conn Conn, files []File, opts Options) error {
+	opts.setDefaults()
+	s := &sender{conn: conn, opts: opts}
+
+	if err := s.init(); err != nil {
+		s.abort(err)
+		return err
+	}
+	for i, f := range files {
+		s.index = i
+		if err := s.sendFile(f); err != nil {
+			s.abort(err)
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+	}
+	if err := s.finish(); err != nil {
+		s.abort(err)
+		return err
+	}
+	return nil
+}
+
+type sender struct {
+	conn Conn
+	opts Options
+
+	// Receiver capabilities, from ZRINIT.
+	crc32   bool
+	escctl  bool
+	bufSize int
+
+	// cans counts consecutive CAN bytes received.
+	cans int
+	// pushback holds a byte that was read but not consumed.
+	pushback []byte
+	// index is the index of the file being sent.
+	index int
+}
+
+// init starts the session, and learns the receiver's capabilities.
+func (s *sender) init() error {
+	for try := 0; try <= s.opts.MaxRetries; try++ {
+		if err := s.writeHexHeader(zrqinit, [4]byte{}); err != nil {
+			return err
+		}
+		for {
+			typ, hdr, err := s.readHeader(s.opts.Timeout)
+			if err == ErrTimeout || err == errBadHeader {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			switch typ {
+			case zrinit:
+				s.crc32 = hdr[f0]&canfc32 != 0
+				s.escctl = hdr[f0]&escctl != 0
+				s.bufSize = int(hdr[p0]) | int(hdr[p1])<<8
+				return nil
+			case zchallenge:
+				if err := s.writeHexHeader(zack, hdr); err != nil {
+					return err
+				}
+				continue
+			}
+			break
+		}
+	}
+	return fmt.Errorf("receiver did not start the session: %w", ErrTimeout)
+}
+
+// sendFile offers f to the receiver, and sends it from the offset that the
+// receiver asks for.
+func (s *sender) sendFile(f File) error {
+	var info []byte
+	info = append(info, f.Name...)
+	info = append(info, 0)
+	info = fmt.Appendf(info, "%d", f.Size)
+	if !f.ModTime.IsZero() {
+		info = fmt.Appendf(info, " %o", f.ModTime.Unix())
+	}
+	info = append(info, 0)
+
+	var opts [4]byte
+	opts[f0] = zcbin
+	if s.opts.Resume {
+		opts[f0] = zcresum
+	}
+
+	for try := 0; try <= s.opts.MaxRetries; try++ {
+		if err := s.writeBinHeader(zfile, opts); err != nil {
+			return err
+		}
+		if err := s.writeData(info, zcrcw); err != nil {
+			return err
+		}
+		typ, hdr, err := s.readHeader(s.opts.Timeout)
+		if err == ErrTimeout || err == errBadHeader {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case zrpos:
+			return s.sendData(f, position(hdr))
+		case zskip:
+			return nil
+		case zferr, zabort:
+			return fmt.Errorf("receiver refused the file (frame type %d)", typ)
+		}
+		// ZRINIT, ZNAK and anything else mean that the receiver did not get
+		// the offer.
+	}
+	return fmt.Errorf("receiver did not accept the file: %w", ErrTimeout)
+}
+
+// sendData streams f starting at offset, going back to wherever the receiver
+// asks with ZRPOS, until the receiver confirms the end of the file.
+func (s *sender) sendData(f File, offset int64) error {
+	buf := make([]byte, s.opts.BlockSize)
+	restarted := offset != 0
+	retries := 0
+	lastRestart := int64(-1)
+
+Restart:
+	for {
+		if restarted {
+			if offset == lastRestart {
+				retries++
+				if retries > s.opts.MaxRetries {
+					return fmt.Errorf("too many errors at offset %d", offset)
+				}
+			} else {
+				retries = 0
+			}
+			lastRestart = offset
+			s.progress(f.Name, offset, true)
+		}
+		if _, err := f.Data.Seek(offset, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek to %d: %w", offset, err)
+		}
+		if err := s.writeBinHeader(zdata, position32(offset)); err != nil {
+			return err
+		}
+
+		var unacked int
+		for {
+			n, err := io.ReadFull(f.Data, buf)
+			eof := err == io.EOF || err == io.ErrUnexpectedEOF
+			if err != nil && !eof {
+				return fmt.Errorf("failed to read file: %w", err)
+			}
+			end := byte(zcrcg)
+			unacked += n
+			switch {
+			case eof:
+				end = zcrce
+			case s.bufSize > 0 && unacked+len(buf) > s.bufSize:
+				end = zcrcw
+			}
+			if err := s.writeData(buf[:n], end); err != nil {
+				return err
+			}
+			offset += int64(n)
+			s.progress(f.Name, offset, false)
+
+			if end == zcrcw {
+				unacked = 0
+				pos, err := s.awaitAck()
+				if err != nil {
+					return err
+				}
+				if pos >= 0 {
+					offset, restarted = pos, true
+					continue Restart
+				}
+			} else if pos, err := s.checkInterrupt(); err != nil {
+				return err
+			} else if pos >= 0 {
+				offset, restarted = pos, true
+				continue Restart
+			}
+			if eof {
+				break
+			}
+		}
+
+		// The data is all sent: confirm the end of the file.
+		for try := 0; ; try++ {
+			if try > s.opts.MaxRetries {
+				return fmt.Errorf("receiver did not confirm the end of file: %w", ErrTimeout)
+			}
+			if err := s.writeBinHeader(zeof, position32(offset)); err != nil {
+				return err
+			}
+			typ, hdr, err := s.readHeader(s.opts.Timeout)
+			if err == ErrTimeout || err == errBadHeader {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			switch typ {
+			case zrinit, zskip:
+				return nil
+			case zrpos:
+				offset, restarted = position(hdr), true
+				continue Restart
+			case zferr, zabort:
+				return fmt.Errorf("receiver aborted the file (frame type %d)", typ)
+			}
+		}
+	}
+}
+
+// awaitAck waits for the receiver to acknowledge a ZCRCW subpacket. It
+// returns the offset to restart from if the receiver asked for one, or -1.
+func (s *sender) awaitAck() (int64, error) {
+	for try := 0; try <= s.opts.MaxRetries; try++ {
+		typ, hdr, err := s.readHeader(s.opts.Timeout)
+		if err == ErrTimeout || err == errBadHeader {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		switch typ {
+		case zack:
+			return -1, nil
+		case zrpos:
+			return position(hdr), nil
+		case zferr, zabort:
+			return 0, fmt.Errorf("receiver aborted the file (frame type %d)", typ)
+		}
+	}
+	return 0, fmt.Errorf("receiver did not acknowledge data: %w", ErrTimeout)
+}
+
+// checkInterrupt looks for a header that the receiver sent while data was
+// being streamed. It returns the offset to restart from if the receiver asked
+// for one, or -1.
+func (s *sender) checkInterrupt() (int64, error) {
+	b, err := s.readByte(0)
+	if err == ErrTimeout {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if b != zpad && b != zdle {
+		// Line noise.
+		return -1, nil
+	}
+	s.pushback = append(s.pushback, b)
+	typ, hdr, err := s.readHeader(s.opts.Timeout)
+	if err == ErrTimeout || err == errBadHeader {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	switch typ {
+	case zrpos:
+		return position(hdr), nil
+	case zferr, zabort:
+		return 0, fmt.Errorf("receiver aborted the file (frame type %d)", typ)
+	}
+	return -1, nil
+}
+
+// finish ends the session.
+func (s *sender) finish() error {
+	for try := 0; try <= s.opts.MaxRetries; try++ {
+		if err := s.writeHexHeader(zfin, [4]byte{}); err != nil {
+			return err
+		}
+		typ, _, err := s.readHeader(s.opts.Timeout)
+		if err == ErrTimeout || err == errBadHeader {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if typ == zfin {
+			_, err := s.conn.Write([]byte("OO"))
+			return err
+		}
+	}
+	return fmt.Errorf("receiver did not end the session: %w", ErrTimeout)
+}
+
+// abort cancels the session, unless the receiver did so already.
+func (s *sender) abort(err error) {
+	if errors.Is(err, ErrCanceled) {
+		return
+	}
+	s.conn.Write([]byte{
+		zdle, zdle, zdle, zdle, zdle, zdle, zdle, zdle,
+		8, 8, 8, 8, 8, 8, 8, 8, 8, 8,
+	})
+}
+
+func (s *sender) progress(name string, offset int64, restarted bool) {
+	if s.opts.Progress != nil {
+		s.opts.Progress(Progress{File: name, Index: s.index, Offset: offset, Restarted: restarted})
+	}
+}
+
+// readByte reads a byte, and detects the run of CANs that cancels a session.
+func (s *sender) readByte(timeout time.Duration) (byte, error) {
+	if len(s.pushback) > 0 {
+		b := s.pushback[0]
+		s.pushback = s.pushback[1:]
+		return b, nil
+	}
+	b, err := s.conn.ReadByteTimeout(timeout)
+	if err != nil {
+		return 0, err
+	}
+	if b == zdle {
+		s.cans++
+		if s.cans >= 5 {
+			return 0, ErrCanceled
+		}
+	} else {
+		s.cans = 0
+	}
+	return b, nil
+}
+
+// readHeader waits for the next header from the receiver, skipping over
+// anything that is not one.
+func (s *sender) readHeader(timeout time.Duration) (byte, [4]byte, error) {
+	var hdr [4]byte
+	deadline := time.Now().Add(timeout)
+	next := func() (byte, error) {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return 0, ErrTimeout
+		}
+		return s.readByte(left)
+	}
+
+	for {
+		b, err := next()
+		if err != nil {
+			return 0, hdr, err
+		}
+		if b != zpad {
+			continue
+		}
+		for b == zpad {
+			if b, err = next(); err != nil {
+				return 0, hdr, err
+			}
+		}
+		if b != zdle {
+			continue
+		}
+		format, err := next()
+		if err != nil {
+			return 0, hdr, err
+		}
+
+		var raw []byte
+		switch format {
+		case zhex:
+			raw, err = s.readHex(next)
+		case zbin:
+			raw, err = s.readEscaped(next, 7)
+		case zbin32:
+			raw, err = s.readEscaped(next, 9)
+		default:
+			continue
+		}
+		if err != nil {
+			return 0, hdr, err
+		}
+		if format == zbin32 {
+			c := crc32.ChecksumIEEE(raw[:5])
+			if uint32(raw[5])|uint32(raw[6])<<8|uint32(raw[7])<<16|uint32(raw[8])<<24 != c {
+				return 0, hdr, errBadHeader
+			}
+		} else if xmodem.CRC16(raw[:5]) != uint16(raw[5])<<8|uint16(raw[6]) {
+			return 0, hdr, errBadHeader
+		}
+		copy(hdr[:], raw[1:5])
+		return raw[0], hdr, nil
+	}
+}
+
+// readHex reads the seven bytes of a hex header.
+func (s *sender) readHex(next func() (byte, error)) ([]byte, error) {
+	raw := make([]byte, 7)
+	for i := range raw {
+		for j := 0; j < 2; j++ {
+			c, err := next()
+			if err != nil {
+				return nil, err
+			}
+			var v byte
+			switch {
+			case c >= '0' && c <= '9':
+				v = c - '0'
+			case c >= 'a' && c <= 'f':
+				v = c - 'a' + 10
+			case c >= 'A' && c <= 'F':
+				v = c - 'A' + 10
+			default:
+				return nil, errBadHeader
+			}
+			raw[i] = raw[i]<<4 | v
+		}
+	}
+	return raw, nil
+}
+
+// readEscaped reads n ZDLE-encoded bytes.
+func (s *sender) readEscaped(next func() (byte, error), n int) ([]byte, error) {
+	raw := make([]byte, 0, n)
+	for len(raw) < n {
+		b, err := next()
+		if err != nil {
+			return nil, err
+		}
+		switch b {
+		case xon, xoff, xon | 0x80, xoff | 0x80:
+			continue
+		case zdle:
+			if b, err = next(); err != nil {
+				return nil, err
+			}
+			switch {
+			case b == 'l':
+				b = 0x7f
+			case b == 'm':
+				b = 0xff
+			case b&0x60 == 0x40:
+				b ^= 0x40
+			default:
+				return nil, errBadHeader
+			}
+		}
+		raw = append(raw, b)
+	}
+	return raw, nil
+}
+
+// writeHexHeader sends a header in hex, as used for headers that carry no
+// data.
+func (s *sender) writeHexHeader(typ byte, hdr [4]byte) error {
+	raw := append([]byte{typ}, hdr[:]...)
+	c := xmodem.CRC16(raw)
+	raw = append(raw, byte(c>>8), byte(c))
+	out := []byte{zpad, zpad, zdle, zhex}
+	out = fmt.Appendf(out, "%x\r\x8a", raw)
+	if typ != zfin && typ != zack {
+		out = append(out, xon)
+	}
+	_, err := s.conn.Write(out)
+	return err
+}
+
+// writeBinHeader sends a header in binary, as used for headers followed by a
+// data subpacket.
+func (s *sender) writeBinHeader(typ byte, hdr [4]byte) error {
+	raw := append([]byte{typ}, hdr[:]...)
+	out := []byte{zpad, zdle}
+	if s.crc32 {
+		c := crc32.ChecksumIEEE(raw)
+		raw = append(raw, byte(c), byte(c>>8), byte(c>>16), byte(c>>24))
+		out = append(out, zbin32)
+	} else {
+		c := xmodem.CRC16(raw)
+		raw = append(raw, byte(c>>8), byte(c))
+		out = append(out, zbin)
+	}
+	out = s.escape(out, raw)
+	_, err := s.conn.Write(out)
+	return err
+}
+
+// writeData sends a data subpacket ending with end.
+func (s *sender) writeData(data []byte, end byte) error {
+	out := s.escape(make([]byte, 0, len(data)+len(data)/8+16), data)
+	out = append(out, zdle, end)
+	if s.crc32 {
+		c := crc32.Update(crc32.ChecksumIEEE(data), crc32.IEEETable, []byte{end})
+		out = s.escape(out, []byte{byte(c), byte(c >> 8), byte(c >> 16), byte(c >> 24)})
+	} else {
+		c := xmodem.CRC16(append(append([]byte{}, data...), end))
+		out = s.escape(out, []byte{byte(c >> 8), byte(c)})
+	}
+	if _, err := s.conn.Write(out); err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+	return nil
+}
+
+// escape appends data to out, ZDLE-encoding the bytes that must not appear
+// on the link.
+func (s *sender) escape(out, data []byte) []byte {
+	for _, b := range data {
+		switch {
+		case b == zdle, b == 0x10, b == 0x90, b == xon, b == xon|0x80, b == xoff, b == xoff|0x80:
+			out = append(out, zdle, b^0x40)
+		case s.escctl && b&0x60 == 0:
+			out = append(out, zdle, b^0x40)
+		default:
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// position decodes the file position carried in a header.
+func position(hdr [4]byte) int64 {
+	return int64(hdr[0]) | int64(hdr[1])<<8 | int64(hdr[2])<<16 | int64(hdr[3])<<24
+}
+
+// position32 encodes a file position for a header.
+func position32(offset int64) [4]byte {
+	return [4]byte{byte(offset), byte(offset >> 8), byte(offset >> 16), byte(offset >> 24)}
+}
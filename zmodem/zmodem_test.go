@@ -0,0 +1,314 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package zmodem
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/filmil/futility/xmodem"
+)
+
+// pipeConn is one end of an in-memory link.
+type pipeConn struct {
+	in  <-chan byte
+	out chan<- byte
+}
+
+func newPipe() (*pipeConn, *pipeConn) {
+	a := make(chan byte, 1<<20)
+	b := make(chan byte, 1<<20)
+	return &pipeConn{in: a, out: b}, &pipeConn{in: b, out: a}
+}
+
+func (c *pipeConn) Write(p []byte) (int, error) {
+	for _, b := range p {
+		c.out <- b
+	}
+	return len(p), nil
+}
+
+func (c *pipeConn) ReadByteTimeout(timeout time.Duration) (byte, error) {
+	select {
+	case b := <-c.in:
+		return b, nil
+	default:
+	}
+	if timeout <= 0 {
+		return 0, ErrTimeout
+	}
+	select {
+	case b := <-c.in:
+		return b, nil
+	case <-time.After(timeout):
+		return 0, ErrTimeout
+	}
+}
+
+// receiver is an in-memory ZMODEM receiver. It reuses the sender's header
+// encoding, which is the same in both directions.
+type receiver struct {
+	s     *sender
+	files map[string]*bytes.Buffer
+	infos []string
+	// resume gives the offset to ask for, by file name, in reply to ZFILE.
+	resume map[string]int64
+	// corruptAt makes the receiver pretend that the data at this offset was
+	// garbled, once, and ask for it again.
+	corruptAt int64
+	corrupted bool
+	// options records ZF0 of each ZFILE header.
+	options []byte
+}
+
+func newReceiver(conn Conn, flags byte) *receiver {
+	r := &receiver{
+		s:         &sender{conn: conn, opts: Options{Timeout: time.Second}, crc32: flags&canfc32 != 0},
+		files:     map[string]*bytes.Buffer{},
+		resume:    map[string]int64{},
+		corruptAt: -1,
+	}
+	return r
+}
+
+// readSubpacket reads one data subpacket.
+func (r *receiver) readSubpacket() ([]byte, byte, error) {
+	var data []byte
+	for {
+		b, err := r.s.readByte(time.Second)
+		if err != nil {
+			return nil, 0, err
+		}
+		if b != zdle {
+			data = append(data, b)
+			continue
+		}
+		if b, err = r.s.readByte(time.Second); err != nil {
+			return nil, 0, err
+		}
+		switch b {
+		case zcrce, zcrcg, zcrcq, zcrcw:
+			n := 2
+			if r.s.crc32 {
+				n = 4
+			}
+			next := func() (byte, error) { return r.s.readByte(time.Second) }
+			if _, err := r.s.readEscaped(next, n); err != nil {
+				return nil, 0, err
+			}
+			return data, b, nil
+		}
+		data = append(data, b^0x40)
+	}
+}
+
+func (r *receiver) run(flags byte, bufSize int) error {
+	var name string
+	var offset int64
+	init := [4]byte{p0: byte(bufSize), p1: byte(bufSize >> 8), f0: flags}
+	for {
+		typ, hdr, err := r.s.readHeader(time.Second)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case zrqinit:
+			r.s.writeHexHeader(zrinit, init)
+		case zfile:
+			r.options = append(r.options, hdr[f0])
+			info, _, err := r.readSubpacket()
+			if err != nil {
+				return err
+			}
+			r.infos = append(r.infos, string(info))
+			name = strings.SplitN(string(info), "\x00", 2)[0]
+			offset = r.resume[name]
+			buf := &bytes.Buffer{}
+			buf.WriteString(strings.Repeat("?", int(offset)))
+			r.files[name] = buf
+			r.s.writeHexHeader(zrpos, position32(offset))
+		case zdata:
+			if position(hdr) != offset {
+				return fmt.Errorf("ZDATA at %d, want %d", position(hdr), offset)
+			}
+		Data:
+			for {
+				data, end, err := r.readSubpacket()
+				if err != nil {
+					return err
+				}
+				if !r.corrupted && r.corruptAt >= 0 && offset+int64(len(data)) > r.corruptAt {
+					r.corrupted = true
+					r.s.writeHexHeader(zrpos, position32(offset))
+					break Data
+				}
+				r.files[name].Write(data)
+				offset += int64(len(data))
+				switch end {
+				case zcrcw:
+					r.s.writeHexHeader(zack, position32(offset))
+				case zcrce:
+					break Data
+				}
+			}
+		case zeof:
+			// A ZEOF that does not match the received data is stale, sent
+			// before the sender saw a ZRPOS.
+			if position(hdr) == offset {
+				r.s.writeHexHeader(zrinit, init)
+			}
+		case zfin:
+			r.s.writeHexHeader(zfin, [4]byte{})
+			// Skip the end of the sender's ZFIN header.
+			var got []byte
+			for len(got) < 2 {
+				b, err := r.s.readByte(time.Second)
+				if err != nil {
+					return err
+				}
+				if b == '\r' || b == '\n'|0x80 {
+					continue
+				}
+				got = append(got, b)
+			}
+			if string(got) != "OO" {
+				return fmt.Errorf("got %q after ZFIN, want \"OO\"", got)
+			}
+			return nil
+		}
+	}
+}
+
+// allBytes has every byte value, so that all escapes are exercised.
+func allBytes(n int) string {
+	var b []byte
+	for len(b) < n {
+		b = append(b, byte(len(b)))
+	}
+	return string(b)
+}
+
+func TestSend(t *testing.T) {
+	first := allBytes(5000)
+	second := "short"
+	tests := []struct {
+		name      string
+		flags     byte
+		bufSize   int
+		resume    map[string]int64
+		corruptAt int64
+	}{
+		{name: "CRC-16", flags: 0},
+		{name: "CRC-32", flags: canfc32},
+		{name: "escape control characters", flags: canfc32 | escctl},
+		{name: "receiver buffer", flags: canfc32, bufSize: 2048},
+		{name: "error recovery", flags: canfc32, corruptAt: 2500},
+		{name: "resume", flags: canfc32, resume: map[string]int64{"first.bin": 3000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sconn, rconn := newPipe()
+			r := newReceiver(rconn, tt.flags)
+			if tt.resume != nil {
+				r.resume = tt.resume
+			}
+			if tt.corruptAt != 0 {
+				r.corruptAt = tt.corruptAt
+			}
+			recvErr := make(chan error, 1)
+			go func() { recvErr <- r.run(tt.flags, tt.bufSize) }()
+
+			var restarts []int64
+			err := Send(sconn, []File{
+				{Name: "first.bin", Size: int64(len(first)), ModTime: time.Unix(0o10, 0), Data: strings.NewReader(first)},
+				{Name: "second.txt", Size: int64(len(second)), Data: strings.NewReader(second)},
+			}, Options{
+				Timeout: time.Second,
+				Resume:  tt.resume != nil,
+				Progress: func(p Progress) {
+					if p.Restarted {
+						restarts = append(restarts, p.Offset)
+					}
+				},
+			})
+			if err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			if err := <-recvErr; err != nil {
+				t.Fatalf("receiver: %v", err)
+			}
+
+			wantFirst := first
+			if off := tt.resume["first.bin"]; off > 0 {
+				wantFirst = strings.Repeat("?", int(off)) + first[off:]
+			}
+			if got := r.files["first.bin"].String(); got != wantFirst {
+				t.Errorf("first.bin differs: got %d bytes, want %d", len(got), len(wantFirst))
+			}
+			if got := r.files["second.txt"].String(); got != second {
+				t.Errorf("second.txt = %q, want %q", got, second)
+			}
+			wantInfos := []string{"first.bin\x005000 10\x00", "second.txt\x005\x00"}
+			if fmt.Sprint(r.infos) != fmt.Sprint(wantInfos) {
+				t.Errorf("file info = %q, want %q", r.infos, wantInfos)
+			}
+			wantOption := byte(zcbin)
+			if tt.resume != nil {
+				wantOption = zcresum
+			}
+			if r.options[0] != wantOption {
+				t.Errorf("ZFILE option = %d, want %d", r.options[0], wantOption)
+			}
+			switch {
+			case tt.resume != nil:
+				if len(restarts) != 1 || restarts[0] != 3000 {
+					t.Errorf("restarts = %v, want [3000]", restarts)
+				}
+			case tt.corruptAt != 0:
+				if len(restarts) != 1 || restarts[0] != 2048 {
+					t.Errorf("restarts = %v, want [2048]", restarts)
+				}
+			default:
+				if len(restarts) != 0 {
+					t.Errorf("restarts = %v, want none", restarts)
+				}
+			}
+		})
+	}
+}
+
+func TestEscapeXONXOFF(t *testing.T) {
+	s := &sender{}
+	out := s.escape(nil, []byte{'a', xon, xoff, xon | 0x80, xoff | 0x80, zdle, 'b'})
+	for _, b := range out {
+		if b == xon || b == xoff || b == xon|0x80 || b == xoff|0x80 {
+			t.Errorf("escaped data % x contains XON or XOFF", out)
+		}
+	}
+}
+
+func TestSendCanceled(t *testing.T) {
+	sconn, rconn := newPipe()
+	go func() {
+		r := newReceiver(rconn, 0)
+		r.s.readHeader(time.Second)
+		rconn.Write([]byte{zdle, zdle, zdle, zdle, zdle, zdle, zdle, zdle})
+	}()
+	err := Send(sconn, nil, Options{Timeout: time.Second})
+	// The same error as for XMODEM and YMODEM.
+	if !errors.Is(err, xmodem.ErrCanceled) {
+		t.Errorf("Send() = %v, want ErrCanceled", err)
+	}
+}
+
+func TestSendNoReceiver(t *testing.T) {
+	sconn, _ := newPipe()
+	err := Send(sconn, nil, Options{Timeout: time.Millisecond, MaxRetries: 2})
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("Send() = %v, want ErrTimeout", err)
+	}
+}